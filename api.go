@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIConfig sets up the HTTP control and status API.
+type APIConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Listen  string `toml:"listen"`
+}
+
+// setupAPI starts the HTTP API in the background, if it's enabled.
+func setupAPI() {
+	if !cfg.API.Enabled {
+		return
+	}
+	if cfg.API.Listen == "" {
+		cfg.API.Listen = "127.0.0.1:8642"
+	}
+
+	go func() {
+		slog.Info("API listening", "addr", cfg.API.Listen)
+		err := http.ListenAndServe(cfg.API.Listen, newAPIHandler())
+		if err != nil {
+			slog.Error("API stopped", "addr", cfg.API.Listen, "err", err)
+		}
+	}()
+}
+
+func newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats", apiMethod("GET", apiStats))
+	mux.HandleFunc("/api/queue", apiMethod("GET", apiQueue))
+	mux.HandleFunc("/api/errors", apiMethod("GET", apiErrors))
+	mux.HandleFunc("/api/run", apiMethod("POST", apiRun))
+	mux.HandleFunc("/api/pause", apiMethod("POST", apiPause))
+	mux.HandleFunc("/api/resume", apiMethod("POST", apiResume))
+	mux.HandleFunc("/api/blogs", apiBlogs)
+	mux.HandleFunc("/api/blogs/", apiBlog)
+	mux.HandleFunc("/metrics", apiMethod("GET", metricsHandler))
+	mux.Handle("/", dashboardHandler())
+	return mux
+}
+
+// apiMethod only lets requests with the given method through.
+func apiMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("can't write an API response", "err", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	apiJSON(w, status, map[string]string{"error": msg})
+}
+
+func apiStats(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, gStats.Snapshot())
+}
+
+func apiQueue(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, map[string]interface{}{
+		"depth":  blogs.QueueDepth(),
+		"paused": downloads.Paused(),
+	})
+}
+
+func apiErrors(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, recentErrors.List())
+}
+
+func apiRun(w http.ResponseWriter, r *http.Request) {
+	triggerRun()
+	apiJSON(w, http.StatusAccepted, map[string]bool{"triggered": true})
+}
+
+func apiPause(w http.ResponseWriter, r *http.Request) {
+	downloads.Pause()
+	apiJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func apiResume(w http.ResponseWriter, r *http.Request) {
+	downloads.Resume()
+	apiJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// apiBlogInfo is what the API returns for a single blog.
+type apiBlogInfo struct {
+	BlogSnapshot
+	Tag           string    `json:"tag,omitempty"`
+	Summary       string    `json:"summary"`
+	LastPostID    int64     `json:"last_post_id"`
+	HighestPostID int64     `json:"highest_post_id"`
+	LastChecked   time.Time `json:"last_checked"`
+	Schedule      string    `json:"schedule,omitempty"`
+	NextDue       time.Time `json:"next_due"`
+	// RescanPending is set if the whole blog will be checked during
+	// the next session.
+	RescanPending bool `json:"rescan_pending"`
+}
+
+func blogInfo(u *User) apiBlogInfo {
+	u.RLock()
+	info := apiBlogInfo{
+		LastPostID:    u.lastPostID,
+		HighestPostID: u.highestPostID,
+		LastChecked:   u.lastChecked,
+		NextDue:       u.nextDue,
+		RescanPending: u.pendingRescan,
+	}
+	u.RUnlock()
+
+	info.Tag, info.Schedule = u.settings()
+
+	info.BlogSnapshot = u.Snapshot()
+	info.Summary = info.BlogSnapshot.String()
+	return info
+}
+
+// apiBlogs lists the blogs on GET, and adds one on POST.
+func apiBlogs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		infos := []apiBlogInfo{}
+		for _, u := range blogs.List() {
+			infos = append(infos, blogInfo(u))
+		}
+		apiJSON(w, http.StatusOK, infos)
+
+	case "POST":
+		var req struct {
+			Name     string `json:"name"`
+			Tag      string `json:"tag"`
+			Schedule string `json:"schedule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		u, err := addBlog(req.Name, req.Tag, req.Schedule)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		apiJSON(w, http.StatusCreated, blogInfo(u))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiBlog shows a single blog on GET, changes its tag or schedule on
+// PATCH, and removes it on DELETE. PATCH takes a tag, a schedule, or
+// both. POSTing to /api/blogs/<name>/rescan makes the next session check
+// the whole blog, and starts it right away.
+func apiBlog(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/blogs/"), "/"), "/", 2)
+	name, action := parts[0], ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	u := blogs.Get(name)
+	if u == nil {
+		apiError(w, http.StatusNotFound, "no such blog: "+name)
+		return
+	}
+
+	switch action {
+	case "":
+	case "rescan":
+		apiMethod("POST", func(w http.ResponseWriter, r *http.Request) {
+			u.requestRescan()
+			wakeUp()
+			apiJSON(w, http.StatusAccepted, blogInfo(u))
+		})(w, r)
+		return
+	default:
+		apiError(w, http.StatusNotFound, "no such action: "+action)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiJSON(w, http.StatusOK, blogInfo(u))
+
+	case "PATCH":
+		var req struct {
+			Tag      *string `json:"tag"`
+			Schedule *string `json:"schedule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if req.Tag != nil {
+			if err := setBlogTag(name, *req.Tag); err != nil {
+				apiError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if req.Schedule != nil {
+			if err := setBlogSchedule(name, *req.Schedule); err != nil {
+				apiError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		apiJSON(w, http.StatusOK, blogInfo(u))
+
+	case "DELETE":
+		if err := removeBlog(name); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		apiJSON(w, http.StatusOK, map[string]string{"removed": name})
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
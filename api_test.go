@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func apiRequest(t *testing.T, method, url string) *httptest.ResponseRecorder {
+	return apiRequestBody(t, method, url, "")
+}
+
+func apiRequestBody(t *testing.T, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	newAPIHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAPI(t *testing.T) {
+	oldUsers := blogs.List()
+	defer blogs.Set(oldUsers)
+	defer downloads.Resume()
+
+	blogs.Set([]*User{
+		{name: "demo", tag: "cats", lastPostID: 10, highestPostID: 20},
+	})
+
+	tests := []struct {
+		method, url string
+		status      int
+	}{
+		{"GET", "/api/stats", http.StatusOK},
+		{"GET", "/api/queue", http.StatusOK},
+		{"GET", "/api/errors", http.StatusOK},
+		{"GET", "/api/blogs", http.StatusOK},
+		{"GET", "/api/blogs/demo", http.StatusOK},
+		{"GET", "/api/blogs/missing", http.StatusNotFound},
+		{"PUT", "/api/blogs/demo", http.StatusMethodNotAllowed},
+		{"GET", "/api/run", http.StatusMethodNotAllowed},
+		{"POST", "/api/stats", http.StatusMethodNotAllowed},
+	}
+
+	for i, test := range tests {
+		w := apiRequest(t, test.method, test.url)
+		if w.Code != test.status {
+			t.Errorf("#%d: %s %s=%d; want %d", i, test.method, test.url, w.Code, test.status)
+		}
+	}
+
+	var info apiBlogInfo
+	w := apiRequest(t, "GET", "/api/blogs/demo")
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "demo" || info.Tag != "cats" || info.LastPostID != 10 || info.HighestPostID != 20 {
+		t.Errorf("GET /api/blogs/demo=%+v; want demo, cats, 10, 20", info)
+	}
+}
+
+func TestAPIControl(t *testing.T) {
+	defer downloads.Resume()
+
+	apiRequest(t, "POST", "/api/pause")
+	if !downloads.Paused() {
+		t.Error("downloads not paused after POST /api/pause")
+	}
+
+	var queue struct{ Paused bool }
+	w := apiRequest(t, "GET", "/api/queue")
+	if err := json.NewDecoder(w.Body).Decode(&queue); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Paused {
+		t.Error("GET /api/queue doesn't report downloads as paused")
+	}
+
+	apiRequest(t, "POST", "/api/resume")
+	if downloads.Paused() {
+		t.Error("downloads still paused after POST /api/resume")
+	}
+
+	if w := apiRequest(t, "POST", "/api/run"); w.Code != http.StatusAccepted {
+		t.Errorf("POST /api/run=%d; want %d", w.Code, http.StatusAccepted)
+	}
+	select {
+	case <-runNow:
+	default:
+		t.Error("POST /api/run didn't trigger a run")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	u := &User{name: "demo"}
+	u.recordError(errors.New("broken"))
+
+	var entries []errorEntry
+	w := apiRequest(t, "GET", "/api/errors")
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("GET /api/errors returned no errors")
+	}
+	last := entries[len(entries)-1]
+	if last.Blog != "demo" || last.Error != "broken" {
+		t.Errorf("last error=%+v; want demo: broken", last)
+	}
+}
+
+func TestAPIBlogChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldUserFile := userFile
+	defer func() { userFile = oldUserFile }()
+	userFile = path.Join(dir, "download.txt")
+	err = ioutil.WriteFile(userFile, []byte("demo cats\nother\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldUsers := blogs.List()
+	defer blogs.Set(oldUsers)
+	u, other := &User{name: "demo", tag: "cats"}, &User{name: "other"}
+	blogs.Set([]*User{u, other})
+	gStats.setActive(other, false)
+
+	w := apiRequestBody(t, "PATCH", "/api/blogs/demo", `{"tag": "dogs"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH /api/blogs/demo=%d; want %d", w.Code, http.StatusOK)
+	}
+	if u.tag != "cats" {
+		t.Errorf("tag changed to %s before the next session", u.tag)
+	}
+
+	w = apiRequest(t, "POST", "/api/blogs/demo/rescan")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /api/blogs/demo/rescan=%d; want %d", w.Code, http.StatusAccepted)
+	}
+	<-runNow
+
+	var info apiBlogInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Tag != "dogs" || !info.RescanPending {
+		t.Errorf("blog info=%+v; want dogs with a pending rescan", info)
+	}
+
+	u.reset()
+	gStats.nowScraping.Lock()
+	delete(gStats.nowScraping.Blog, u)
+	gStats.nowScraping.Unlock()
+	if u.tag != "dogs" || !u.forceCheck || u.pendingRescan {
+		t.Errorf("after reset: tag=%s, forceCheck=%t, pendingRescan=%t; want dogs, true, false",
+			u.tag, u.forceCheck, u.pendingRescan)
+	}
+
+	if w := apiRequest(t, "DELETE", "/api/blogs/other"); w.Code != http.StatusOK {
+		t.Errorf("DELETE /api/blogs/other=%d; want %d", w.Code, http.StatusOK)
+	}
+	for _, b := range gStats.Snapshot().Blogs {
+		if b.Name == "other" {
+			t.Error("the removed blog is still in the stats")
+		}
+	}
+	if w := apiRequest(t, "POST", "/api/blogs/demo/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("POST /api/blogs/demo/unknown=%d; want %d", w.Code, http.StatusNotFound)
+	}
+
+	contents, err := ioutil.ReadFile(userFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "demo dogs\n" {
+		t.Errorf("user file=%q; want %q", contents, "demo dogs\n")
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	for _, url := range []string{"/", "/dashboard.js", "/dashboard.css"} {
+		if w := apiRequest(t, "GET", url); w.Code != http.StatusOK {
+			t.Errorf("GET %s=%d; want %d", url, w.Code, http.StatusOK)
+		}
+	}
+}
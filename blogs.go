@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blogList holds the users that get downloaded every session. Users can
+// be added and removed while the downloader runs; changes take effect
+// at the start of the next session.
+type blogList struct {
+	sync.RWMutex
+	users []*User
+
+	// queue is the merged download queue of the current session.
+	queue <-chan File
+}
+
+var blogs blogList
+
+// runNow starts the next session early when server mode is sleeping.
+var runNow = make(chan struct{}, 1)
+
+// runAllRequested is set when the next session should check every
+// blog, not only the ones that are due.
+var runAllRequested int32
+
+// triggerRun asks for a session that checks every blog to start as
+// soon as possible.
+func triggerRun() {
+	atomic.StoreInt32(&runAllRequested, 1)
+	wakeUp()
+}
+
+// wakeUp starts the next session as soon as possible. Only blogs that
+// are due, or have a rescan pending, are checked.
+func wakeUp() {
+	select {
+	case runNow <- struct{}{}:
+	default:
+		// A run is already pending.
+	}
+}
+
+// takeRunAll reports if a session that checks every blog was asked
+// for, and resets the request.
+func takeRunAll() bool {
+	return atomic.SwapInt32(&runAllRequested, 0) == 1
+}
+
+// List returns a copy of the current list of users.
+func (b *blogList) List() []*User {
+	b.RLock()
+	defer b.RUnlock()
+	return append([]*User(nil), b.users...)
+}
+
+// Set replaces the list of users.
+func (b *blogList) Set(users []*User) {
+	b.Lock()
+	b.users = users
+	b.Unlock()
+}
+
+// Get returns the user with the given name, or nil.
+func (b *blogList) Get(name string) *User {
+	b.RLock()
+	defer b.RUnlock()
+	for _, u := range b.users {
+		if u.name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// Add adds a user to the list. It returns false if the user was
+// already in it.
+func (b *blogList) Add(u *User) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, v := range b.users {
+		if v.name == u.name {
+			return false
+		}
+	}
+	b.users = append(b.users, u)
+	return true
+}
+
+// Remove removes the user with the given name. It returns false if
+// there was no such user.
+func (b *blogList) Remove(name string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for i, u := range b.users {
+		if u.name == name {
+			b.users = append(b.users[:i], b.users[i+1:]...)
+			gStats.forget(u)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blogList) setQueue(q <-chan File) {
+	b.Lock()
+	b.queue = q
+	b.Unlock()
+}
+
+// QueueDepth returns the number of files waiting to be downloaded.
+func (b *blogList) QueueDepth() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	n := len(b.queue)
+	for _, u := range b.users {
+		u.RLock()
+		n += len(u.fileChannel)
+		u.RUnlock()
+	}
+	return n
+}
+
+// pauser lets the downloaders be paused and resumed.
+type pauser struct {
+	sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+var downloads pauser
+
+// Pause stops downloaders from starting new downloads. Downloads that
+// already started are finished.
+func (p *pauser) Pause() {
+	p.Lock()
+	defer p.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resume = make(chan struct{})
+	}
+}
+
+// Resume lets the downloaders continue.
+func (p *pauser) Resume() {
+	p.Lock()
+	defer p.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resume)
+	}
+}
+
+// Paused reports whether downloads are paused.
+func (p *pauser) Paused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// Wait blocks while downloads are paused, unless the downloader is
+// shutting down.
+func (p *pauser) Wait() {
+	p.Lock()
+	ch := p.resume
+	paused := p.paused
+	p.Unlock()
+
+	if paused {
+		select {
+		case <-ch:
+		case <-stopCtx.Done():
+		}
+	}
+}
+
+// An errorEntry is an error that happened recently, kept to be shown
+// to anyone who asks.
+type errorEntry struct {
+	Time  time.Time `json:"time"`
+	Blog  string    `json:"blog,omitempty"`
+	Error string    `json:"error"`
+}
+
+// maxRecentErrors is the number of errors kept by recentErrors.
+const maxRecentErrors = 100
+
+// errorLog keeps the last maxRecentErrors errors.
+type errorLog struct {
+	sync.Mutex
+	entries []errorEntry
+}
+
+var recentErrors errorLog
+
+// Add records an error.
+func (l *errorLog) Add(blog string, err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, errorEntry{time.Now(), blog, err.Error()})
+	if len(l.entries) > maxRecentErrors {
+		l.entries = l.entries[len(l.entries)-maxRecentErrors:]
+	}
+}
+
+// List returns the recorded errors, oldest first.
+func (l *errorLog) List() []errorEntry {
+	l.Lock()
+	defer l.Unlock()
+	return append([]errorEntry(nil), l.entries...)
+}
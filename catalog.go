@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	// A pure Go SQLite driver, with full-text search.
+	_ "github.com/glebarez/go-sqlite"
+)
+
+// CatalogConfig sets up the catalog, an SQLite index of every scraped
+// post and downloaded file. Files can be listed with the query command,
+// and posts found with the search command.
+type CatalogConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Path is where the catalog is kept. It's next to the database by
+	// default.
+	Path string `toml:"path"`
+}
+
+// catalog is nil unless the catalog is enabled.
+var catalog *sql.DB
+
+// catalogVersions bring the catalog up to date. Each one is a step to
+// the next version, which is kept in SQLite's user_version.
+var catalogVersions = [][]string{
+	// Files, with their captions and tags indexed for full-text search.
+	// Triggers keep the index up to date. Catalogs made before there
+	// were versions already have these.
+	{
+		`CREATE TABLE IF NOT EXISTS files (
+			id         INTEGER PRIMARY KEY,
+			blog       TEXT NOT NULL,
+			name       TEXT NOT NULL,
+			post_id    INTEGER NOT NULL,
+			type       TEXT NOT NULL,
+			tags       TEXT NOT NULL,
+			caption    TEXT NOT NULL,
+			url        TEXT NOT NULL,
+			path       TEXT NOT NULL,
+			size       INTEGER NOT NULL,
+			sha256     TEXT NOT NULL,
+			posted     INTEGER NOT NULL,
+			downloaded INTEGER NOT NULL,
+			UNIQUE (blog, name)
+		)`,
+		`CREATE INDEX IF NOT EXISTS files_post ON files (blog, post_id)`,
+		`CREATE INDEX IF NOT EXISTS files_posted ON files (posted)`,
+		`CREATE TABLE IF NOT EXISTS file_tags (
+			file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+			tag     TEXT NOT NULL COLLATE NOCASE,
+			PRIMARY KEY (file_id, tag)
+		)`,
+		`CREATE INDEX IF NOT EXISTS file_tags_tag ON file_tags (tag)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS files_text USING fts5(
+			caption, tags, content='files', content_rowid='id'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS files_text_insert AFTER INSERT ON files BEGIN
+			INSERT INTO files_text (rowid, caption, tags) VALUES (new.id, new.caption, new.tags);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS files_text_delete AFTER DELETE ON files BEGIN
+			INSERT INTO files_text (files_text, rowid, caption, tags) VALUES ('delete', old.id, old.caption, old.tags);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS files_text_update AFTER UPDATE ON files BEGIN
+			INSERT INTO files_text (files_text, rowid, caption, tags) VALUES ('delete', old.id, old.caption, old.tags);
+			INSERT INTO files_text (rowid, caption, tags) VALUES (new.id, new.caption, new.tags);
+		END`,
+	},
+	// Every scraped post, with its text indexed for the search command.
+	// Posts that already have files are filled in from them.
+	{
+		`CREATE TABLE posts (
+			id      INTEGER PRIMARY KEY,
+			blog    TEXT NOT NULL,
+			post_id INTEGER NOT NULL,
+			type    TEXT NOT NULL,
+			tags    TEXT NOT NULL,
+			caption TEXT NOT NULL,
+			body    TEXT NOT NULL,
+			answer  TEXT NOT NULL,
+			posted  INTEGER NOT NULL,
+			UNIQUE (blog, post_id)
+		)`,
+		`CREATE INDEX posts_posted ON posts (posted)`,
+		`CREATE TABLE post_tags (
+			post_id INTEGER NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+			tag     TEXT NOT NULL COLLATE NOCASE,
+			PRIMARY KEY (post_id, tag)
+		)`,
+		`CREATE INDEX post_tags_tag ON post_tags (tag)`,
+		`CREATE VIRTUAL TABLE posts_text USING fts5(
+			caption, body, answer, tags, content='posts', content_rowid='id'
+		)`,
+		`CREATE TRIGGER posts_text_insert AFTER INSERT ON posts BEGIN
+			INSERT INTO posts_text (rowid, caption, body, answer, tags)
+				VALUES (new.id, new.caption, new.body, new.answer, new.tags);
+		END`,
+		`CREATE TRIGGER posts_text_delete AFTER DELETE ON posts BEGIN
+			INSERT INTO posts_text (posts_text, rowid, caption, body, answer, tags)
+				VALUES ('delete', old.id, old.caption, old.body, old.answer, old.tags);
+		END`,
+		`CREATE TRIGGER posts_text_update AFTER UPDATE ON posts BEGIN
+			INSERT INTO posts_text (posts_text, rowid, caption, body, answer, tags)
+				VALUES ('delete', old.id, old.caption, old.body, old.answer, old.tags);
+			INSERT INTO posts_text (rowid, caption, body, answer, tags)
+				VALUES (new.id, new.caption, new.body, new.answer, new.tags);
+		END`,
+		`INSERT INTO posts (blog, post_id, type, tags, caption, body, answer, posted)
+			SELECT blog, post_id, type, tags, caption, '', '', posted FROM files
+			GROUP BY blog, post_id`,
+		`INSERT INTO post_tags (post_id, tag)
+			SELECT DISTINCT posts.id, file_tags.tag FROM posts
+			JOIN files ON files.blog = posts.blog AND files.post_id = posts.post_id
+			JOIN file_tags ON file_tags.file_id = files.id`,
+	},
+}
+
+// A postMeta holds what the catalog records about the post a file is
+// from. Every file of a post shares it.
+type postMeta struct {
+	Type    string
+	Tags    []string
+	Caption string
+}
+
+var htmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// newPostMeta collects the catalog details of a post. Captions are
+// stored as plain text.
+func newPostMeta(p Post) *postMeta {
+	var caption string
+	for _, s := range []string{p.PhotoCaption, p.RegularBody, p.Answer, p.VideoCaption} {
+		if s != "" {
+			caption = s
+			break
+		}
+	}
+	return &postMeta{Type: p.Type, Tags: p.Tags, Caption: plainText(caption)}
+}
+
+// plainText strips the HTML from post text.
+func plainText(s string) string {
+	s = html.UnescapeString(htmlTagRegex.ReplaceAllString(s, " "))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// catalogPath returns where the catalog is kept.
+func catalogPath() string {
+	if cfg.Catalog.Path != "" {
+		return cfg.Catalog.Path
+	}
+	return path.Join(path.Dir(databaseFile), "catalog.sqlite")
+}
+
+// openCatalog opens the catalog at p, and creates it if needed.
+func openCatalog(p string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", p+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer at a time anyway.
+	db.SetMaxOpenConns(1)
+
+	if err = migrateCatalog(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateCatalog brings the catalog to the latest version, in one
+// transaction.
+func migrateCatalog(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(catalogVersions) {
+		return fmt.Errorf("the catalog is version %d, newer than this downloader knows (%d)", version, len(catalogVersions))
+	}
+	if version == len(catalogVersions) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmts := range catalogVersions[version:] {
+		for _, stmt := range stmts {
+			if _, err = tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	// PRAGMA doesn't take parameters.
+	if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(catalogVersions))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setupCatalog opens the catalog if it's enabled. Dry runs don't add
+// to it.
+func setupCatalog() {
+	if !cfg.Catalog.Enabled || dryRun {
+		return
+	}
+
+	db, err := openCatalog(catalogPath())
+	if err != nil {
+		log.Fatal("catalog: ", err)
+	}
+	if err = backfillCatalog(db); err != nil {
+		slog.Warn("can't add recorded files to the catalog", "err", err)
+	}
+	catalog = db
+}
+
+// backfillCatalog adds every file recorded in the database to a catalog
+// without files, like one that was just enabled. Their posts aren't
+// known, so they don't have tags or captions until they're scraped
+// again.
+func backfillCatalog(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&n); err != nil || n != 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = database.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(filesBucket).ForEach(func(blog, _ []byte) error {
+			return btx.Bucket(filesBucket).Bucket(blog).ForEach(func(k, v []byte) error {
+				var rec fileRecord
+				if json.Unmarshal(v, &rec) != nil || rec.Status != fileDownloaded || rec.Path == "" {
+					return nil
+				}
+				_, err := tx.Exec(`INSERT OR IGNORE INTO files
+					(blog, name, post_id, type, tags, caption, url, path, size, sha256, posted, downloaded)
+					VALUES (?, ?, ?, '', '', '', ?, ?, ?, ?, 0, ?)`,
+					string(blog), string(k), rec.PostID, rec.URL, rec.Path, rec.Size, rec.Hash, time.Now().Unix())
+				return err
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// catalogFile records a downloaded file in the catalog, if it's
+// enabled. A file downloaded again replaces its entry.
+func catalogFile(f File, filepath string, size int64, hash string) {
+	if catalog == nil {
+		return
+	}
+
+	meta := f.meta
+	if meta == nil {
+		meta = &postMeta{}
+	}
+
+	err := catalogFileTx(f, meta, filepath, size, hash)
+	if err != nil {
+		slog.Warn("can't add a file to the catalog", f.logFields("path", filepath, "err", err)...)
+	}
+}
+
+func catalogFileTx(f File, meta *postMeta, filepath string, size int64, hash string) error {
+	tx, err := catalog.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM files WHERE blog = ? AND name = ?`, f.User.name, f.Filename)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`INSERT INTO files
+		(blog, name, post_id, type, tags, caption, url, path, size, sha256, posted, downloaded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.User.name, f.Filename, f.PostID, meta.Type, strings.Join(meta.Tags, ", "), meta.Caption,
+		f.URL, filepath, size, hash, f.UnixTimestamp, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range meta.Tags {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO file_tags (file_id, tag) VALUES (?, ?)`, id, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// catalogPosts records the scraped posts of a page in the catalog, if
+// it's enabled, so the search command can find them. They're written in
+// one transaction, since SQLite is slow to commit.
+func catalogPosts(blog string, posts []Post) {
+	if catalog == nil || len(posts) == 0 {
+		return
+	}
+
+	if err := catalogPostsTx(blog, posts); err != nil {
+		slog.Warn("can't add posts to the catalog", "blog", blog, "posts", len(posts), "err", err)
+	}
+}
+
+func catalogPostsTx(blog string, posts []Post) error {
+	tx, err := catalog.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range posts {
+		id, err := p.ID.Int64()
+		if err != nil {
+			continue
+		}
+		if err = catalogPost(tx, blog, id, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// catalogPost adds or updates a post as part of tx.
+func catalogPost(tx *sql.Tx, blog string, id int64, p Post) error {
+	caption := p.PhotoCaption
+	if caption == "" {
+		caption = p.VideoCaption
+	}
+	// An upsert keeps the row ID, which the text index refers to.
+	_, err := tx.Exec(`INSERT INTO posts (blog, post_id, type, tags, caption, body, answer, posted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (blog, post_id) DO UPDATE SET
+			type = excluded.type, tags = excluded.tags, caption = excluded.caption,
+			body = excluded.body, answer = excluded.answer, posted = excluded.posted`,
+		blog, id, p.Type, strings.Join(p.Tags, ", "), plainText(caption),
+		plainText(p.RegularBody), plainText(p.Answer), p.UnixTimestamp)
+	if err != nil {
+		return err
+	}
+
+	var rowID int64
+	err = tx.QueryRow(`SELECT id FROM posts WHERE blog = ? AND post_id = ?`, blog, id).Scan(&rowID)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM post_tags WHERE post_id = ?`, rowID); err != nil {
+		return err
+	}
+	for _, tag := range p.Tags {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO post_tags (post_id, tag) VALUES (?, ?)`, rowID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A catalogQuery selects files from the catalog. Empty fields match
+// everything.
+type catalogQuery struct {
+	Blog  string
+	Tag   string
+	Type  string
+	Post  int64
+	Name  string
+	Text  string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// A catalogEntry is a file found by a query.
+type catalogEntry struct {
+	Blog       string    `json:"blog"`
+	PostID     int64     `json:"post_id"`
+	Type       string    `json:"type"`
+	Tags       []string  `json:"tags"`
+	Caption    string    `json:"caption"`
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Hash       string    `json:"sha256"`
+	Posted     time.Time `json:"posted"`
+	Downloaded time.Time `json:"downloaded"`
+}
+
+// where turns the query into an SQL condition and its arguments.
+func (q catalogQuery) where() (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if q.Blog != "" {
+		add("blog = ?", q.Blog)
+	}
+	if q.Tag != "" {
+		add("id IN (SELECT file_id FROM file_tags WHERE tag = ?)", q.Tag)
+	}
+	if q.Type != "" {
+		add("type = ?", q.Type)
+	}
+	if q.Post != 0 {
+		add("post_id = ?", q.Post)
+	}
+	if q.Name != "" {
+		add("name = ?", q.Name)
+	}
+	if q.Text != "" {
+		add("id IN (SELECT rowid FROM files_text WHERE files_text MATCH ?)", q.Text)
+	}
+	if !q.Since.IsZero() {
+		add("posted >= ?", q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		add("posted < ?", q.Until.Unix())
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// queryCatalog returns the files matching q, newest post first.
+func queryCatalog(db *sql.DB, q catalogQuery) ([]catalogEntry, error) {
+	where, args := q.where()
+	query := `SELECT blog, post_id, type, tags, caption, name, url, path, size, sha256, posted, downloaded
+		FROM files WHERE ` + where + ` ORDER BY posted DESC, post_id DESC, name`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []catalogEntry
+	for rows.Next() {
+		var e catalogEntry
+		var tags string
+		var posted, downloaded int64
+		err = rows.Scan(&e.Blog, &e.PostID, &e.Type, &tags, &e.Caption, &e.Name, &e.URL,
+			&e.Path, &e.Size, &e.Hash, &posted, &downloaded)
+		if err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			e.Tags = strings.Split(tags, ", ")
+		}
+		e.Posted = time.Unix(posted, 0).UTC()
+		e.Downloaded = time.Unix(downloaded, 0).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
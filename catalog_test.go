@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPostMeta(t *testing.T) {
+	tests := []struct {
+		post    Post
+		caption string
+	}{
+		{Post{Type: "photo", PhotoCaption: "<p>A <b>sunset</b> &amp; a beach</p>"}, "A sunset & a beach"},
+		{Post{Type: "regular", RegularBody: "<p>One</p>\n<p>Two</p>"}, "One Two"},
+		{Post{Type: "answer", Answer: "Yes."}, "Yes."},
+		{Post{Type: "video", VideoCaption: "<a href=\"x\">link</a>"}, "link"},
+		{Post{Type: "photo"}, ""},
+	}
+
+	for i, test := range tests {
+		test.post.Tags = []string{"a", "b"}
+		meta := newPostMeta(test.post)
+		if meta.Caption != test.caption || meta.Type != test.post.Type || !reflect.DeepEqual(meta.Tags, test.post.Tags) {
+			t.Errorf("#%d: newPostMeta=%+v; want caption %q", i, meta, test.caption)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"2020-03-04", time.Date(2020, 3, 4, 0, 0, 0, 0, time.Local), true},
+		{"2020-03", time.Date(2020, 3, 1, 0, 0, 0, 0, time.Local), true},
+		{"2020", time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local), true},
+		{"03/04/2020", time.Time{}, false},
+	}
+
+	for i, test := range tests {
+		got, err := parseDate(test.in)
+		if (err == nil) != test.ok || !got.Equal(test.want) {
+			t.Errorf("#%d: parseDate(%q)=%v, %v; want %v", i, test.in, got, err, test.want)
+		}
+	}
+}
+
+// setupTestCatalog opens an empty catalog for a test. The returned
+// function closes and removes it.
+func setupTestCatalog(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openCatalog(path.Join(dir, "catalog.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	old := catalog
+	catalog = db
+	return func() {
+		catalog = old
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCatalogQuery(t *testing.T) {
+	defer setupTestCatalog(t)()
+
+	day := func(s string) int64 {
+		d, _ := parseDate(s)
+		return d.Unix()
+	}
+	demo, other := &User{name: "demo"}, &User{name: "other"}
+	sunset := newPostMeta(Post{Type: "photo", Tags: []string{"Sunset", "beach"}, PhotoCaption: "<p>Evening at the coast</p>"})
+	forest := newPostMeta(Post{Type: "photo", Tags: []string{"forest"}, PhotoCaption: "Morning walk"})
+	clip := newPostMeta(Post{Type: "video", Tags: []string{"sunset"}, VideoCaption: "Timelapse"})
+
+	catalogFile(File{User: demo, Filename: "a.jpg", PostID: 1, UnixTimestamp: day("2019-06-01"), meta: sunset}, "demo/a.jpg", 10, "aa")
+	catalogFile(File{User: demo, Filename: "b.jpg", PostID: 1, UnixTimestamp: day("2019-06-01"), meta: sunset}, "demo/b.jpg", 20, "bb")
+	catalogFile(File{User: demo, Filename: "c.jpg", PostID: 2, UnixTimestamp: day("2020-02-01"), meta: forest}, "demo/c.jpg", 30, "cc")
+	catalogFile(File{User: other, Filename: "d.mp4", PostID: 3, UnixTimestamp: day("2021-01-01"), meta: clip}, "other/d.mp4", 40, "dd")
+	// Downloading a file again replaces it.
+	catalogFile(File{User: demo, Filename: "c.jpg", PostID: 2, UnixTimestamp: day("2020-02-01"), meta: forest}, "demo/c.jpg", 35, "cd")
+
+	tests := []struct {
+		q    catalogQuery
+		want []string
+	}{
+		{catalogQuery{}, []string{"d.mp4", "c.jpg", "a.jpg", "b.jpg"}},
+		{catalogQuery{Blog: "demo"}, []string{"c.jpg", "a.jpg", "b.jpg"}},
+		{catalogQuery{Tag: "sunset"}, []string{"d.mp4", "a.jpg", "b.jpg"}},
+		{catalogQuery{Type: "video"}, []string{"d.mp4"}},
+		{catalogQuery{Post: 1}, []string{"a.jpg", "b.jpg"}},
+		{catalogQuery{Text: "coast"}, []string{"a.jpg", "b.jpg"}},
+		{catalogQuery{Text: "forest OR timelapse"}, []string{"d.mp4", "c.jpg"}},
+		{catalogQuery{Since: time.Unix(day("2020"), 0), Until: time.Unix(day("2021"), 0)}, []string{"c.jpg"}},
+		{catalogQuery{Limit: 1}, []string{"d.mp4"}},
+		{catalogQuery{Blog: "nobody"}, nil},
+	}
+
+	for i, test := range tests {
+		entries, err := queryCatalog(catalog, test.q)
+		if err != nil {
+			t.Errorf("#%d: queryCatalog(%+v): %v", i, test.q, err)
+			continue
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("#%d: queryCatalog(%+v)=%v; want %v", i, test.q, names, test.want)
+		}
+	}
+
+	entries, _ := queryCatalog(catalog, catalogQuery{Blog: "demo", Post: 2})
+	if len(entries) != 1 || entries[0].Size != 35 || entries[0].Hash != "cd" || entries[0].Caption != "Morning walk" {
+		t.Errorf("replaced entry=%+v; want size 35, hash cd", entries)
+	}
+}
+
+func TestBackfillCatalog(t *testing.T) {
+	defer setupTestDatabase(t)()
+	defer setupTestCatalog(t)()
+
+	updateFile("demo", "a.jpg", func(rec *fileRecord) {
+		*rec = fileRecord{URL: "https://x/a.jpg", Path: "demo/a.jpg", PostID: 1, Size: 10, Hash: "aa", Status: fileDownloaded}
+	})
+	updateFile("demo", "b.jpg", func(rec *fileRecord) {
+		*rec = fileRecord{URL: "https://x/b.jpg", PostID: 1, Status: fileFailed}
+	})
+
+	if err := backfillCatalog(catalog); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := queryCatalog(catalog, catalogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "a.jpg" || entries[0].Path != "demo/a.jpg" || entries[0].Hash != "aa" {
+		t.Errorf("backfilled entries=%+v; want only a.jpg", entries)
+	}
+
+	// Catalogs that have files are left alone.
+	updateFile("demo", "c.jpg", func(rec *fileRecord) {
+		*rec = fileRecord{Path: "demo/c.jpg", Status: fileDownloaded}
+	})
+	backfillCatalog(catalog)
+	if entries, _ = queryCatalog(catalog, catalogQuery{}); len(entries) != 1 {
+		t.Errorf("%d entries after a second backfill; want 1", len(entries))
+	}
+}
+
+func TestQueryFormats(t *testing.T) {
+	entries := []catalogEntry{{
+		Blog: "demo", PostID: 1, Type: "photo", Tags: []string{"a", "b"}, Caption: "Hi, there",
+		Name: "a.jpg", Path: "demo/a.jpg", Size: 10, Posted: time.Unix(0, 0).UTC(), Downloaded: time.Unix(0, 0).UTC(),
+	}}
+
+	var out bytes.Buffer
+	if err := writeQueryJSON(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []catalogEntry
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("JSON output decoded to %+v, %v; want %+v", decoded, err, entries)
+	}
+
+	out.Reset()
+	if err := writeQueryCSV(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"a, b","Hi, there",a.jpg`) {
+		t.Errorf("CSV output=%q", out.String())
+	}
+
+	out.Reset()
+	writeQueryJSON(&out, nil)
+	if strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("JSON output without results=%q; want []", out.String())
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	d := func(s string) time.Time {
+		t, _ := parseDate(s)
+		return t
+	}
+	tests := []struct {
+		query string
+		want  postSearch
+	}{
+		{"blog:foo tag:landscape sunset after:2018",
+			postSearch{Blogs: []string{"foo"}, Tags: []string{"landscape"}, After: d("2018"), Match: `"sunset"`}},
+		{`"red sky" OR dawn before:2020-06`,
+			postSearch{Before: d("2020-06"), Match: `"red sky" OR "dawn"`}},
+		{`tag:"new york" type:photo type:video`,
+			postSearch{Tags: []string{"new york"}, Types: []string{"photo", "video"}}},
+		{`OR a OR OR b OR`, postSearch{Match: `"a" OR "b"`}},
+		{`say "hi" "blog:x" http://x.com`, postSearch{Match: `"say" "hi" "blog:x" "http://x.com"`}},
+		{`"unclosed quote`, postSearch{Match: `"unclosed quote"`}},
+		{"", postSearch{}},
+	}
+
+	for i, test := range tests {
+		got, err := parseSearch(test.query)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("#%d: parseSearch(%q)=%+v, %v; want %+v", i, test.query, got, err, test.want)
+		}
+	}
+
+	if _, err := parseSearch("after:yesterday"); err == nil {
+		t.Error("parseSearch accepted an invalid date")
+	}
+}
+
+func TestSearchPosts(t *testing.T) {
+	defer setupTestCatalog(t)()
+
+	day := func(s string) int64 {
+		d, _ := parseDate(s)
+		return d.Unix()
+	}
+	posts := []Post{
+		{ID: "1", Type: "photo", Tags: []string{"landscape"}, PhotoCaption: "<p>Sunset over the hills</p>", UnixTimestamp: day("2019")},
+		{ID: "2", Type: "regular", Tags: []string{"Landscape", "notes"}, RegularBody: "Drafts about a <i>sunset</i>", UnixTimestamp: day("2017")},
+		{ID: "3", Type: "answer", Answer: "Dawn is better", UnixTimestamp: day("2020")},
+	}
+	catalogPosts("foo", posts)
+	catalogPosts("bar", []Post{{ID: "4", Type: "photo", Tags: []string{"landscape"}, PhotoCaption: "Sunset", UnixTimestamp: day("2021")}})
+	catalogFile(File{User: &User{name: "foo"}, Filename: "1.jpg", PostID: 1}, "foo/1.jpg", 1, "")
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"blog:foo tag:landscape sunset after:2018", []int64{1}},
+		{"blog:foo sunset", []int64{1, 2}},
+		{"tag:landscape", []int64{4, 1, 2}},
+		{"tag:landscape tag:notes", []int64{2}},
+		{"dawn OR drafts", []int64{3, 2}},
+		{"type:answer", []int64{3}},
+		{"before:2018", []int64{2}},
+		{"nothing", nil},
+	}
+
+	for i, test := range tests {
+		s, _ := parseSearch(test.query)
+		results, err := searchPosts(catalog, s, 0)
+		if err != nil {
+			t.Errorf("#%d: %q: %v", i, test.query, err)
+			continue
+		}
+		var ids []int64
+		for _, r := range results {
+			ids = append(ids, r.PostID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("#%d: search %q found %v; want %v", i, test.query, ids, test.want)
+		}
+	}
+
+	s, _ := parseSearch("blog:foo hills")
+	results, _ := searchPosts(catalog, s, 0)
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Paths, []string{"foo/1.jpg"}) ||
+		results[0].Text != "Sunset over the hills" {
+		t.Errorf("search results=%+v; want post 1 with foo/1.jpg", results)
+	}
+
+	// Scraping a post again updates it.
+	posts[0].PhotoCaption = "Moonrise"
+	posts[0].Tags = nil
+	catalogPosts("foo", posts[:1])
+	for i, query := range []string{"hills", "tag:landscape blog:foo"} {
+		s, _ = parseSearch(query)
+		results, _ = searchPosts(catalog, s, 0)
+		for _, r := range results {
+			if r.PostID == 1 {
+				t.Errorf("#%d: search %q still finds the old post", i, query)
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import "sync"
+
+// postsPerPage is the number of posts the scraper asks for at once.
+const postsPerPage = 50
+
+// A checkpoint records how far an unfinished scrape of a blog got, so
+// that the next session can continue it instead of starting over.
+type checkpoint struct {
+	// Tag is the tag that was being scraped. A checkpoint is only
+	// used for the same tag.
+	Tag string `json:"tag,omitempty"`
+
+	// Top is the highest post ID of the unfinished scrape.
+	Top int64 `json:"top"`
+	// Every post from LowWater up to Top is fully downloaded.
+	LowWater int64 `json:"low_water"`
+	// Offset is the offset of the page LowWater was found on.
+	Offset int `json:"offset"`
+
+	// Full is set if the unfinished scrape was checking the whole blog.
+	// Only those are continued by another full check.
+	Full bool `json:"full,omitempty"`
+	// Parser is the oldest parser version that took part in the
+	// unfinished scrape.
+	Parser int `json:"parser,omitempty"`
+}
+
+func loadCheckpoint(name string) (checkpoint, bool) {
+	c := readBlog(name).Checkpoint
+	if c == nil {
+		return checkpoint{}, false
+	}
+	return *c, true
+}
+
+func saveCheckpoint(name string, c checkpoint) {
+	updateBlog(name, func(rec *blogRecord) {
+		rec.Checkpoint = &c
+	})
+}
+
+func deleteCheckpoint(name string) {
+	updateBlog(name, func(rec *blogRecord) {
+		rec.Checkpoint = nil
+	})
+}
+
+// postProgress keeps track of which posts of a scrape are fully
+// downloaded. Posts are added in the order they're scraped, newest
+// first, and the low-water mark is the oldest post that every post
+// before it is complete up to.
+type postProgress struct {
+	sync.Mutex
+	order   []int64
+	offsets []int
+	pending map[int64]int
+	// failed holds posts with a file that couldn't be downloaded.
+	failed map[int64]bool
+	// done is the number of posts at the start of order that are
+	// complete.
+	done int
+	// held is set once a page is skipped. The low-water mark doesn't
+	// pass the heldAt posts that were added before it.
+	held   bool
+	heldAt int
+}
+
+func newPostProgress() *postProgress {
+	return &postProgress{pending: make(map[int64]int), failed: make(map[int64]bool)}
+}
+
+// add registers a post found on the page at offset, with the number of
+// files that still have to be downloaded for it. offset is -1 for posts
+// that weren't found on a page, which don't count for the low-water
+// mark.
+func (p *postProgress) add(id int64, offset, files int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.pending[id]; !ok && offset >= 0 {
+		p.order = append(p.order, id)
+		p.offsets = append(p.offsets, offset)
+	}
+	p.pending[id] += files
+	p.advance()
+}
+
+// adjust changes the number of files a post has, for links that turn
+// out to lead to more or fewer files than expected.
+func (p *postProgress) adjust(id int64, files int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.pending[id] += files
+	p.advance()
+}
+
+// complete marks a file of a post as downloaded.
+func (p *postProgress) complete(id int64) {
+	p.adjust(id, -1)
+}
+
+// fail marks a post as having a file that couldn't be downloaded. The
+// file still has to be completed, so the scrape can move past it.
+func (p *postProgress) fail(id int64) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	p.failed[id] = true
+	p.Unlock()
+}
+
+// states returns the state of every post that was added.
+func (p *postProgress) states() map[int64]postState {
+	states := make(map[int64]postState)
+	if p == nil {
+		return states
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	for id, files := range p.pending {
+		switch {
+		case p.failed[id]:
+			states[id] = postQueued
+		case files > 0:
+			// Files are only left over if the downloader stopped.
+			states[id] = postInterrupted
+		default:
+			states[id] = postComplete
+		}
+	}
+	return states
+}
+
+// hold stops the low-water mark at the posts added so far, because the
+// page after them was skipped. A resumed scrape then gets to it again.
+func (p *postProgress) hold() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if !p.held {
+		p.held, p.heldAt = true, len(p.order)
+	}
+}
+
+func (p *postProgress) advance() {
+	for p.done < len(p.order) && (!p.held || p.done < p.heldAt) && p.pending[p.order[p.done]] <= 0 {
+		p.done++
+	}
+}
+
+// lowWater returns the oldest post that every post before it is
+// complete up to, the offset of its page, and the number of posts that
+// are complete. n is 0 if the first post isn't complete yet.
+func (p *postProgress) lowWater() (id int64, offset int, n int) {
+	if p == nil {
+		return 0, 0, 0
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	if p.done == 0 {
+		return 0, 0, 0
+	}
+	return p.order[p.done-1], p.offsets[p.done-1], p.done
+}
+
+// A scrapeCursor decides which page the scraper fetches next, and which
+// posts on it still have to be downloaded.
+//
+// When an unfinished scrape is resumed, the cursor first catches up on
+// the posts that are newer than it, and then jumps to where it stopped.
+type scrapeCursor struct {
+	offset int
+	// full is set if the scrape checks the whole blog.
+	full bool
+
+	// resume is the checkpoint being resumed, if there is one.
+	resume *checkpoint
+	// catchingUp is set while looking at posts newer than resume.
+	catchingUp bool
+	// verify is set after a jump. Posts may have been deleted since the
+	// checkpoint, so the page jumped to may be too far along.
+	verify bool
+	// newPosts is the number of posts newer than resume.
+	newPosts int
+
+	// top is the highest post ID seen.
+	top int64
+}
+
+func newScrapeCursor(resume *checkpoint) *scrapeCursor {
+	c := &scrapeCursor{resume: resume}
+	if resume != nil {
+		c.catchingUp = true
+		c.top = resume.Top
+	}
+	return c
+}
+
+// next takes the post IDs on the page at c.offset, and returns the
+// indexes of the ones to queue. If jumped is set, the rest of the page
+// is ignored and the page at the new c.offset has to be fetched.
+func (c *scrapeCursor) next(ids []int64) (keep []int, jumped bool) {
+	if c.verify {
+		if len(ids) != 0 && ids[0] < c.resume.LowWater && c.offset > 0 {
+			c.offset -= postsPerPage
+			if c.offset < 0 {
+				c.offset = 0
+			}
+			return nil, true
+		}
+		c.verify = false
+	}
+
+	for i, id := range ids {
+		if id > c.top {
+			c.top = id
+		}
+
+		if c.catchingUp {
+			if id <= c.resume.Top {
+				c.catchingUp = false
+				c.verify = true
+				c.offset = c.resume.Offset + c.newPosts
+				return keep, true
+			}
+			c.newPosts++
+			keep = append(keep, i)
+			continue
+		}
+
+		if c.resume != nil && id >= c.resume.LowWater && id <= c.resume.Top {
+			// Downloaded by the unfinished scrape.
+			continue
+		}
+		keep = append(keep, i)
+	}
+
+	c.offset += postsPerPage
+	return keep, false
+}
+
+// skip moves past a page that couldn't be parsed. Posts on it are
+// counted as new while catching up, and the pages before it aren't
+// checked again, since that would lead back to it.
+func (c *scrapeCursor) skip() {
+	if c.catchingUp {
+		c.newPosts += postsPerPage
+	}
+	c.verify = false
+	c.offset += postsPerPage
+}
+
+// parser returns the oldest parser version that took part in the
+// scrape, including the unfinished scrape it resumed.
+func (c *scrapeCursor) parser() int {
+	if c.resume != nil && c.resume.Parser < parserVersion {
+		return c.resume.Parser
+	}
+	return parserVersion
+}
+
+// checkpoint returns the checkpoint to save for the progress made so
+// far. It returns false if there's nothing new to save.
+func (c *scrapeCursor) checkpoint(tag string, p *postProgress) (checkpoint, bool) {
+	id, offset, n := p.lowWater()
+
+	if c.resume != nil {
+		// Until every new post is downloaded, the old checkpoint is
+		// the only one that can be trusted.
+		if c.catchingUp || n < c.newPosts {
+			return checkpoint{}, false
+		}
+		if n == c.newPosts {
+			return checkpoint{
+				Tag:      tag,
+				Top:      c.top,
+				LowWater: c.resume.LowWater,
+				Offset:   c.resume.Offset + c.newPosts,
+				Full:     c.full,
+				Parser:   c.parser(),
+			}, true
+		}
+	} else if n == 0 {
+		return checkpoint{}, false
+	}
+
+	return checkpoint{Tag: tag, Top: c.top, LowWater: id, Offset: offset, Full: c.full, Parser: c.parser()}, true
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// postIDs returns the IDs from high down to low.
+func postIDs(high, low int64) []int64 {
+	var ids []int64
+	for id := high; id >= low; id-- {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// simulateScrape runs a cursor over a blog with the given posts, newest
+// first, and returns the posts that would be queued.
+func simulateScrape(posts []int64, c *scrapeCursor, lastPostID int64) []int64 {
+	var queued []int64
+	for pages := 0; pages < 1000; pages++ {
+		var page []int64
+		if c.offset < len(posts) {
+			end := c.offset + postsPerPage
+			if end > len(posts) {
+				end = len(posts)
+			}
+			page = posts[c.offset:end]
+		}
+
+		keep, jumped := c.next(page)
+		for _, j := range keep {
+			if page[j] <= lastPostID {
+				return queued
+			}
+			queued = append(queued, page[j])
+		}
+		if jumped {
+			continue
+		}
+		if len(page) < postsPerPage {
+			return queued
+		}
+	}
+	panic("scrape doesn't end")
+}
+
+// without returns ids without the ones from high down to low.
+func without(ids []int64, high, low int64) []int64 {
+	var result []int64
+	for _, id := range ids {
+		if id > high || id < low {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func TestScrapeCursor(t *testing.T) {
+	blog := postIDs(1000, 1)
+
+	// The first scrape stopped with posts 1000 to 401 downloaded. 401
+	// is on the page at offset 550.
+	resume := checkpoint{Top: 1000, LowWater: 401, Offset: 550}
+
+	tests := []struct {
+		name       string
+		posts      []int64
+		resume     *checkpoint
+		lastPostID int64
+		want       []int64
+	}{
+		{"first scrape", blog, nil, 0, blog},
+		{"incremental", blog, nil, 900, postIDs(1000, 901)},
+		{"resume", blog, &resume, 0, postIDs(400, 1)},
+		{"resume with new posts", postIDs(1120, 1), &resume, 0,
+			append(postIDs(1120, 1001), postIDs(400, 1)...)},
+		{"resume with deleted posts", without(postIDs(1120, 1), 700, 550), &resume, 0,
+			append(postIDs(1120, 1001), postIDs(400, 1)...)},
+		{"resume with deleted old posts", without(blog, 400, 250), &resume, 0, postIDs(249, 1)},
+		{"resume incremental", postIDs(1120, 1), &resume, 200,
+			append(postIDs(1120, 1001), postIDs(400, 201)...)},
+	}
+
+	for i, test := range tests {
+		c := newScrapeCursor(test.resume)
+		queued := simulateScrape(test.posts, c, test.lastPostID)
+		if !reflect.DeepEqual(queued, test.want) {
+			t.Errorf("#%d: %s: queued %d posts (%v...); want %d (%v...)", i, test.name,
+				len(queued), head(queued), len(test.want), head(test.want))
+		}
+	}
+}
+
+func head(ids []int64) []int64 {
+	if len(ids) > 5 {
+		return ids[:5]
+	}
+	return ids
+}
+
+func TestPostProgress(t *testing.T) {
+	p := newPostProgress()
+	p.add(10, 0, 2)
+	p.add(9, 0, 0)
+	p.add(8, 50, 1)
+	p.add(7, 50, 1)
+
+	if _, _, n := p.lowWater(); n != 0 {
+		t.Errorf("lowWater with nothing downloaded: n=%d; want 0", n)
+	}
+
+	// Downloads finish out of order, and post 10 still has a file left.
+	p.complete(8)
+	p.complete(10)
+	if _, _, n := p.lowWater(); n != 0 {
+		t.Errorf("lowWater with post 10 incomplete: n=%d; want 0", n)
+	}
+
+	p.complete(10)
+	if id, offset, n := p.lowWater(); id != 8 || offset != 50 || n != 3 {
+		t.Errorf("lowWater=%d, %d, %d; want 8, 50, 3", id, offset, n)
+	}
+
+	// A link that turns out to lead to two files.
+	p.adjust(7, 1)
+	p.complete(7)
+	if id, _, _ := p.lowWater(); id != 8 {
+		t.Errorf("lowWater=%d; want 8", id)
+	}
+	p.complete(7)
+	if id, _, _ := p.lowWater(); id != 7 {
+		t.Errorf("lowWater=%d; want 7", id)
+	}
+
+	// The page at offset 100 was skipped.
+	p.hold()
+	p.add(3, 150, 0)
+	if id, _, _ := p.lowWater(); id != 7 {
+		t.Errorf("lowWater after a skipped page=%d; want 7", id)
+	}
+}
+
+func TestSkipFloor(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages []int64 // 0 is a skipped page, otherwise its newest post
+		want  int64
+		skip  bool
+	}{
+		{"no skips", []int64{300, 250}, 0, false},
+		{"skipped", []int64{300, 0, 200, 150}, 200, true},
+		{"skipped twice", []int64{0, 250, 0, 150}, 150, true},
+		{"skipped last", []int64{300, 0}, 0, true},
+	}
+
+	for i, test := range tests {
+		u := &User{name: "demo"}
+		for _, p := range test.pages {
+			if p == 0 {
+				u.skipPage()
+			} else {
+				u.pastSkipped(p)
+			}
+		}
+		if u.skippedPage != test.skip || u.skipFloor != test.want {
+			t.Errorf("#%d: %s: skipped=%t floor=%d; want %t, %d", i, test.name, u.skippedPage, u.skipFloor, test.skip, test.want)
+		}
+	}
+}
+
+func TestPostStates(t *testing.T) {
+	p := newPostProgress()
+	p.add(10, 0, 1)
+	p.add(9, 0, 2)
+	p.add(8, 0, 1)
+	p.add(7, -1, 1)
+
+	p.complete(10)
+	p.complete(9)
+	p.fail(8)
+	p.complete(8)
+	p.complete(7)
+
+	want := map[int64]postState{10: postComplete, 9: postInterrupted, 8: postQueued, 7: postComplete}
+	if states := p.states(); !reflect.DeepEqual(states, want) {
+		t.Errorf("states=%v; want %v", states, want)
+	}
+
+	// Failed posts don't hold back the low-water mark, since they're
+	// queued again anyway. Posts that weren't on a page don't count.
+	p.complete(9)
+	if id, _, n := p.lowWater(); id != 8 || n != 3 {
+		t.Errorf("lowWater=%d, n=%d; want 8, 3", id, n)
+	}
+}
+
+func TestCursorCheckpoint(t *testing.T) {
+	resume := checkpoint{Top: 1000, LowWater: 401, Offset: 550}
+	c := newScrapeCursor(&resume)
+	p := newPostProgress()
+
+	c.next(postIDs(1010, 961))
+	for _, id := range postIDs(1010, 1001) {
+		p.add(id, 0, 1)
+	}
+
+	if _, ok := c.checkpoint("", p); ok {
+		t.Error("checkpoint saved before the new posts are downloaded")
+	}
+
+	for _, id := range postIDs(1010, 1001) {
+		p.complete(id)
+	}
+	want := checkpoint{Top: 1010, LowWater: 401, Offset: 560}
+	if cp, ok := c.checkpoint("", p); !ok || cp != want {
+		t.Errorf("checkpoint=%+v, %t; want %+v", cp, ok, want)
+	}
+
+	c.next(postIDs(450, 401))
+	c.next(postIDs(400, 351))
+	for _, id := range postIDs(400, 351) {
+		p.add(id, 610, 1)
+		p.complete(id)
+	}
+	want = checkpoint{Top: 1010, LowWater: 351, Offset: 610}
+	if cp, ok := c.checkpoint("", p); !ok || cp != want {
+		t.Errorf("checkpoint=%+v, %t; want %+v", cp, ok, want)
+	}
+}
+
+func TestCursorParser(t *testing.T) {
+	tests := []struct {
+		resume *checkpoint
+		want   int
+	}{
+		{nil, parserVersion},
+		{&checkpoint{Top: 1000, LowWater: 401, Parser: parserVersion}, parserVersion},
+		// Stored before checkpoints had a parser version.
+		{&checkpoint{Top: 1000, LowWater: 401}, 0},
+	}
+
+	for i, test := range tests {
+		c := newScrapeCursor(test.resume)
+		c.full = true
+		c.next(postIDs(1000, 951))
+		p := newPostProgress()
+		p.add(1000, 0, 0)
+
+		if got := c.parser(); got != test.want {
+			t.Errorf("#%d: parser=%d; want %d", i, got, test.want)
+		}
+		if cp, ok := c.checkpoint("", p); !ok || cp.Parser != test.want || !cp.Full {
+			t.Errorf("#%d: checkpoint=%+v, %t; want parser %d of a full scrape", i, cp, ok, test.want)
+		}
+	}
+}
+
+func TestCheckpointDatabase(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	if _, ok := loadCheckpoint("demo"); ok {
+		t.Error("loadCheckpoint found a checkpoint in an empty database")
+	}
+
+	want := checkpoint{Tag: "cats", Top: 1000, LowWater: 401, Offset: 550}
+	saveCheckpoint("demo", want)
+	if c, ok := loadCheckpoint("demo"); !ok || c != want {
+		t.Errorf("loadCheckpoint=%+v, %t; want %+v", c, ok, want)
+	}
+
+	deleteCheckpoint("demo")
+	if _, ok := loadCheckpoint("demo"); ok {
+		t.Error("checkpoint still there after deleteCheckpoint")
+	}
+}
+
+func TestCursorSkip(t *testing.T) {
+	c := newScrapeCursor(nil)
+	c.skip()
+	if c.offset != postsPerPage {
+		t.Errorf("offset after a skip=%d; want %d", c.offset, postsPerPage)
+	}
+
+	// A skipped page while catching up is counted as new posts.
+	c = newScrapeCursor(&checkpoint{Top: 1000, LowWater: 401, Offset: 550})
+	c.skip()
+	if _, jumped := c.next(postIDs(1000, 951)); !jumped || c.offset != 550+postsPerPage {
+		t.Errorf("offset after catching up=%d, jumped=%t; want %d, true", c.offset, jumped, 550+postsPerPage)
+	}
+}
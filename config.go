@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"log"
-	"time"
+	"os"
+	"sync"
 
 	"github.com/blang/semver"
 	"github.com/burntsushi/toml"
@@ -10,31 +12,115 @@ import (
 
 var cfg Config
 
+// cfgLock guards cfg while a reload replaces it. That only happens
+// between sessions, so code that runs during a session reads cfg
+// directly, but anything that can run between sessions uses config.
+var cfgLock sync.RWMutex
+
+// config returns a copy of the current config.
+func config() Config {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg
+}
+
 // Config is a struct that contains all the configuration options
 // and possibilities for the downloader to run.
 type Config struct {
-	NumDownloaders    int           `toml:"num_downloaders"`
-	RequestRate       int           `toml:"rate"`
-	ForceCheck        bool          `toml:"force"`
-	ServerMode        bool          `toml:"server_mode"`
-	ServerSleep       time.Duration `toml:"sleep_time"`
-	DownloadDirectory string        `toml:"directory"`
+	NumDownloaders    int      `toml:"num_downloaders"`
+	RequestRate       int      `toml:"rate"`
+	ForceCheck        bool     `toml:"force"`
+	ServerMode        bool     `toml:"server_mode"`
+	ServerSleep       duration `toml:"sleep_time"`
+	DownloadDirectory string   `toml:"directory"`
+
+	// ShutdownTimeout is how long downloads get to finish after the
+	// downloader is asked to stop.
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
 
 	IgnorePhotos   bool `toml:"ignore_photos"`
 	IgnoreVideos   bool `toml:"ignore_videos"`
 	IgnoreAudio    bool `toml:"ignore_audio"`
 	UseProgressBar bool `toml:"use_progress_bar"`
 
+	// PhotoSize is parsed by parsePhotoSize.
+	PhotoSize string `toml:"photo_size"`
+	// PreferredFormat is sent in the Accept header of downloads.
+	PreferredFormat string `toml:"preferred_format"`
+
+	// DeletedView hardlinks files from deleted posts and terminated
+	// blogs into the _deleted folder of the download directory.
+	DeletedView bool `toml:"deleted_view"`
+
+	Resolvers ResolverConfig `toml:"resolvers"`
+	Convert   ConvertConfig  `toml:"convert"`
+	Hooks     HookConfig     `toml:"hooks"`
+	Notify    NotifyConfig   `toml:"notify"`
+	API       APIConfig      `toml:"api"`
+	Schedule  ScheduleConfig `toml:"schedule"`
+	Catalog   CatalogConfig  `toml:"catalog"`
+
 	version semver.Version // don't want to be able to decode into this
 }
 
+// configFile is the file the config is read from. It's set by setupPaths.
+var configFile = "config.toml"
+
+// loadConfig reads the config file. Options given on the command line
+// override the ones in it.
 func loadConfig() {
-	var err error
-	if _, err = toml.DecodeFile("config.toml", &cfg); err != nil {
-		// TODO: Do something if config.toml isn't detected.
+	c, err := readConfig()
+	if err != nil {
 		log.Fatal(err)
 	}
-	if cfg.DownloadDirectory == "" {
-		cfg.DownloadDirectory = "."
+
+	flags := commandLineFlags()
+	cfg = c
+	for name, value := range flags {
+		flag.Set(name, value)
+	}
+	cfg.version = semver.MustParse(VERSION)
+}
+
+// commandLineFlags returns the value of every flag given on the
+// command line.
+func commandLineFlags() map[string]string {
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	return flags
+}
+
+// readConfig reads the config file, and fills in the defaults that
+// the command line flags need. A missing config file is fine, unless
+// it was given on the command line.
+func readConfig() (Config, error) {
+	var c Config
+	_, err := toml.DecodeFile(configFile, &c)
+	if os.IsNotExist(err) && configPath == "" {
+		err = nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	setConfigDefaults(&c)
+	return c, nil
+}
+
+func setConfigDefaults(c *Config) {
+	if c.NumDownloaders == 0 {
+		c.NumDownloaders = 10
+	}
+	if c.RequestRate == 0 {
+		c.RequestRate = 4
+	}
+	if c.DownloadDirectory == "" {
+		c.DownloadDirectory = "."
+	}
+	c.DownloadDirectory = profileDirectory(c.DownloadDirectory)
+	if c.PhotoSize == "" {
+		c.PhotoSize = defaultPhotoSize
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	// Decoders for formats that can be converted, but not encoded.
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// ConvertConfig sets up the conversion of downloaded images into
+// formats that other tools can read.
+type ConvertConfig struct {
+	// Formats maps the format of a downloaded image, like "webp",
+	// to the format it gets converted to, like "png".
+	Formats map[string]string `toml:"formats"`
+
+	// KeepOriginals keeps the downloaded file next to the converted one.
+	KeepOriginals bool `toml:"keep_originals"`
+}
+
+// imageEncoders are the formats images can be converted to.
+var imageEncoders = map[string]func(*os.File, image.Image) error{
+	"png": func(w *os.File, m image.Image) error { return png.Encode(w, m) },
+	"jpeg": func(w *os.File, m image.Image) error {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: 95})
+	},
+	"gif": func(w *os.File, m image.Image) error { return gif.Encode(w, m, nil) },
+}
+
+// verifyConvertConfig removes conversions to formats that can't be encoded.
+func verifyConvertConfig(c *ConvertConfig) {
+	for from, to := range c.Formats {
+		if to == "jpg" {
+			c.Formats[from], to = "jpeg", "jpeg"
+		}
+		if _, ok := imageEncoders[to]; !ok {
+			slog.Warn("can't convert images to this format, ignoring", "from", from, "to", to)
+			delete(c.Formats, from)
+		}
+	}
+}
+
+// convertTarget returns the format a file of the given content type
+// should be converted to, if any.
+func convertTarget(contentType string) (string, bool) {
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", false
+	}
+	from := strings.TrimPrefix(contentType, "image/")
+	to, ok := cfg.Convert.Formats[from]
+	if !ok || to == from {
+		return "", false
+	}
+	return to, true
+}
+
+// convertFile runs the conversion stage on a file that was just
+// downloaded to filepath. It returns the path of the file that should
+// be used from now on, which is the converted file unless originals
+// are kept.
+//
+// Every conversion is recorded in the database, so the original isn't
+// downloaded again on the next run if it was removed.
+func convertFile(f File, filepath, contentType string) string {
+	to, ok := convertTarget(contentType)
+	if !ok {
+		return filepath
+	}
+
+	newpath := strings.TrimSuffix(filepath, path.Ext(filepath)) + "." + imageExtension(to)
+	if err := convertImage(filepath, newpath, to); err != nil {
+		slog.Warn("can't convert an image", f.logFields("path", filepath, "err", err)...)
+		os.Remove(newpath)
+		return filepath
+	}
+
+	err := os.Chtimes(newpath, time.Now(), time.Unix(f.UnixTimestamp, 0))
+	if err != nil {
+		slog.Warn("can't set the time of a file", "path", newpath, "err", err)
+	}
+
+	recordConversion(f.User.name, f.Filename, path.Base(newpath))
+	atomic.AddUint64(&gStats.converted, 1)
+
+	if cfg.Convert.KeepOriginals {
+		return filepath
+	}
+
+	if err = os.Remove(filepath); err != nil {
+		slog.Warn("can't remove a converted original", "path", filepath, "err", err)
+	}
+	return newpath
+}
+
+func imageExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+func convertImage(oldpath, newpath, format string) error {
+	encode, ok := imageEncoders[format]
+	if !ok {
+		return errors.New("unknown format " + format)
+	}
+
+	in, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	m, _, err := image.Decode(in)
+	if err != nil {
+		return fmt.Errorf("decode: %s", err)
+	}
+
+	out, err := os.Create(newpath)
+	if err != nil {
+		return err
+	}
+
+	if err = encode(out, m); err != nil {
+		out.Close()
+		return fmt.Errorf("encode: %s", err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestConvertFile(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.Convert = ConvertConfig{Formats: map[string]string{"png": "jpg"}}
+	verifyConvertConfig(&cfg.Convert)
+
+	m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	m.Set(1, 1, color.RGBA{255, 0, 0, 255})
+
+	original := path.Join(dir, "tumblr_abc_1280.png")
+	out, err := os.Create(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = png.Encode(out, m); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	f := File{User: &User{name: "demo"}, Filename: "tumblr_abc_1280.png"}
+
+	if p := convertFile(f, original, "image/gif"); p != original {
+		t.Errorf("convertFile converted a gif to %s; want no conversion", p)
+	}
+
+	p := convertFile(f, original, "image/png")
+	if p != path.Join(dir, "tumblr_abc_1280.jpg") {
+		t.Fatalf("convertFile=%s; want tumblr_abc_1280.jpg", p)
+	}
+	if _, err = os.Stat(original); !os.IsNotExist(err) {
+		t.Error("original was kept; want it removed")
+	}
+
+	in, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if _, format, err := image.Decode(in); err != nil || format != "jpeg" {
+		t.Errorf("converted file is %q (%v); want jpeg", format, err)
+	}
+
+	if !isConverted("demo", "tumblr_abc_1280.png") {
+		t.Error("conversion wasn't recorded in the database")
+	}
+}
+
+func TestDownloadConverted(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.DownloadDirectory = dir
+	cfg.Convert = ConvertConfig{Formats: map[string]string{"png": "jpg"}}
+	verifyConvertConfig(&cfg.Convert)
+	if err = os.Mkdir(path.Join(dir, "demo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer ts.Close()
+
+	u := &User{name: "demo"}
+	f := File{User: u, URL: ts.URL + "/tumblr_conv_1280.png", Filename: "tumblr_conv_1280.png"}
+	FileTracker.Add(f.Filename, f.path())
+	defer FileTracker.Discard(f.Filename, f.path())
+	u.downloadWg.Add(1)
+	f.Download()
+
+	var rec fileRecord
+	database.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(filesBucket).Bucket([]byte("demo")).Get([]byte(f.Filename)), &rec)
+	})
+	want := path.Join(dir, "demo", "tumblr_conv_1280.jpg")
+	if rec.Path != want {
+		t.Errorf("recorded path=%s; want %s", rec.Path, want)
+	}
+	data, err := ioutil.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if rec.Hash != hex.EncodeToString(sum[:]) || rec.Size != int64(len(data)) {
+		t.Errorf("recorded size %d, hash %s; want the converted file's", rec.Size, rec.Hash)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+// webFiles is the dashboard, which is a static page that uses the API.
+//
+//go:embed web
+var webFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return http.FileServer(http.FS(root))
+}
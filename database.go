@@ -1,48 +1,155 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
 	"log"
+	"log/slog"
 	"strconv"
+	"time"
 
-	"github.com/blang/semver"
 	"github.com/boltdb/bolt"
 )
 
 var database *bolt.DB
 
+var postsBucket = []byte("posts")
+
+// A scheduleRecord keeps track of when a blog is due to be checked.
+type scheduleRecord struct {
+	NextDue time.Time `json:"next_due"`
+	// IdleChecks is the number of checks in a row without new posts.
+	IdleChecks int `json:"idle_checks,omitempty"`
+}
+
+// postState is how far along the download of a post is.
+type postState int
+
+const (
+	// postComplete posts have every file downloaded. It's the zero
+	// value, so posts stored before states were tracked count as
+	// complete.
+	postComplete postState = iota
+	// postQueued posts were scraped and their files queued, but not
+	// every file was downloaded. They're queued again next session.
+	postQueued
+	// postInterrupted posts were queued, but the downloader stopped
+	// before their files were tried. They're stored as postQueued, but
+	// the session doesn't count as an attempt.
+	postInterrupted
+)
+
+// A postRecord is stored for every post seen on a blog. It's used
+// to find out which posts have been deleted since the last full scan,
+// and which ones still have files to download.
+type postRecord struct {
+	Files []string `json:"files,omitempty"`
+	// Deleted is the time the post was noticed missing, if it was.
+	Deleted int64     `json:"deleted,omitempty"`
+	State   postState `json:"state,omitempty"`
+	// Attempts is the number of sessions in a row that the post was
+	// queued in without being completed.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// maxPostAttempts is the number of sessions an incomplete post is
+// queued in before it's given up on, so that links that are gone for
+// good aren't tried forever. A full scan still tries them.
+const maxPostAttempts = 5
+
 func setupDatabase(userBlogs []*User) {
-	db, err := bolt.Open("tumblr-update.db", 0600, nil)
+	open := openDatabase
+	if dryRun {
+		open = openDryRunDatabase
+	}
+	db, err := open()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("database: ", err)
 	}
 
 	database = db
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b, boltErr := tx.CreateBucketIfNotExists([]byte("tumblr"))
-		if boltErr != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-
+	// Dry runs only read the database.
+	load := db.Update
+	if dryRun {
+		load = db.View
+	}
+	err = load(func(tx *bolt.Tx) error {
 		for _, blog := range userBlogs {
-			v := b.Get([]byte(blog.name))
-			if len(v) != 0 {
-				blog.lastPostID, _ = strconv.ParseInt(string(v), 10, 64) // TODO: Messy, probably.
-				blog.updateHighestPost(blog.lastPostID)
+			if err := loadUserTx(tx, blog); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
 
-		storedVersion := string(b.Get([]byte("_VERSION_")))
-		v, err := semver.Parse(storedVersion)
-		if err != nil {
-			// Usually means 0.0.0, which means old database.
-			log.Println(err)
-		}
+	if err != nil {
+		log.Fatal("database: ", err)
+	}
+}
 
-		checkVersion(v)
+// loadUser reads what's known about a user from the database.
+func loadUser(u *User) {
+	err := database.Update(func(tx *bolt.Tx) error {
+		return loadUserTx(tx, u)
+	})
+
+	if err != nil {
+		log.Fatal("database: ", err)
+	}
+}
+
+func loadUserTx(tx *bolt.Tx, u *User) error {
+	rec, ok, err := getBlog(tx, u.name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
 
+	u.lastPostID = rec.LastPostID
+	u.updateHighestPost(u.lastPostID)
+	u.lastChecked = rec.LastChecked
+	u.nextDue, u.idleChecks = rec.Schedule.NextDue, rec.Schedule.IdleChecks
+
+	// Blogs that were downloaded with an older parser are checked in
+	// full, to find what it missed, unless it only missed posts of some
+	// types. The scraper parses those again.
+	if rec.LastPostID != 0 && rec.ParserVersion < parserVersion {
+		if _, all := reparseTypes(rec.ParserVersion, parserVersion); all {
+			u.pendingRescan = true
+		}
+	}
+
+	if rec.Terminated.IsZero() || !tx.Writable() {
 		return nil
+	}
+	// The blog is reachable, so it's not terminated (anymore).
+	rec.Terminated = time.Time{}
+	return putJSON(tx.Bucket(blogsBucket), []byte(u.name), rec)
+}
+
+// getBlog reads the record of a blog. ok is false if there is none.
+func getBlog(tx *bolt.Tx, name string) (rec blogRecord, ok bool, err error) {
+	v := tx.Bucket(blogsBucket).Get([]byte(name))
+	if v == nil {
+		return rec, false, nil
+	}
+	return rec, true, json.Unmarshal(v, &rec)
+}
+
+// updateBlog changes the record of a blog, which is created if needed.
+func updateBlog(name string, fn func(rec *blogRecord)) {
+	err := database.Update(func(tx *bolt.Tx) error {
+		rec, _, err := getBlog(tx, name)
+		if err != nil {
+			return err
+		}
+		if rec.UUID == "" {
+			rec.UUID = newUUID()
+		}
+		fn(&rec)
+		return putJSON(tx.Bucket(blogsBucket), []byte(name), rec)
 	})
 
 	if err != nil {
@@ -50,54 +157,367 @@ func setupDatabase(userBlogs []*User) {
 	}
 }
 
+// readBlog returns the record of a blog, which is empty if there is none.
+func readBlog(name string) blogRecord {
+	var rec blogRecord
+	err := database.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, _, err = getBlog(tx, name)
+		return err
+	})
+
+	if err != nil {
+		slog.Error("can't read the database", "blog", name, "err", err)
+	}
+	return rec
+}
+
 func updateDatabase(name string, id int64) {
+	updateBlog(name, func(rec *blogRecord) {
+		rec.LastPostID = id
+	})
+}
+
+// markBlogChecked stores the time a blog was last fully processed.
+func markBlogChecked(name string, t time.Time) {
+	updateBlog(name, func(rec *blogRecord) {
+		rec.LastChecked = t
+	})
+}
+
+// markBlogParsed records that a blog was checked in full by the
+// current parser.
+func markBlogParsed(name string) {
+	updateBlog(name, func(rec *blogRecord) {
+		rec.ParserVersion = parserVersion
+	})
+}
+
+// updateSchedule stores when a blog is due to be checked next.
+func updateSchedule(name string, rec scheduleRecord) {
+	updateBlog(name, func(blog *blogRecord) {
+		blog.Schedule = rec
+	})
+}
+
+// updatePosts stores the posts seen during a scrape of a blog, along
+// with their states. Posts that have a state but weren't seen keep their
+// record, with the state updated.
+//
+// If the scrape was complete, every stored post that wasn't seen again
+// is marked as deleted. Posts that were newly marked are returned.
+func updatePosts(name string, seen map[int64][]string, states map[int64]postState, complete bool) map[int64]postRecord {
+	deleted := make(map[int64]postRecord)
+	now := time.Now().Unix()
 
 	err := database.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(postsBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
 
-		b := tx.Bucket([]byte("tumblr"))
+		for id, files := range seen {
+			if err = putPostState(b, id, files, true, states[id]); err != nil {
+				return err
+			}
+		}
+		for id, state := range states {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			if err = putPostState(b, id, nil, false, state); err != nil {
+				return err
+			}
+		}
 
-		if b == nil {
-			log.Println(`Bucket "tumblr" doesn't exist in database. Something went wrong.`)
+		if !complete {
+			return nil
 		}
 
-		if err := b.Put([]byte(name), []byte(strconv.FormatInt(id, 10))); err != nil {
+		err = b.ForEach(func(k, v []byte) error {
+			id, err := strconv.ParseInt(string(k), 10, 64)
+			if err != nil {
+				return nil
+			}
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+
+			var rec postRecord
+			if err = json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.Deleted == 0 {
+				rec.Deleted = now
+				deleted[id] = rec
+			}
+			return nil
+		})
+		if err != nil {
 			return err
 		}
+
+		// The bucket can't be modified during ForEach, so the deleted
+		// posts are written afterwards.
+		for id, rec := range deleted {
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(strconv.FormatInt(id, 10)), v); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 
 	if err != nil {
 		log.Fatal("database: ", err)
 	}
+	return deleted
+}
+
+// putPostState stores the state of a post. If seen is set, the files
+// found in it replace the stored record.
+func putPostState(b *bolt.Bucket, id int64, files []string, seen bool, state postState) error {
+	key := []byte(strconv.FormatInt(id, 10))
 
+	var old postRecord
+	if v := b.Get(key); v != nil {
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+	}
+
+	rec := old
+	if seen {
+		rec = postRecord{Files: files}
+	}
+	rec.State = state
+	rec.Attempts = 0
+	switch state {
+	case postQueued:
+		rec.Attempts = old.Attempts + 1
+	case postInterrupted:
+		rec.State = postQueued
+		rec.Attempts = old.Attempts
+	}
+
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
 }
 
-func updateDatabaseVersion() {
+// incompletePosts returns the IDs of the posts of a blog that still
+// have files to download, and haven't been given up on.
+func incompletePosts(name string) []int64 {
+	var ids []int64
+
+	err := database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(postsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var rec postRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.State != postQueued || rec.Deleted != 0 || rec.Attempts >= maxPostAttempts {
+				return nil
+			}
+			id, err := strconv.ParseInt(string(k), 10, 64)
+			if err != nil {
+				return nil
+			}
+			ids = append(ids, id)
+			return nil
+		})
+	})
+
+	if err != nil {
+		slog.Error("can't read unfinished posts", "blog", name, "err", err)
+	}
+	return ids
+}
+
+// markBlogTerminated records that a blog which was downloaded before
+// can't be found anymore. It returns true if the blog was previously
+// known and hadn't been marked yet.
+func markBlogTerminated(name string) bool {
+	var marked bool
+
 	err := database.Update(func(tx *bolt.Tx) error {
+		rec, _, err := getBlog(tx, name)
+		if err != nil {
+			return err
+		}
+
+		known := rec.LastPostID != 0 || tx.Bucket(postsBucket).Bucket([]byte(name)) != nil
+		if !known || !rec.Terminated.IsZero() {
+			return nil
+		}
+
+		marked = true
+		rec.Terminated = time.Now()
+		return putJSON(tx.Bucket(blogsBucket), []byte(name), rec)
+	})
+
+	if err != nil {
+		log.Fatal("database: ", err)
+	}
+	return marked
+}
 
-		b := tx.Bucket([]byte("tumblr"))
+// updateFile changes the record of a file, which is created if needed.
+// Files are keyed by blog and the name they were found under. Changes
+// made by downloaders at the same time are written in one transaction,
+// so fn may be called more than once.
+func updateFile(blog, name string, fn func(rec *fileRecord)) {
+	err := database.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(blog))
+		if err != nil {
+			return err
+		}
 
+		var rec fileRecord
+		if v := b.Get([]byte(name)); v != nil {
+			if err = json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+		}
+		fn(&rec)
+		return putJSON(b, []byte(name), rec)
+	})
+
+	if err != nil {
+		log.Fatal("database: ", err)
+	}
+}
+
+// isRecorded reports whether a file is recorded as downloaded.
+func isRecorded(blog, name string) bool {
+	var recorded bool
+	database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket).Bucket([]byte(blog))
 		if b == nil {
-			log.Println(`Bucket "tumblr" doesn't exist in database. Something went wrong.`)
+			return nil
+		}
+		var rec fileRecord
+		if v := b.Get([]byte(name)); v != nil && json.Unmarshal(v, &rec) == nil {
+			recorded = rec.Status == fileDownloaded
 		}
+		return nil
+	})
+	return recorded
+}
 
-		// Set the value "bar" for the key "foo".
-		if err := b.Put([]byte(`_VERSION_`),
-			[]byte(cfg.version.String())); err != nil {
-			return err
+// recordConversion stores that a downloaded file was converted into
+// another format.
+func recordConversion(blog, original, converted string) {
+	updateFile(blog, original, func(rec *fileRecord) {
+		rec.Converted = converted
+	})
+}
+
+// isConverted reports whether a file was already downloaded and
+// converted into another format.
+func isConverted(blog, original string) bool {
+	var converted bool
+	database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket).Bucket([]byte(blog))
+		if b == nil {
+			return nil
+		}
+		var rec fileRecord
+		if v := b.Get([]byte(original)); v != nil && json.Unmarshal(v, &rec) == nil {
+			converted = rec.Converted != ""
+		}
+		return nil
+	})
+	return converted
+}
+
+// recordResolved stores the names of the files a link led to, so it
+// doesn't have to be resolved again.
+func recordResolved(blog string, f File, names []string) {
+	updateFile(blog, f.Filename, func(rec *fileRecord) {
+		rec.URL = f.URL
+		rec.PostID = f.PostID
+		rec.Status = fileResolved
+		rec.Resolved = names
+	})
+}
+
+// resolvedLink returns the names of the files a link led to, if it was
+// resolved before.
+func resolvedLink(blog, name string) (names []string, ok bool) {
+	database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket).Bucket([]byte(blog))
+		if b == nil {
+			return nil
+		}
+		var rec fileRecord
+		if v := b.Get([]byte(name)); v != nil && json.Unmarshal(v, &rec) == nil {
+			names, ok = rec.Resolved, rec.Status == fileResolved
+		}
+		return nil
+	})
+	return names, ok
+}
+
+// recordLargest stores which version of a photo is the largest, so
+// the versions don't have to be probed again.
+func recordLargest(blog, name, largest string) {
+	updateFile(blog, name, func(rec *fileRecord) {
+		rec.Largest = largest
+	})
+}
+
+// largestVariant returns the name of the largest version of a photo, if
+// its versions were probed before.
+func largestVariant(blog, name string) (largest string, ok bool) {
+	database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket).Bucket([]byte(blog))
+		if b == nil {
+			return nil
+		}
+		var rec fileRecord
+		if v := b.Get([]byte(name)); v != nil && json.Unmarshal(v, &rec) == nil {
+			largest = rec.Largest
 		}
 		return nil
 	})
+	return largest, largest != ""
+}
+
+// recordRun stores the summary of a download session.
+func recordRun(run runRecord) {
+	err := database.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return putJSON(b, runKey(seq), run)
+	})
 
 	if err != nil {
 		log.Fatal("database: ", err)
 	}
 }
 
-func checkVersion(v semver.Version) {
-	fmt.Println("Current version is", cfg.version)
-	if v.LT(cfg.version) {
-		cfg.ForceCheck = true
-		log.Println("Checking entire tumblrblog due to new version.")
+// updateDatabaseVersion stores the version of the downloader that last
+// ran against the database.
+func updateDatabaseVersion() {
+	err := database.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(versionKey, []byte(cfg.version.String()))
+	})
+
+	if err != nil {
+		log.Fatal("database: ", err)
 	}
 }
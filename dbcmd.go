@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// databaseFile is where the database is kept.
+var databaseFile = "tumblr-update.db"
+
+const dbUsage = `Usage: tumblr-downloader db <command> [arguments]
+
+Commands:
+  list                       list blogs with their last post and last run
+  reset <blog>...            forget how far blogs were downloaded, so the
+                             next run checks them in full
+  set-cursor <blog> <post>   continue downloading a blog after a post ID
+  export [file]              write the database as JSON, to stdout by default
+  import <file>              read a JSON export into the database
+  compact                    rewrite the database without unused space
+  check [-hash]              check downloaded files against the database
+`
+
+// openDatabase opens the database and brings it up to date. It fails
+// if another downloader is using it.
+func openDatabase() (*bolt.DB, error) {
+	if err := os.MkdirAll(path.Dir(databaseFile), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(databaseFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another downloader", databaseFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrateDatabase(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDryRunDatabase opens the database read-only, without migrating
+// it. A database that's missing or has an older schema can't be read by
+// this version, so dry runs work on a migrated copy of it instead.
+func openDryRunDatabase() (*bolt.DB, error) {
+	var db *bolt.DB
+	var err error
+	// bolt would create a missing database, even read-only.
+	if fileExists(databaseFile) {
+		db, err = bolt.Open(databaseFile, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("%s is in use by another downloader", databaseFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var version int
+		err = db.View(func(tx *bolt.Tx) (err error) {
+			version, err = schemaVersion(tx)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if version == len(migrations) {
+			return db, nil
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "tumblr-dry-run-*.db")
+	if err == nil {
+		tmp.Close()
+		// On most systems, the copy can be removed while it's open.
+		defer os.Remove(tmp.Name())
+	}
+	if db != nil {
+		if err == nil {
+			err = db.View(func(tx *bolt.Tx) error {
+				return tx.CopyFile(tmp.Name(), 0600)
+			})
+		}
+		db.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	copied, err := bolt.Open(tmp.Name(), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateDatabase(copied); err != nil {
+		copied.Close()
+		return nil, err
+	}
+	return copied, nil
+}
+
+// runDBCommand runs a db subcommand, and returns the exit code.
+func runDBCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dbUsage)
+		return 2
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "compact" {
+		before, after, err := compactDatabase(databaseFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "db compact:", err)
+			return 1
+		}
+		fmt.Printf("Compacted %s from %s to %s\n", databaseFile, byteSize(uint64(before)), byteSize(uint64(after)))
+		return 0
+	}
+
+	var run func() error
+	switch cmd {
+	case "list":
+		run = func() error { return dbList(os.Stdout) }
+	case "reset":
+		run = func() error { return dbReset(os.Stdout, args) }
+	case "set-cursor":
+		run = func() error { return dbSetCursor(os.Stdout, args) }
+	case "export":
+		run = func() error { return dbExportTo(args) }
+	case "import":
+		run = func() error { return dbImportFrom(args) }
+	case "check":
+		flags := flag.NewFlagSet("db check", flag.ExitOnError)
+		hash := flags.Bool("hash", false, "Also compare file contents with their stored hashes.")
+		flags.Parse(args)
+		run = func() error { return dbCheck(os.Stdout, *hash) }
+	default:
+		fmt.Fprintf(os.Stderr, "db: unknown command %q\n\n%s", cmd, dbUsage)
+		return 2
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "db:", err)
+		return 1
+	}
+	database = db
+	defer db.Close()
+
+	if err = run(); err != nil {
+		fmt.Fprintf(os.Stderr, "db %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// blogNames returns the names of every blog in the database, sorted.
+func blogNames(tx *bolt.Tx) []string {
+	var names []string
+	tx.Bucket(blogsBucket).ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+// lastRuns maps every blog to the start of the last run it was in.
+func lastRuns(tx *bolt.Tx) map[string]time.Time {
+	last := make(map[string]time.Time)
+	tx.Bucket(runsBucket).ForEach(func(k, v []byte) error {
+		var run runRecord
+		if json.Unmarshal(v, &run) != nil {
+			return nil
+		}
+		for _, name := range run.Blogs {
+			last[name] = run.Start
+		}
+		return nil
+	})
+	return last
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func dbList(w io.Writer) error {
+	return database.View(func(tx *bolt.Tx) error {
+		runs := lastRuns(tx)
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "BLOG\tLAST POST\tLAST RUN\tLAST CHECKED\tNEXT DUE\tNOTES")
+		for _, name := range blogNames(tx) {
+			rec, _, err := getBlog(tx, name)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			var notes []string
+			if !rec.Terminated.IsZero() {
+				notes = append(notes, "terminated")
+			}
+			if rec.Checkpoint != nil {
+				notes = append(notes, "unfinished")
+			}
+			if rec.LastPostID != 0 && rec.ParserVersion < parserVersion {
+				if types, all := reparseTypes(rec.ParserVersion, parserVersion); all {
+					notes = append(notes, "needs full check")
+				} else if len(types) != 0 {
+					notes = append(notes, "needs "+strings.Join(types, ", ")+" posts parsed again")
+				}
+			}
+			if len(notes) == 0 {
+				notes = []string{"-"}
+			}
+
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", name, rec.LastPostID,
+				formatTime(runs[name]), formatTime(rec.LastChecked),
+				formatTime(rec.Schedule.NextDue), strings.Join(notes, ", "))
+		}
+		return tw.Flush()
+	})
+}
+
+// updateKnownBlog is like updateBlog, but fails for blogs that aren't
+// in the database, so that typos don't add blogs.
+func updateKnownBlog(name string, fn func(rec *blogRecord)) error {
+	return database.Update(func(tx *bolt.Tx) error {
+		rec, ok, err := getBlog(tx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no such blog: " + name)
+		}
+		fn(&rec)
+		return putJSON(tx.Bucket(blogsBucket), []byte(name), rec)
+	})
+}
+
+// dbReset forgets how far blogs were downloaded. Their posts and files
+// are kept, so deleted posts are still found.
+func dbReset(w io.Writer, names []string) error {
+	if len(names) == 0 {
+		return errors.New("no blogs given")
+	}
+
+	for _, name := range names {
+		err := updateKnownBlog(name, func(rec *blogRecord) {
+			*rec = blogRecord{UUID: rec.UUID, Terminated: rec.Terminated}
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "Reset", name)
+	}
+	return nil
+}
+
+func dbSetCursor(w io.Writer, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: db set-cursor <blog> <post ID>")
+	}
+
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || id < 0 {
+		return fmt.Errorf("bad post ID %q", args[1])
+	}
+
+	err = updateKnownBlog(args[0], func(rec *blogRecord) {
+		rec.LastPostID = id
+		rec.Checkpoint = nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s continues after post %d\n", args[0], id)
+	return nil
+}
+
+// A dbExport is the whole database as JSON.
+type dbExport struct {
+	Schema  int                              `json:"schema"`
+	Version string                           `json:"version,omitempty"`
+	Blogs   map[string]blogRecord            `json:"blogs"`
+	Posts   map[string]map[string]postRecord `json:"posts"`
+	Files   map[string]map[string]fileRecord `json:"files"`
+	Runs    []runRecord                      `json:"runs"`
+}
+
+func exportDatabase() (dbExport, error) {
+	e := dbExport{
+		Schema: len(migrations),
+		Blogs:  make(map[string]blogRecord),
+		Posts:  make(map[string]map[string]postRecord),
+		Files:  make(map[string]map[string]fileRecord),
+	}
+
+	err := database.View(func(tx *bolt.Tx) error {
+		e.Version = string(tx.Bucket(metaBucket).Get(versionKey))
+
+		for _, name := range blogNames(tx) {
+			rec, _, err := getBlog(tx, name)
+			if err != nil {
+				return err
+			}
+			e.Blogs[name] = rec
+		}
+
+		err := tx.Bucket(postsBucket).ForEach(func(blog, _ []byte) error {
+			posts := make(map[string]postRecord)
+			e.Posts[string(blog)] = posts
+			return tx.Bucket(postsBucket).Bucket(blog).ForEach(func(k, v []byte) error {
+				var rec postRecord
+				err := json.Unmarshal(v, &rec)
+				posts[string(k)] = rec
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(filesBucket).ForEach(func(blog, _ []byte) error {
+			files := make(map[string]fileRecord)
+			e.Files[string(blog)] = files
+			return tx.Bucket(filesBucket).Bucket(blog).ForEach(func(k, v []byte) error {
+				var rec fileRecord
+				err := json.Unmarshal(v, &rec)
+				files[string(k)] = rec
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(runsBucket).ForEach(func(k, v []byte) error {
+			var run runRecord
+			err := json.Unmarshal(v, &run)
+			e.Runs = append(e.Runs, run)
+			return err
+		})
+	})
+	return e, err
+}
+
+// importDatabase writes an export into the database. Records in it
+// replace the ones in the database, and its runs are added.
+func importDatabase(e dbExport) error {
+	if e.Schema != len(migrations) {
+		return fmt.Errorf("export has schema version %d; want %d", e.Schema, len(migrations))
+	}
+
+	return database.Update(func(tx *bolt.Tx) error {
+		for name, rec := range e.Blogs {
+			if rec.UUID == "" {
+				rec.UUID = newUUID()
+			}
+			if err := putJSON(tx.Bucket(blogsBucket), []byte(name), rec); err != nil {
+				return err
+			}
+		}
+
+		for blog, posts := range e.Posts {
+			b, err := tx.Bucket(postsBucket).CreateBucketIfNotExists([]byte(blog))
+			if err != nil {
+				return err
+			}
+			for id, rec := range posts {
+				if err = putJSON(b, []byte(id), rec); err != nil {
+					return err
+				}
+			}
+		}
+
+		for blog, files := range e.Files {
+			b, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(blog))
+			if err != nil {
+				return err
+			}
+			for name, rec := range files {
+				if err = putJSON(b, []byte(name), rec); err != nil {
+					return err
+				}
+			}
+		}
+
+		b := tx.Bucket(runsBucket)
+		for _, run := range e.Runs {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err = putJSON(b, runKey(seq), run); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func dbExportTo(args []string) error {
+	e, err := exportDatabase()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(args) == 0 || args[0] == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return writeFile(args[0], data)
+}
+
+func dbImportFrom(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: db import <file>")
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var e dbExport
+	if err = json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	if err = importDatabase(e); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d blogs and %d runs\n", len(e.Blogs), len(e.Runs))
+	return nil
+}
+
+// compactDatabase copies the database at p into a new file without the
+// unused space bolt leaves behind, and replaces it with that. It returns
+// the size before and after.
+func compactDatabase(p string) (before, after int64, err error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = info.Size()
+
+	src, err := bolt.Open(p, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return 0, 0, fmt.Errorf("%s is in use by another downloader", p)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	tmp := p + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				db, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(db, sb)
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	if info, err = os.Stat(tmp); err != nil {
+		return 0, 0, err
+	}
+	after = info.Size()
+
+	src.Close()
+	return before, after, os.Rename(tmp, p)
+}
+
+// copyBucket copies every key and nested bucket of src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	// Keys are added in order, so pages can be filled up.
+	dst.FillPercent = 1
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+// dbCheck compares the files recorded in the database with the ones on
+// disk, and reports every file that's missing or different. Files in
+// the download directory without a record are listed too, but they
+// aren't problems, since files downloaded by older versions have none.
+func dbCheck(w io.Writer, hash bool) error {
+	var checked, failed, problems int
+	known := make(map[string]bool)
+
+	err := database.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(blog, _ []byte) error {
+			return tx.Bucket(filesBucket).Bucket(blog).ForEach(func(k, v []byte) error {
+				var rec fileRecord
+				if err := json.Unmarshal(v, &rec); err != nil {
+					fmt.Fprintf(w, "%s/%s: bad record: %v\n", blog, k, err)
+					problems++
+					return nil
+				}
+
+				if rec.Status == fileFailed {
+					failed++
+					return nil
+				}
+				if rec.Status != fileDownloaded {
+					// Links and probed photos that weren't
+					// downloaded under their own names. The
+					// files they led to have records of their
+					// own.
+					return nil
+				}
+				checked++
+				known[string(blog)+"/"+path.Base(rec.Path)] = true
+				if rec.Converted != "" {
+					known[string(blog)+"/"+rec.Converted] = true
+				}
+
+				if problem := checkFileRecord(string(blog), rec, hash); problem != "" {
+					fmt.Fprintf(w, "%s/%s: %s\n", blog, k, problem)
+					problems++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	untracked, err := untrackedFiles(known)
+	if err != nil {
+		return err
+	}
+	for _, name := range untracked {
+		fmt.Fprintf(w, "%s: no record\n", name)
+	}
+
+	fmt.Fprintf(w, "Checked %d files: %d problems, %d failed downloads, %d files without a record\n", checked, problems, failed, len(untracked))
+	if problems != 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	return nil
+}
+
+// untrackedFiles returns the files in the blog folders of the download
+// directory that aren't in known, as blog/name.
+func untrackedFiles(known map[string]bool) ([]string, error) {
+	dirs, err := ioutil.ReadDir(cfg.DownloadDirectory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var untracked []string
+	for _, d := range dirs {
+		if !d.IsDir() || d.Name() == deletedDirName || d.Name() == quarantineDirName {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(cfg.DownloadDirectory, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := d.Name() + "/" + f.Name()
+			if f.IsDir() || strings.HasSuffix(f.Name(), partSuffix) || known[name] {
+				continue
+			}
+			untracked = append(untracked, name)
+		}
+	}
+	return untracked, nil
+}
+
+// checkFileRecord returns what's wrong with a downloaded file, if
+// anything.
+func checkFileRecord(blog string, rec fileRecord, hash bool) string {
+	if rec.Converted != "" {
+		dir := path.Join(cfg.DownloadDirectory, blog)
+		if rec.Path != "" {
+			dir = path.Dir(rec.Path)
+		}
+		if _, err := os.Stat(path.Join(dir, rec.Converted)); err != nil {
+			return "converted file " + rec.Converted + " is missing"
+		}
+		if rec.Path == "" || path.Base(rec.Path) != rec.Converted && !fileExists(rec.Path) {
+			// Older records only have the name, or the path of
+			// the original that was removed.
+			return ""
+		}
+	}
+
+	info, err := os.Stat(rec.Path)
+	if err != nil {
+		return rec.Path + " is missing"
+	}
+	if rec.Size != 0 && info.Size() != rec.Size {
+		return fmt.Sprintf("%s is %d bytes; want %d", rec.Path, info.Size(), rec.Size)
+	}
+
+	if hash && rec.Hash != "" {
+		data, err := ioutil.ReadFile(rec.Path)
+		if err != nil {
+			return err.Error()
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != rec.Hash {
+			return rec.Path + " doesn't match its hash"
+		}
+	}
+	return ""
+}
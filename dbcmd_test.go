@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDBList(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	updateDatabase("demo", 123)
+	saveCheckpoint("demo", checkpoint{Top: 200, LowWater: 150})
+	markBlogParsed("demo")
+	updateDatabase("old", 5)
+	recordRun(runRecord{Blogs: []string{"demo"}})
+
+	var out bytes.Buffer
+	if err := dbList(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("dbList printed %d lines; want 3:\n%s", len(lines), out.String())
+	}
+	tests := []struct {
+		line  string
+		words []string
+	}{
+		{lines[1], []string{"demo", "123", "unfinished"}},
+		{lines[2], []string{"old", "5", "needs full check"}},
+	}
+	for i, test := range tests {
+		for _, w := range test.words {
+			if !strings.Contains(test.line, w) {
+				t.Errorf("#%d: line %q doesn't contain %q", i, test.line, w)
+			}
+		}
+	}
+}
+
+func TestDBResetAndSetCursor(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	updateDatabase("demo", 123)
+	saveCheckpoint("demo", checkpoint{Top: 200, LowWater: 150})
+	uuid := readBlog("demo").UUID
+
+	if err := dbSetCursor(ioutil.Discard, []string{"demo", "100"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := readBlog("demo"); rec.LastPostID != 100 || rec.Checkpoint != nil {
+		t.Errorf("after set-cursor: last post %d, checkpoint %v; want 100, none", rec.LastPostID, rec.Checkpoint)
+	}
+
+	if err := dbReset(ioutil.Discard, []string{"demo"}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := readBlog("demo"); rec.LastPostID != 0 || rec.UUID != uuid {
+		t.Errorf("after reset: last post %d, UUID %s; want 0, %s", rec.LastPostID, rec.UUID, uuid)
+	}
+
+	for i, args := range [][]string{{"unknown", "1"}, {"demo", "x"}, {"demo"}} {
+		if err := dbSetCursor(ioutil.Discard, args); err == nil {
+			t.Errorf("#%d: dbSetCursor(%q) succeeded; want an error", i, args)
+		}
+	}
+	if err := dbReset(ioutil.Discard, []string{"unknown"}); err == nil {
+		t.Error("dbReset(unknown) succeeded; want an error")
+	}
+}
+
+func TestDBExportImport(t *testing.T) {
+	cleanup := setupTestDatabase(t)
+
+	updateDatabase("demo", 123)
+	updatePosts("demo", map[int64][]string{123: {"a.jpg"}}, map[int64]postState{123: postQueued}, false)
+	recordConversion("demo", "a.png", "a.jpg")
+	recordRun(runRecord{Blogs: []string{"demo"}, FilesDownloaded: 3})
+
+	exported, err := exportDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	defer setupTestDatabase(t)()
+	var e dbExport
+	if err = json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if err = importDatabase(e); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := exportDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Times lose their monotonic clock readings in JSON.
+	imported.Blogs["demo"] = e.Blogs["demo"]
+	if !reflect.DeepEqual(imported, e) {
+		t.Errorf("imported database=%+v; want %+v", imported, e)
+	}
+	if ids := incompletePosts("demo"); len(ids) != 1 {
+		t.Errorf("incompletePosts after import=%v; want [123]", ids)
+	}
+
+	e.Schema++
+	if err = importDatabase(e); err == nil {
+		t.Error("importing an export from another schema succeeded")
+	}
+}
+
+func TestCompactDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "test.db")
+	db, err := bolt.Open(p, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	old := database
+	database = db
+	updateDatabase("demo", 123)
+	updatePosts("demo", map[int64][]string{123: {"a.jpg"}}, nil, false)
+	for i := 0; i < 3; i++ {
+		recordRun(runRecord{})
+	}
+	want, err := exportDatabase()
+	database = old
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = compactDatabase(p); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(p, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database = db
+	defer func() { database = old }()
+
+	got, err := exportDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Blogs["demo"] = want.Blogs["demo"]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted database=%+v; want %+v", got, want)
+	}
+
+	// Sequences are kept, so runs don't overwrite each other.
+	db.View(func(tx *bolt.Tx) error {
+		if seq := tx.Bucket(runsBucket).Sequence(); seq != 3 {
+			t.Errorf("runs sequence=%d; want 3", seq)
+		}
+		return nil
+	})
+}
+
+func TestDBCheck(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := cfg.DownloadDirectory
+	cfg.DownloadDirectory = dir
+	defer func() { cfg.DownloadDirectory = oldDir }()
+	blogDir := path.Join(dir, "demo")
+	if err = os.Mkdir(blogDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(blogDir, "extra.jpg"), []byte("data"), 0644)
+
+	u := &User{name: "demo"}
+	for _, name := range []string{"good.jpg", "changed.jpg", "missing.jpg"} {
+		p := path.Join(blogDir, name)
+		if err = ioutil.WriteFile(p, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		File{User: u, Filename: name}.record(p, []byte("data"))
+	}
+	ioutil.WriteFile(path.Join(blogDir, "changed.jpg"), []byte("more data"), 0644)
+	os.Remove(path.Join(blogDir, "missing.jpg"))
+
+	var out bytes.Buffer
+	if err = dbCheck(&out, false); err == nil {
+		t.Error("dbCheck found no problems")
+	}
+	report := out.String()
+	for _, want := range []string{"changed.jpg is 9 bytes", "missing.jpg is missing", "demo/extra.jpg: no record", "Checked 3 files: 2 problems, 0 failed downloads, 1 files without a record"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "good.jpg") {
+		t.Errorf("report mentions good.jpg:\n%s", report)
+	}
+
+	// Same size, different contents.
+	ioutil.WriteFile(path.Join(blogDir, "good.jpg"), []byte("DATA"), 0644)
+	out.Reset()
+	dbCheck(&out, true)
+	if !strings.Contains(out.String(), "good.jpg doesn't match its hash") {
+		t.Errorf("hash check didn't notice good.jpg changed:\n%s", out.String())
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// deletedDirName is the folder inside the download directory where
+// deleted posts and terminated blogs are reported. Files in it are
+// never removed, only linked, so nothing already archived is lost.
+const deletedDirName = "_deleted"
+
+// vanishedBlogs holds the names of blogs that tumblr reported as not
+// found while reading the user list. They are checked against the
+// database once it's open.
+var vanishedBlogs []string
+
+// checkDeletedPosts stores the posts found during the user's scrape,
+// and reports any previously seen posts that have since disappeared.
+func checkDeletedPosts(u *User) {
+	u.RLock()
+	deleted := updatePosts(u.name, u.seenPosts, u.progress.states(), u.scrapeComplete)
+	u.RUnlock()
+
+	ids := make([]int64, 0, len(deleted))
+	for id := range deleted {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		reason := fmt.Sprint("post ", id, " deleted")
+		slog.Info("post deleted", "blog", u.name, "post_id", id)
+		flagDeletedFiles(u.name, reason, deleted[id].Files)
+	}
+}
+
+// checkTerminatedBlogs reports every blog in names that was downloaded
+// before, but is no longer available on tumblr.
+func checkTerminatedBlogs(names []string) {
+	for _, name := range names {
+		if !markBlogTerminated(name) {
+			continue
+		}
+		slog.Warn("blog appears to have been terminated", "blog", name)
+
+		var files []string
+		infos, _ := ioutil.ReadDir(path.Join(cfg.DownloadDirectory, name))
+		for _, info := range infos {
+			if !info.IsDir() {
+				files = append(files, info.Name())
+			}
+		}
+		flagDeletedFiles(name, "blog terminated", files)
+	}
+}
+
+// flagDeletedFiles writes an entry to the deleted report for each
+// local file that belonged to deleted content. If the deleted view is
+// enabled, the files are also hardlinked into it.
+func flagDeletedFiles(blog, reason string, files []string) {
+	dir := path.Join(cfg.DownloadDirectory, deletedDirName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		slog.Warn("can't write the deleted report", "blog", blog, "path", dir, "err", err)
+		return
+	}
+
+	report, err := os.OpenFile(path.Join(dir, "report.txt"),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Warn("can't write the deleted report", "blog", blog, "path", path.Join(dir, "report.txt"), "err", err)
+		return
+	}
+	defer report.Close()
+
+	date := time.Now().Format("2006-01-02 15:04:05")
+	if len(files) == 0 {
+		fmt.Fprintf(report, "%s\t%s\t%s\t(no files)\n", date, blog, reason)
+		return
+	}
+
+	for _, f := range files {
+		filepath := path.Join(cfg.DownloadDirectory, blog, f)
+		if _, err = os.Stat(filepath); err != nil {
+			fmt.Fprintf(report, "%s\t%s\t%s\t%s (not downloaded)\n", date, blog, reason, f)
+			continue
+		}
+		fmt.Fprintf(report, "%s\t%s\t%s\t%s\n", date, blog, reason, filepath)
+
+		if cfg.DeletedView {
+			linkDeletedFile(filepath, path.Join(dir, blog, f))
+		}
+	}
+}
+
+func linkDeletedFile(oldpath, newpath string) {
+	err := os.MkdirAll(path.Dir(newpath), 0755)
+	if err != nil {
+		slog.Warn("can't link a deleted file", "path", newpath, "err", err)
+		return
+	}
+
+	if _, err = os.Stat(newpath); err == nil {
+		return
+	}
+
+	if err = os.Link(oldpath, newpath); err != nil {
+		slog.Warn("can't link a deleted file", "path", oldpath, "err", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// setupTestDatabase points the global database at a fresh database in
+// a temporary directory. The returned function restores the old one.
+func setupTestDatabase(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(path.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	old := database
+	database = db
+
+	return func() {
+		db.Close()
+		database = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpdatePosts(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	first := map[int64][]string{
+		1: {"a.jpg"},
+		2: {"b.jpg", "c.jpg"},
+		3: nil,
+	}
+	if deleted := updatePosts("demo", first, nil, true); len(deleted) != 0 {
+		t.Fatalf("first scan: %d posts deleted, want 0", len(deleted))
+	}
+
+	// Incomplete scrapes must never mark posts as deleted.
+	if deleted := updatePosts("demo", map[int64][]string{3: nil}, nil, false); len(deleted) != 0 {
+		t.Errorf("incomplete scan: %d posts deleted, want 0", len(deleted))
+	}
+
+	deleted := updatePosts("demo", map[int64][]string{3: nil}, nil, true)
+	if len(deleted) != 2 {
+		t.Fatalf("complete scan: %d posts deleted, want 2", len(deleted))
+	}
+	if files := deleted[2].Files; len(files) != 2 || files[0] != "b.jpg" {
+		t.Errorf("deleted[2].Files = %v, want [b.jpg c.jpg]", files)
+	}
+
+	// Posts are only reported once.
+	if deleted = updatePosts("demo", map[int64][]string{3: nil}, nil, true); len(deleted) != 0 {
+		t.Errorf("repeated scan: %d posts deleted, want 0", len(deleted))
+	}
+}
+
+func TestIncompletePosts(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	seen := map[int64][]string{1: {"a.jpg"}, 2: {"b.jpg"}, 3: nil}
+	states := map[int64]postState{1: postComplete, 2: postQueued, 3: postComplete}
+	updatePosts("demo", seen, states, false)
+
+	if ids := incompletePosts("demo"); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("incompletePosts=%v; want [2]", ids)
+	}
+
+	// Post 2 is queued again, but not found on a page this time. Its
+	// files are kept.
+	updatePosts("demo", nil, map[int64]postState{2: postComplete}, false)
+	if ids := incompletePosts("demo"); len(ids) != 0 {
+		t.Errorf("incompletePosts after completing=%v; want none", ids)
+	}
+	if deleted := updatePosts("demo", map[int64][]string{1: nil, 3: nil}, nil, true); len(deleted[2].Files) != 1 {
+		t.Errorf("files of post 2=%v; want [b.jpg]", deleted[2].Files)
+	}
+
+	// Sessions that were stopped don't count as attempts.
+	for i := 0; i < maxPostAttempts+1; i++ {
+		updatePosts("demo", nil, map[int64]postState{1: postInterrupted}, false)
+	}
+	if ids := incompletePosts("demo"); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("incompletePosts after stopped sessions=%v; want [1]", ids)
+	}
+
+	// Posts that keep failing are given up on.
+	for i := 0; i < maxPostAttempts; i++ {
+		if ids := incompletePosts("demo"); i != 0 && len(ids) != 1 {
+			t.Fatalf("attempt %d: incompletePosts=%v; want [1]", i, ids)
+		}
+		updatePosts("demo", nil, map[int64]postState{1: postQueued}, false)
+	}
+	if ids := incompletePosts("demo"); len(ids) != 0 {
+		t.Errorf("incompletePosts after %d attempts=%v; want none", maxPostAttempts, ids)
+	}
+}
+
+func TestMarkBlogTerminated(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	if markBlogTerminated("unknown") {
+		t.Error("markBlogTerminated(unknown) = true for a blog never downloaded")
+	}
+
+	updateDatabase("demo", 10)
+	if !markBlogTerminated("demo") {
+		t.Error("markBlogTerminated(demo) = false, want true")
+	}
+	if markBlogTerminated("demo") {
+		t.Error("markBlogTerminated(demo) = true the second time, want false")
+	}
+}
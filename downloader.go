@@ -9,13 +9,31 @@ import (
 
 func downloader(id int, limiter <-chan time.Time, fileChan <-chan File) {
 	for f := range fileChan {
+		downloads.Wait()
+
+		// Files still queued when the downloader is stopped are
+		// dropped, so that every user can finish up.
+		if stopping() {
+			f.discard()
+			continue
+		}
 
 		err := os.MkdirAll(path.Join(cfg.DownloadDirectory, f.User.String()), 0755)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		<-limiter
+		if f.resolver != nil {
+			downloadLinked(f, limiter)
+			continue
+		}
+
+		if len(f.variants) != 0 {
+			downloadPhoto(f, limiter)
+			continue
+		}
+
+		waitLimiter(limiter)
 		showProgress(f)
 		f.Download()
 
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	// dryRun scrapes blogs without downloading or linking anything, and
+	// without changing the database. What would be done is shown
+	// instead.
+	dryRun bool
+
+	// planFormat is how the plan of a dry run is shown: "text" or "json".
+	planFormat string
+)
+
+func init() {
+	flag.BoolVar(&dryRun, "dry-run", false, "Scrape blogs and show what would be downloaded, without downloading anything or changing the database.")
+	flag.StringVar(&planFormat, "plan-format", "text", `How -dry-run shows what would be done: "text" or "json".`)
+}
+
+// What would be done with a file.
+const (
+	planDownload = "download"
+	planHardlink = "hardlink"
+	planSkip     = "skip"
+)
+
+// A planEntry is what a dry run would do with a file.
+type planEntry struct {
+	Blog     string `json:"blog"`
+	PostID   int64  `json:"post_id"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	// Size is -1 if it isn't known.
+	Size int64 `json:"size"`
+}
+
+// A planSummary counts what would be done for a blog, or for every blog.
+type planSummary struct {
+	Blog      string `json:"blog,omitempty"`
+	Downloads int    `json:"downloads"`
+	Hardlinks int    `json:"hardlinks"`
+	Skipped   int    `json:"skipped"`
+	// Bytes is the size of the downloads whose sizes are known.
+	Bytes        int64 `json:"bytes"`
+	UnknownSizes int   `json:"unknown_sizes"`
+}
+
+func (s *planSummary) add(e planEntry) {
+	switch e.Action {
+	case planDownload:
+		s.Downloads++
+		if e.Size < 0 {
+			s.UnknownSizes++
+		} else {
+			s.Bytes += e.Size
+		}
+	case planHardlink:
+		s.Hardlinks++
+	case planSkip:
+		s.Skipped++
+	}
+}
+
+// A dryRunPlan collects what a dry run would do.
+type dryRunPlan struct {
+	sync.Mutex
+	entries []planEntry
+}
+
+var plan dryRunPlan
+
+// planFile adds a file to the plan, if this is a dry run.
+func planFile(f File, action, reason string, size int64) {
+	if !dryRun {
+		return
+	}
+	plan.Lock()
+	plan.entries = append(plan.entries, planEntry{
+		Blog:     f.User.name,
+		PostID:   f.PostID,
+		URL:      f.URL,
+		Filename: f.Filename,
+		Action:   action,
+		Reason:   reason,
+		Size:     size,
+	})
+	plan.Unlock()
+}
+
+// planned adds a file that reached the download queue to the plan, and
+// is done with it.
+func (f File) planned(action, reason string, size int64) {
+	planFile(f, action, reason, size)
+	f.User.progress.complete(f.PostID)
+	atomic.AddUint64(&f.User.filesProcessed, 1)
+	f.User.downloadWg.Done()
+}
+
+// planner takes the place of a downloader in a dry run. It finds out
+// what would be downloaded, and how big it is, without downloading it.
+func planner(limiter <-chan time.Time, fileChan <-chan File) {
+	for f := range fileChan {
+		if stopping() {
+			f.discard()
+			continue
+		}
+
+		switch {
+		case f.resolver != nil:
+			// Resolving a link takes requests to another site, so
+			// it's left for the real run.
+			f.planned(planDownload, "link to resolve with "+f.resolver.Name(), -1)
+		case len(f.variants) != 0:
+			planPhoto(f, limiter)
+		default:
+			waitLimiter(limiter)
+			size, reason := headSize(f.URL)
+			f.planned(planDownload, reason, size)
+		}
+	}
+}
+
+// planPhoto plans the download of the largest variant of a photo.
+func planPhoto(f File, limiter <-chan time.Time) {
+	best, size, smaller, have := largestPhoto(f, limiter)
+	if have {
+		f.User.skipFile(f, "largest version already downloaded")
+		return
+	}
+	if len(smaller) != 0 {
+		best.planned(planDownload, "larger than the copy on disk", size)
+		return
+	}
+	if f.User.checkFile(best) {
+		return
+	}
+	best.planned(planDownload, "new file", size)
+}
+
+// headSize asks for the size of a file without downloading it. The
+// size is -1 if the server doesn't say.
+func headSize(u string) (size int64, reason string) {
+	resp, err := probeClient.Head(u)
+	if err != nil {
+		return -1, "new file (size unknown: " + err.Error() + ")"
+	}
+	resp.Body.Close()
+	reqStats.recordStatus("probe", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		return -1, "new file (size unknown: HTTP status " + resp.Status + ")"
+	}
+	return resp.ContentLength, "new file"
+}
+
+// summarize sorts the plan, and counts what would be done for each
+// blog.
+func (p *dryRunPlan) summarize() (entries []planEntry, blogs []planSummary, total planSummary) {
+	p.Lock()
+	entries = append([]planEntry(nil), p.entries...)
+	p.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Blog != b.Blog {
+			return a.Blog < b.Blog
+		}
+		if a.PostID != b.PostID {
+			return a.PostID > b.PostID
+		}
+		return a.Filename < b.Filename
+	})
+
+	for _, e := range entries {
+		if len(blogs) == 0 || blogs[len(blogs)-1].Blog != e.Blog {
+			blogs = append(blogs, planSummary{Blog: e.Blog})
+		}
+		blogs[len(blogs)-1].add(e)
+		total.add(e)
+	}
+	return entries, blogs, total
+}
+
+// writePlan shows what a dry run would do, in the plan format.
+func writePlan(w io.Writer, format string) error {
+	entries, blogs, total := plan.summarize()
+	if format == "json" {
+		if entries == nil {
+			entries, blogs = []planEntry{}, []planSummary{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Files []planEntry   `json:"files"`
+			Blogs []planSummary `json:"blogs"`
+			Total planSummary   `json:"total"`
+		}{entries, blogs, total})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tBLOG\tPOST\tFILE\tSIZE\tREASON")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", e.Action, e.Blog, e.PostID, e.Filename, planSize(e.Size), e.Reason)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "BLOG\tDOWNLOADS\tHARDLINKS\tSKIPPED\tSIZE")
+	for _, s := range append(blogs, total) {
+		name := s.Blog
+		if name == "" {
+			name = "total"
+		}
+		size := byteSize(uint64(s.Bytes))
+		if s.UnknownSizes != 0 {
+			size += fmt.Sprintf(" + %d unknown", s.UnknownSizes)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", name, s.Downloads, s.Hardlinks, s.Skipped, size)
+	}
+	return tw.Flush()
+}
+
+func planSize(size int64) string {
+	if size < 0 {
+		return "?"
+	}
+	return byteSize(uint64(size))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// setupDryRun starts a dry run with an empty plan. The returned function
+// ends it.
+func setupDryRun() func() {
+	dryRun = true
+	plan = dryRunPlan{}
+	return func() {
+		dryRun = false
+		plan = dryRunPlan{}
+	}
+}
+
+func TestDryRunCheckFile(t *testing.T) {
+	defer setupDryRun()()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := cfg.DownloadDirectory
+	cfg.DownloadDirectory = dir
+	defer func() { cfg.DownloadDirectory = oldDir }()
+
+	os.MkdirAll(path.Join(dir, "demo"), 0755)
+	ioutil.WriteFile(path.Join(dir, "demo", "dryrun_have.jpg"), []byte("data"), 0644)
+
+	demo, other := &User{name: "demo"}, &User{name: "other"}
+	tests := []struct {
+		u        *User
+		name     string
+		queued   bool
+		action   string
+		inReason string
+	}{
+		{demo, "dryrun_have.jpg", false, planSkip, "already downloaded"},
+		{demo, "dryrun_new.jpg", true, "", ""},
+		{other, "dryrun_new.jpg", false, planHardlink, path.Join(dir, "demo", "dryrun_new.jpg")},
+	}
+
+	for i, test := range tests {
+		test.u.downloadWg.Add(1)
+		f := File{User: test.u, Filename: test.name, PostID: int64(i)}
+		if queued := !test.u.checkFile(f); queued != test.queued {
+			t.Errorf("#%d: %s: queued=%t; want %t", i, test.name, queued, test.queued)
+		}
+		if test.queued {
+			test.u.downloadWg.Done()
+			continue
+		}
+
+		entries, _, _ := plan.summarize()
+		var found bool
+		for _, e := range entries {
+			if e.PostID == int64(i) {
+				found = true
+				if e.Action != test.action || !strings.Contains(e.Reason, test.inReason) {
+					t.Errorf("#%d: %s: planned %s (%s); want %s (%s)", i, test.name, e.Action, e.Reason, test.action, test.inReason)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("#%d: %s isn't in the plan", i, test.name)
+		}
+	}
+
+	// Files that reach the queue are only planned once they're looked at.
+	if entries, _, _ := plan.summarize(); len(entries) != 2 {
+		t.Errorf("plan has %d files; want 2", len(entries))
+	}
+	demo.downloadWg.Wait()
+	other.downloadWg.Wait()
+}
+
+func TestWritePlan(t *testing.T) {
+	defer setupDryRun()()
+
+	u, v := &User{name: "b-blog"}, &User{name: "a-blog"}
+	for _, f := range []struct {
+		f      File
+		action string
+		size   int64
+	}{
+		{File{User: u, PostID: 1, Filename: "1.jpg"}, planDownload, 1000},
+		{File{User: u, PostID: 2, Filename: "2.jpg"}, planDownload, -1},
+		{File{User: u, PostID: 2, Filename: "3.jpg"}, planSkip, -1},
+		{File{User: v, PostID: 5, Filename: "1.jpg"}, planHardlink, -1},
+		{File{User: v, PostID: 6, Filename: "6.jpg"}, planDownload, 24},
+	} {
+		planFile(f.f, f.action, "test", f.size)
+	}
+
+	var out bytes.Buffer
+	if err := writePlan(&out, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Files []planEntry
+		Blogs []planSummary
+		Total planSummary
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, e := range got.Files {
+		order = append(order, e.Blog+"/"+e.Filename)
+	}
+	if want := "a-blog/6.jpg a-blog/1.jpg b-blog/2.jpg b-blog/3.jpg b-blog/1.jpg"; strings.Join(order, " ") != want {
+		t.Errorf("files in order %v; want %s", order, want)
+	}
+
+	want := []planSummary{
+		{Blog: "a-blog", Downloads: 1, Hardlinks: 1, Bytes: 24},
+		{Blog: "b-blog", Downloads: 2, Skipped: 1, Bytes: 1000, UnknownSizes: 1},
+	}
+	if len(got.Blogs) != len(want) || got.Blogs[0] != want[0] || got.Blogs[1] != want[1] {
+		t.Errorf("blogs=%+v; want %+v", got.Blogs, want)
+	}
+	if total := (planSummary{Downloads: 3, Hardlinks: 1, Skipped: 1, Bytes: 1024, UnknownSizes: 1}); got.Total != total {
+		t.Errorf("total=%+v; want %+v", got.Total, total)
+	}
+
+	out.Reset()
+	if err := writePlan(&out, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "+ 1 unknown") || !strings.Contains(out.String(), "total") {
+		t.Errorf("text plan doesn't have the totals:\n%s", out.String())
+	}
+}
+
+func TestDryRunDatabase(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	terminated := time.Now()
+	updateBlog("demo", func(rec *blogRecord) {
+		rec.LastPostID = 123
+		rec.Terminated = terminated
+	})
+
+	defer setupDryRun()()
+	u := &User{name: "demo"}
+	err := database.View(func(tx *bolt.Tx) error {
+		return loadUserTx(tx, u)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.lastPostID != 123 {
+		t.Errorf("last post=%d; want 123", u.lastPostID)
+	}
+	if readBlog("demo").Terminated.IsZero() {
+		t.Error("loading a blog in a dry run cleared that it was terminated")
+	}
+
+	// Checkpoints aren't saved.
+	u.cursor = &scrapeCursor{resume: &checkpoint{Top: 200, LowWater: 150}}
+	u.progress = newPostProgress()
+	u.saveCheckpoint()
+	if readBlog("demo").Checkpoint != nil {
+		t.Error("a dry run saved a checkpoint")
+	}
+	dryRun = false
+	u.saveCheckpoint()
+	if readBlog("demo").Checkpoint == nil {
+		t.Error("the checkpoint isn't saved outside of a dry run")
+	}
+}
+
+func TestOpenDryRunDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldFile := databaseFile
+	defer func() { databaseFile = oldFile }()
+	databaseFile = path.Join(dir, "tumblr-update.db")
+
+	// Without a database, one isn't made.
+	db, err := openDryRunDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if fileExists(databaseFile) {
+		t.Error("a dry run made a database")
+	}
+
+	// A database with an older schema is left as it was.
+	db, err = bolt.Open(databaseFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("tumblr"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("demo"), []byte("123"))
+	})
+	db.Close()
+
+	db, err = openDryRunDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lastPostID int64
+	db.View(func(tx *bolt.Tx) error {
+		rec, _, err := getBlog(tx, "demo")
+		lastPostID = rec.LastPostID
+		return err
+	})
+	db.Close()
+	if lastPostID != 123 {
+		t.Errorf("last post in the migrated copy=%d; want 123", lastPostID)
+	}
+
+	db, err = bolt.Open(databaseFile, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if version, _ := schemaVersion(tx); version != 0 || tx.Bucket(blogsBucket) != nil {
+			t.Errorf("a dry run migrated the database to version %d", version)
+		}
+		return nil
+	})
+	db.Close()
+
+	// An up to date database is only read.
+	db, err = openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = openDryRunDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Update(func(tx *bolt.Tx) error { return nil }); err != bolt.ErrDatabaseReadOnly {
+		t.Errorf("writing in a dry run: %v; want %v", err, bolt.ErrDatabaseReadOnly)
+	}
+}
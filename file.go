@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -12,16 +14,24 @@ import (
 	"time"
 )
 
-var (
-	gfyRequest = "https://gfycat.com/cajax/get/%s"
-)
-
 // A File contains information on a particular tumblr URL, as well as the user where the URL was found.
 type File struct {
 	User          *User
 	URL           string
 	UnixTimestamp int64
 	Filename      string
+	PostID        int64
+
+	// resolver is set for links found by a Resolver. URL is then the
+	// link, which has to be resolved before anything is downloaded.
+	resolver Resolver
+
+	// variants are URLs of larger versions of a photo, which may or
+	// may not exist. They're checked before the photo is downloaded.
+	variants []string
+
+	// meta describes the post the file is from, for the catalog.
+	meta *postMeta
 }
 
 func newFile(URL string) File {
@@ -32,101 +42,194 @@ func newFile(URL string) File {
 }
 
 // Download downloads a file specified in the file's URL.
-func (f File) Download() {
-	filepath := path.Join(cfg.DownloadDirectory, f.User.String(), path.Base(f.Filename))
+//
+// The file is saved with the extension that matches what was actually
+// downloaded, which isn't always what the URL says. It returns where the
+// file was saved, or "" if it wasn't downloaded.
+func (f File) Download() string {
 	var resp *http.Response
 	var err error
 	var pic []byte
 
-	for {
-		resp, err = http.Get(f.URL)
+	req, err := http.NewRequestWithContext(abortCtx, "GET", f.URL, nil)
+	if err != nil {
+		f.fail(err)
+		return ""
+	}
+	if cfg.PreferredFormat != "" {
+		req.Header.Set("Accept", cfg.PreferredFormat+",*/*;q=0.8")
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err = http.DefaultClient.Do(req)
 		if err != nil {
-			log.Println(err)
+			if abortCtx.Err() != nil || stopping() {
+				f.discard()
+				return ""
+			}
+			slog.Warn("download request failed", f.logFields("attempt", attempt, "err", err)...)
+			f.User.recordError(err)
+			reqStats.recordRetry("download")
 			continue
 		}
 		defer resp.Body.Close()
+		reqStats.recordStatus("download", resp.StatusCode)
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			// Saving an error page would make the file look
+			// downloaded. The post is tried again next session.
+			f.fail(fmt.Errorf("HTTP status %s", resp.Status))
+			return ""
+		}
 
 		pic, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Println("ReadAll:", err)
+			if abortCtx.Err() != nil || stopping() {
+				f.discard()
+				return ""
+			}
+			slog.Warn("download cut off", f.logFields("attempt", attempt, "err", err)...)
+			f.User.recordError(err)
+			reqStats.recordRetry("download")
 			continue
 		}
 
 		break
 	}
+	f.User.recordSuccess()
 
-	err = ioutil.WriteFile(filepath, pic, 0644)
+	contentType := sniffContentType(resp.Header.Get("Content-Type"), pic)
+	filename := fixExtension(path.Base(f.Filename), contentType)
+	filepath := path.Join(cfg.DownloadDirectory, f.User.String(), filename)
+
+	err = writeFile(filepath, pic)
 	if err != nil {
 		log.Fatal("WriteFile:", err)
 	}
 
 	err = os.Chtimes(filepath, time.Now(), time.Unix(f.UnixTimestamp, 0))
 	if err != nil {
-		log.Println(err)
+		slog.Warn("can't set the time of a file", "path", filepath, "err", err)
+	}
+
+	// The converted file is the one that's kept, so it's the one
+	// that's recorded.
+	if converted := convertFile(f, filepath, contentType); converted != filepath {
+		filepath = converted
+		f.recordFile(filepath)
+	} else {
+		f.record(filepath, pic)
 	}
+	runFileHook(f, filepath)
 
-	FileTracker.Signal(f.Filename)
+	FileTracker.Signal(f.Filename, filepath)
 
 	pBar.Increment()
+	f.User.progress.complete(f.PostID)
 	f.User.downloadWg.Done()
 	atomic.AddUint64(&f.User.filesProcessed, 1)
+	atomic.AddUint64(&f.User.filesDownloaded, 1)
 	atomic.AddUint64(&gStats.filesDownloaded, 1)
 	atomic.AddUint64(&gStats.bytesDownloaded, uint64(len(pic)))
+	return filepath
+}
 
+// partSuffix is the suffix of files that are still being written.
+const partSuffix = ".part"
+
+// writeFile writes data to a temporary file next to filepath, and then
+// renames it, so that filepath is never left half-written.
+func writeFile(filepath string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(filepath), path.Base(filepath)+".*"+partSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
-// String is the standard method for the Stringer interface.
-func (f File) String() string {
-	date := time.Unix(f.UnixTimestamp, 0)
-	return f.User.String() + " - " + date.Format("2006-01-02 15:04:05") + " - " + path.Base(f.Filename)
+// discard gives up on a file that was going to be downloaded, because
+// the downloader is shutting down.
+func (f File) discard() {
+	FileTracker.Discard(f.Filename, f.path())
+	f.User.markInterrupted()
+	f.User.downloadWg.Done()
 }
 
-// Gfy houses the Gfycat response.
-type Gfy struct {
-	GfyItem struct {
-		Mp4Url  string `json:"mp4Url"`
-		WebmURL string `json:"webmUrl"`
-	} `json:"gfyItem"`
+// path is where the file is registered with the FileTracker.
+func (f File) path() string {
+	return path.Join(cfg.DownloadDirectory, f.User.name, f.Filename)
 }
 
-// GetGfycatURL gets the appropriate Gfycat URL for download, from a "normal" link.
-func GetGfycatURL(slug string) string {
-	gfyURL := fmt.Sprintf(gfyRequest, slug)
+// record stores a downloaded file in the database.
+func (f File) record(filepath string, data []byte) {
+	sum := sha256.Sum256(data)
+	updateFile(f.User.name, f.Filename, func(rec *fileRecord) {
+		rec.URL = f.URL
+		rec.Path = filepath
+		rec.PostID = f.PostID
+		rec.Hash = hex.EncodeToString(sum[:])
+		rec.Size = int64(len(data))
+		rec.Status = fileDownloaded
+	})
+	catalogFile(f, filepath, int64(len(data)), hex.EncodeToString(sum[:]))
+}
 
-	var resp *http.Response
-	for {
-		resp2, err := http.Get(gfyURL)
-		if err != nil {
-			log.Println("GetGfycatURL: ", err)
-		} else {
-			resp = resp2
-			break
-		}
+// recordFile stores a file that's on disk at filepath in the database,
+// like record does.
+func (f File) recordFile(filepath string) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		slog.Warn("can't record a file", f.logFields("path", filepath, "err", err)...)
+		return
 	}
-	defer resp.Body.Close()
-
-	gfyData, err := ioutil.ReadAll(resp.Body)
-	checkFatalError(err)
+	f.record(filepath, data)
+}
 
-	var gfy Gfy
+// fail gives up on a file for this session. The post it's from is
+// stored as incomplete, so the next session queues it again.
+func (f File) fail(err error) {
+	slog.Error("download failed", f.logFields("err", err)...)
+	f.User.recordError(err)
+	recordFailure(f.User.name, causeDownload, f.URL, err)
+	if f.Filename != "" {
+		updateFile(f.User.name, f.Filename, func(rec *fileRecord) {
+			rec.URL = f.URL
+			rec.PostID = f.PostID
+			rec.Status = fileFailed
+		})
+	}
+	FileTracker.Discard(f.Filename, f.path())
+	f.User.progress.fail(f.PostID)
+	f.User.progress.complete(f.PostID)
 
-	err = json.Unmarshal(gfyData, &gfy)
-	checkFatalError(err, "Gfycat Unmarshal:")
+	pBar.Increment()
+	f.User.downloadWg.Done()
+	atomic.AddUint64(&f.User.filesProcessed, 1)
+}
 
-	return gfy.GfyItem.Mp4Url
+// logFields returns the fields of log messages about the file, followed
+// by more fields.
+func (f File) logFields(fields ...interface{}) []interface{} {
+	return append([]interface{}{"blog", f.User.name, "post_id", f.PostID, "url", f.URL}, fields...)
 }
 
-func getGfycatFiles(b, slug string) []File {
-	var files []File
-	regexResult := gfycatSearch.FindStringSubmatch(b)
-	if regexResult != nil {
-		for i, v := range regexResult[1:] {
-			gfyFile := newFile(GetGfycatURL(v))
-			if slug != "" {
-				gfyFile.Filename = fmt.Sprintf("%s_gfycat_%02d.mp4", slug, i+1)
-			}
-			files = append(files, gfyFile)
-		}
-	}
-	return files
+// String is the standard method for the Stringer interface.
+func (f File) String() string {
+	date := time.Unix(f.UnixTimestamp, 0)
+	return f.User.String() + " - " + date.Format("2006-01-02 15:04:05") + " - " + path.Base(f.Filename)
 }
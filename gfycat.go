@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	gfycatSearch  = regexp.MustCompile(`href="https?:\/\/(?:www\.)?gfycat\.com\/(\w+)`)
+	waybackRawURL = regexp.MustCompile(`/web/(\d+)/`)
+)
+
+func init() {
+	registerResolver("gfycat", func(ResolverConfig) Resolver {
+		return &gfycatResolver{
+			apiBase:     "https://api.gfycat.com",
+			waybackBase: "https://archive.org",
+			redgifs:     &redgifsResolver{apiBase: "https://api.redgifs.com"},
+		}
+	})
+}
+
+// gfycatResolver finds files linked from gfycat.
+//
+// Gfycat shut down in 2023, so its API is only tried first in case it
+// ever comes back. After that, redgifs is checked, since most adult
+// content moved there with the same IDs, and then the Wayback Machine.
+type gfycatResolver struct {
+	apiBase     string
+	waybackBase string
+	redgifs     *redgifsResolver
+}
+
+func (*gfycatResolver) Name() string { return "gfycat" }
+
+func (*gfycatResolver) Match(s string) []string {
+	if cfg.IgnoreVideos {
+		return nil
+	}
+
+	var slugs []string
+	for _, m := range gfycatSearch.FindAllStringSubmatch(s, -1) {
+		slugs = append(slugs, m[1])
+	}
+	return slugs
+}
+
+// Resolve tries every known source for a gfycat video. It never fails
+// hard; if no source has a copy, an error is returned and the link is
+// skipped.
+func (r *gfycatResolver) Resolve(slug string) ([]File, error) {
+	sources := []func(string) (string, error){
+		r.fromGfycat,
+		r.fromRedgifs,
+		r.fromWayback,
+	}
+
+	var errs []string
+	for _, source := range sources {
+		u, err := source(slug)
+		if err == nil && u != "" {
+			return []File{newFile(u)}, nil
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	return nil, fmt.Errorf("gfycat: no copy of %s found (%s)", slug, strings.Join(errs, "; "))
+}
+
+func (r *gfycatResolver) fromGfycat(slug string) (string, error) {
+	resp, err := resolverClient.Get(r.apiBase + "/v1/gfycats/" + slug)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("gfycat returned " + resp.Status)
+	}
+
+	var gfy struct {
+		GfyItem struct {
+			Mp4URL string `json:"mp4Url"`
+		} `json:"gfyItem"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&gfy); err != nil {
+		return "", err
+	}
+	return gfy.GfyItem.Mp4URL, nil
+}
+
+func (r *gfycatResolver) fromRedgifs(slug string) (string, error) {
+	files, err := r.redgifs.Resolve(strings.ToLower(slug))
+	if err != nil {
+		return "", err
+	}
+	return files[0].URL, nil
+}
+
+func (r *gfycatResolver) fromWayback(slug string) (string, error) {
+	candidates := []string{
+		"giant.gfycat.com/" + slug + ".mp4",
+		"thumbs.gfycat.com/" + slug + "-mobile.mp4",
+	}
+
+	for _, c := range candidates {
+		resp, err := resolverClient.Get(r.waybackBase + "/wayback/available?url=" + url.QueryEscape(c))
+		if err != nil {
+			return "", err
+		}
+
+		var avail struct {
+			ArchivedSnapshots struct {
+				Closest struct {
+					Available bool   `json:"available"`
+					URL       string `json:"url"`
+				} `json:"closest"`
+			} `json:"archived_snapshots"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&avail)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		closest := avail.ArchivedSnapshots.Closest
+		if closest.Available && closest.URL != "" {
+			// The id_ suffix makes the Wayback Machine return the
+			// original file instead of wrapping it in its own page.
+			return waybackRawURL.ReplaceAllString(closest.URL, "/web/${1}id_/"), nil
+		}
+	}
+
+	return "", errors.New("not archived")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HookConfig contains commands that are run when files are downloaded,
+// blogs are finished, or download sessions end. Each command is a list
+// of the program to run and its arguments.
+type HookConfig struct {
+	File    []string `toml:"file"`
+	Blog    []string `toml:"blog"`
+	Session []string `toml:"session"`
+
+	// Concurrency is the maximum number of hooks running at once.
+	Concurrency int `toml:"concurrency"`
+	// Timeout is the number of seconds a hook may run before it's killed.
+	Timeout int `toml:"timeout"`
+}
+
+// A hookEvent describes what a hook is run for. It's passed to hooks
+// as JSON on stdin, and as TUMBLR_* environment variables.
+type hookEvent struct {
+	Event     string `json:"event"`
+	Path      string `json:"path,omitempty"`
+	Blog      string `json:"blog,omitempty"`
+	PostID    int64  `json:"post_id,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	// FilesDownloaded is set for blog and session events.
+	FilesDownloaded uint64 `json:"files_downloaded,omitempty"`
+}
+
+var (
+	hookSem = newSemaphore()
+	hookWg  sync.WaitGroup
+)
+
+// A semaphore limits how many hooks run at once. The limit can be
+// changed by a reload while hooks are running.
+type semaphore struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+}
+
+func newSemaphore() *semaphore {
+	s := &semaphore{limit: 1}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *semaphore) acquire() {
+	s.mu.Lock()
+	for s.running >= s.limit {
+		s.cond.Wait()
+	}
+	s.running++
+	s.mu.Unlock()
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.running--
+	s.cond.Signal()
+	s.mu.Unlock()
+}
+
+// resize changes the limit. Hooks that are already running keep
+// running, even if there are more of them than the new limit.
+func (s *semaphore) resize(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// setupHooks checks the hook config and sets the defaults.
+func setupHooks(c *HookConfig) {
+	if c.Concurrency < 1 {
+		c.Concurrency = 4
+	}
+	if c.Timeout < 1 {
+		c.Timeout = 60
+	}
+	hookSem.resize(c.Concurrency)
+}
+
+func (e hookEvent) env() []string {
+	return append(os.Environ(),
+		"TUMBLR_EVENT="+e.Event,
+		"TUMBLR_PATH="+e.Path,
+		"TUMBLR_BLOG="+e.Blog,
+		"TUMBLR_POST_ID="+strconv.FormatInt(e.PostID, 10),
+		"TUMBLR_URL="+e.URL,
+		"TUMBLR_TIMESTAMP="+strconv.FormatInt(e.Timestamp, 10),
+		"TUMBLR_FILES_DOWNLOADED="+strconv.FormatUint(e.FilesDownloaded, 10),
+	)
+}
+
+// runHook runs a hook command in the background. Failures are logged
+// and counted, but never stop the download.
+func runHook(command []string, e hookEvent) {
+	if len(command) == 0 {
+		return
+	}
+
+	hookWg.Add(1)
+	go func() {
+		defer hookWg.Done()
+
+		hookSem.acquire()
+		defer hookSem.release()
+
+		if err := execHook(command, e); err != nil {
+			slog.Warn("hook failed", "event", e.Event, "blog", e.Blog, "path", e.Path, "err", err)
+			atomic.AddUint64(&gStats.hookFailures, 1)
+		}
+	}()
+}
+
+func execHook(command []string, e hookEvent) error {
+	stdin, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(config().Hooks.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = e.env()
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	// Don't wait forever on children of the hook that keep stderr open.
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil && stderr.Len() != 0 {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return err
+}
+
+// runFileHook runs the file hook for a file that was saved to filepath.
+func runFileHook(f File, filepath string) {
+	runHook(cfg.Hooks.File, hookEvent{
+		Event:     "file",
+		Path:      filepath,
+		Blog:      f.User.name,
+		PostID:    f.PostID,
+		URL:       f.URL,
+		Timestamp: f.UnixTimestamp,
+	})
+}
+
+// runBlogHook runs the blog hook for a user that's done downloading.
+func runBlogHook(u *User) {
+	runHook(cfg.Hooks.Blog, hookEvent{
+		Event:           "blog",
+		Blog:            u.name,
+		Timestamp:       time.Now().Unix(),
+		FilesDownloaded: atomic.LoadUint64(&u.filesDownloaded),
+	})
+}
+
+// runSessionHook runs the session hook, and waits for every hook that
+// is still running to finish.
+func runSessionHook() {
+	runHook(cfg.Hooks.Session, hookEvent{
+		Event:           "session",
+		Timestamp:       time.Now().Unix(),
+		FilesDownloaded: atomic.LoadUint64(&gStats.filesDownloaded),
+	})
+	hookWg.Wait()
+}
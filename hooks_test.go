@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test hooks are shell scripts")
+	}
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.Hooks = HookConfig{Timeout: 1}
+	setupHooks(&cfg.Hooks)
+
+	out := path.Join(dir, "out")
+	script := path.Join(dir, "hook.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo "$TUMBLR_EVENT $TUMBLR_BLOG $TUMBLR_POST_ID $TUMBLR_PATH" > "$1"
+cat >> "$1"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := File{
+		User:          &User{name: "demo"},
+		URL:           "https://example.com/tumblr_abc.jpg",
+		PostID:        123,
+		UnixTimestamp: 1500000000,
+	}
+	cfg.Hooks.File = []string{script, out}
+	runFileHook(f, "/downloads/demo/tumblr_abc.jpg")
+	hookWg.Wait()
+
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(contents), "\n", 2)
+	if want := "file demo 123 /downloads/demo/tumblr_abc.jpg"; lines[0] != want {
+		t.Errorf("hook environment = %q; want %q", lines[0], want)
+	}
+
+	var e hookEvent
+	if err = json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.URL != f.URL || e.Timestamp != f.UnixTimestamp {
+		t.Errorf("hook stdin = %+v; want URL and timestamp of %+v", e, f)
+	}
+
+	failures := atomic.LoadUint64(&gStats.hookFailures)
+	cfg.Hooks.File = []string{"sh", "-c", "sleep 5"}
+	runFileHook(f, "")
+	cfg.Hooks.File = []string{path.Join(dir, "missing")}
+	runFileHook(f, "")
+	hookWg.Wait()
+
+	if n := atomic.LoadUint64(&gStats.hookFailures) - failures; n != 2 {
+		t.Errorf("%d hook failures counted; want 2", n)
+	}
+}
+
+func TestSemaphoreResize(t *testing.T) {
+	s := newSemaphore()
+	s.acquire()
+
+	acquired := make(chan bool)
+	go func() {
+		s.acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired more than the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Growing the limit lets the waiting hook run, and the hook that
+	// was already running still releases the same semaphore.
+	s.resize(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the limit grew")
+	}
+	s.release()
+	s.release()
+	if s.running != 0 {
+		t.Errorf("%d running after every release; want 0", s.running)
+	}
+}
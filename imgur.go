@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var imgurSearch = regexp.MustCompile(`https?:\/\/(?:i\.|m\.|www\.)?imgur\.com\/(?:(a|gallery)\/)?(\w+)(\.\w+)?`)
+
+func init() {
+	registerResolver("imgur", func(c ResolverConfig) Resolver {
+		return &imgurResolver{
+			apiBase:  "https://api.imgur.com",
+			fileBase: "https://i.imgur.com",
+			clientID: c.ImgurClientID,
+		}
+	})
+}
+
+// imgurResolver finds images and albums linked from imgur.
+//
+// Direct links to images are used as-is. Albums and image pages need
+// the imgur API, which requires a client ID.
+type imgurResolver struct {
+	apiBase, fileBase string
+	clientID          string
+}
+
+// imgurImage is a single image as returned by the imgur API.
+type imgurImage struct {
+	Link string `json:"link"`
+}
+
+func (*imgurResolver) Name() string { return "imgur" }
+
+func (*imgurResolver) Match(s string) []string {
+	if cfg.IgnorePhotos {
+		return nil
+	}
+	return imgurSearch.FindAllString(s, -1)
+}
+
+func (r *imgurResolver) Resolve(link string) ([]File, error) {
+	m := imgurSearch.FindStringSubmatch(link)
+	if m == nil {
+		return nil, errors.New("imgur: not an imgur link")
+	}
+	kind, id, ext := m[1], m[2], m[3]
+
+	if kind == "" && ext != "" {
+		return []File{newFile(fmt.Sprintf("%s/%s%s", r.fileBase, id, ext))}, nil
+	}
+
+	if r.clientID == "" {
+		return nil, errors.New("imgur: imgur_client_id is needed for albums and image pages")
+	}
+
+	if kind == "" {
+		var img imgurImage
+		if err := r.get("/3/image/"+id, &img); err != nil {
+			return nil, err
+		}
+		return []File{newFile(img.Link)}, nil
+	}
+
+	var album []imgurImage
+	if err := r.get("/3/album/"+id+"/images", &album); err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(album))
+	for _, img := range album {
+		files = append(files, newFile(img.Link))
+	}
+	return files, nil
+}
+
+// get requests an endpoint of the imgur API, and decodes the data of
+// the response into v.
+func (r *imgurResolver) get(endpoint string, v interface{}) error {
+	req, err := http.NewRequest("GET", r.apiBase+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Client-ID "+r.clientID)
+
+	resp, err := resolverClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("imgur: %s returned %s", endpoint, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(&struct {
+		Data interface{} `json:"data"`
+	}{v})
+}
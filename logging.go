@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var (
+	// logFormat is how log messages are written to stderr: "text",
+	// which is meant for people, or "json" or "logfmt", one message
+	// per line with its fields.
+	logFormat string
+	logLevel  string
+
+	// jsonSummary prints a JSON summary of each session on stdout,
+	// instead of the status meant for people.
+	jsonSummary bool
+
+	// statusOutput is where progress and the status meant for people
+	// are printed. It's stderr when stdout has the JSON summary.
+	statusOutput io.Writer = os.Stdout
+)
+
+func init() {
+	flag.StringVar(&logFormat, "log-format", "text", `How log messages are written: "text", "json" or "logfmt".`)
+	flag.StringVar(&logLevel, "log-level", "info", `The least important log messages that are written: "debug", "info", "warn" or "error".`)
+	flag.BoolVar(&jsonSummary, "json", false, "Print a JSON summary of each download session on stdout.")
+}
+
+// setupLogging sets up the logger from the flags. Messages from the log
+// package go through it too.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return errors.New("invalid log level: " + logLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch logFormat {
+	case "text":
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	case "logfmt":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	default:
+		return errors.New("invalid log format: " + logFormat)
+	}
+
+	if jsonSummary {
+		statusOutput = os.Stderr
+	}
+	return nil
+}
+
+// A sessionSummary is printed with -json when a download session ends.
+// The stats only count this session.
+type sessionSummary struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Interrupted bool      `json:"interrupted"`
+	StatsSnapshot
+	// Errors is what was given up on, and the blogs that couldn't be
+	// added.
+	Errors []failure `json:"errors"`
+}
+
+// newSessionSummary sums up a session from the stats before and after
+// it, and the blogs that were in it.
+func newSessionSummary(run runRecord, before, after StatsSnapshot, userBlogs []*User) sessionSummary {
+	s := sessionSummary{
+		Start:       run.Start,
+		End:         run.End,
+		Interrupted: run.Interrupted,
+		StatsSnapshot: StatsSnapshot{
+			FilesDownloaded: after.FilesDownloaded - before.FilesDownloaded,
+			FilesFound:      after.FilesFound - before.FilesFound,
+			AlreadyExists:   after.AlreadyExists - before.AlreadyExists,
+			Hardlinked:      after.Hardlinked - before.Hardlinked,
+			ResolverMisses:  after.ResolverMisses - before.ResolverMisses,
+			Upgraded:        after.Upgraded - before.Upgraded,
+			Converted:       after.Converted - before.Converted,
+			HookFailures:    after.HookFailures - before.HookFailures,
+			BytesDownloaded: after.BytesDownloaded - before.BytesDownloaded,
+			BytesOverhead:   after.BytesOverhead - before.BytesOverhead,
+			BytesSaved:      after.BytesSaved - before.BytesSaved,
+			Blogs:           []BlogSnapshot{},
+		},
+		Errors: []failure{},
+	}
+	for _, u := range userBlogs {
+		s.Blogs = append(s.Blogs, u.Snapshot())
+	}
+	return s
+}
+
+// writeSummary prints a session summary as a single line of JSON.
+func writeSummary(w io.Writer, s sessionSummary) error {
+	return json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func(format, level string) { logFormat, logLevel = format, level }(logFormat, logLevel)
+
+	tests := []struct {
+		format, level string
+		ok            bool
+	}{
+		{"text", "info", true},
+		{"text", "DEBUG", true},
+		{"text", "loud", false},
+		{"xml", "info", false},
+	}
+
+	for i, test := range tests {
+		logFormat, logLevel = test.format, test.level
+		if err := setupLogging(); (err == nil) != test.ok {
+			t.Errorf("#%d: setupLogging with %s, %s: %v", i, test.format, test.level, err)
+		}
+	}
+	logFormat, logLevel = "text", "info"
+	setupLogging()
+}
+
+func TestSessionSummary(t *testing.T) {
+	before := StatsSnapshot{FilesDownloaded: 10, FilesFound: 20, BytesDownloaded: 1000}
+	after := StatsSnapshot{FilesDownloaded: 13, FilesFound: 25, BytesDownloaded: 1500, Blogs: []BlogSnapshot{{Name: "other"}}}
+	start := time.Unix(100, 0).UTC()
+	run := runRecord{Start: start, End: start.Add(time.Minute), Interrupted: true}
+
+	s := newSessionSummary(run, before, after, []*User{{name: "demo", lastPostID: 7}})
+	if s.FilesDownloaded != 3 || s.FilesFound != 5 || s.BytesDownloaded != 500 || !s.Interrupted {
+		t.Errorf("summary=%+v; want 3 files downloaded, 5 found, 500 bytes, interrupted", s)
+	}
+	if len(s.Blogs) != 1 || s.Blogs[0].Name != "demo" || s.Blogs[0].LastPostID != 7 {
+		t.Errorf("summary blogs=%+v; want only demo", s.Blogs)
+	}
+
+	var out bytes.Buffer
+	if err := writeSummary(&out, s); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("summary isn't a single line: %q", out.String())
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"start", "end", "interrupted", "files_downloaded", "blogs"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("summary doesn't have %q: %s", key, out.String())
+		}
+	}
+}
@@ -2,22 +2,24 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
-	"os/signal"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/cheggaaa/pb"
 )
 
-// VERSION is the current version of the program. It is used for
-// checking if blogs need to be force-updated.
+// VERSION is the current version of the program. It's stored in the
+// database as the version that last ran against it.
 //
 // This can be changed during the build phase like so:
 //     go build -ldflags "-X main.VERSION=1.4.1"
@@ -28,29 +30,9 @@ var (
 )
 
 func init() {
-	loadConfig()
-
-	var numDownloaders int
-	if cfg.NumDownloaders == 0 {
-		numDownloaders = 10
-	} else {
-		numDownloaders = cfg.NumDownloaders
-	}
-
-	var requestRate int
-	if cfg.RequestRate == 0 {
-		requestRate = 4
-	} else {
-		requestRate = cfg.RequestRate
-	}
-
-	var downloadDirectory string
-	if len(cfg.DownloadDirectory) == 0 {
-		downloadDirectory = "."
-	} else {
-		downloadDirectory = cfg.DownloadDirectory
-
-	}
+	// The config is loaded once the flags are parsed, since they say
+	// where it is. Until then, the flags show the defaults.
+	setConfigDefaults(&cfg)
 
 	flag.BoolVar(&cfg.IgnorePhotos, "ignore-photos", cfg.IgnorePhotos, "Ignore any photos found in the selected tumblrs.")
 	flag.BoolVar(&cfg.IgnoreVideos, "ignore-videos", cfg.IgnoreVideos, "Ignore any videos found in the selected tumblrs.")
@@ -58,43 +40,204 @@ func init() {
 	flag.BoolVar(&cfg.UseProgressBar, "p", cfg.UseProgressBar, "Use a progress bar to show download status.")
 	flag.BoolVar(&cfg.ForceCheck, "force", cfg.ForceCheck, "Force checking an entire blog for new files.")
 
-	flag.IntVar(&cfg.NumDownloaders, "d", numDownloaders, "Number of simultaneous downloads allowed.")
-	flag.IntVar(&cfg.RequestRate, "r", requestRate, "Number of requests per second allowed. Do not exceed 15, as tumblr begins throttling at that point.")
-	flag.StringVar(&cfg.DownloadDirectory, "dir", downloadDirectory, "The directory which will store all downloads.")
+	flag.IntVar(&cfg.NumDownloaders, "d", cfg.NumDownloaders, "Number of simultaneous downloads allowed.")
+	flag.IntVar(&cfg.RequestRate, "r", cfg.RequestRate, "Number of requests per second allowed. Do not exceed 15, as tumblr begins throttling at that point.")
+	flag.StringVar(&cfg.DownloadDirectory, "dir", cfg.DownloadDirectory, "The directory which will store all downloads.")
+	flag.StringVar(&cfg.PhotoSize, "photo-size", cfg.PhotoSize, `Size of photos to download: "max", a size in pixels like "500", or a limit like "<=2048".`)
 
 	cfg.version = semver.MustParse(VERSION)
+}
 
-	flag.Parse()
+// userFile is the file that lists the blogs to download. It's set by
+// setupPaths.
+var userFile = "download.txt"
+
+// A userEntry is a line of the user file.
+type userEntry struct {
+	name, tag, schedule string
 }
 
-func readUserFile() ([]*User, error) {
-	path := "download.txt"
-	file, err := os.Open(path)
+func readUserEntries() ([]userEntry, error) {
+	file, err := os.Open(userFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var users []*User
+	var entries []userEntry
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		text := strings.Trim(scanner.Text(), " \n\r\t")
-		split := strings.SplitN(text, " ", 2)
+		name, tag, schedule := parseUserLine(text)
+		if name == "" {
+			continue
+		}
+		entries = append(entries, userEntry{name, tag, schedule})
+	}
+	return entries, scanner.Err()
+}
 
-		b, err := newUser(split[0])
+func readUserFile() ([]*User, error) {
+	entries, err := readUserEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	for _, e := range entries {
+		b, err := newUser(e.name)
 		if err != nil {
-			log.Println(err)
+			checkNewUserError(e.name, err)
 			continue
 		}
 
-		if len(split) > 1 {
-			b.tag = split[1]
-		}
+		b.tag = e.tag
+		b.schedule = e.schedule
 
 		users = append(users, b)
 	}
 	// fmt.Println(blogs)
-	return users, scanner.Err()
+	return users, nil
+}
+
+// parseUserLine splits a line of the user file into the blog name, the
+// tag and the schedule. The schedule starts at the first word that
+// starts with "@".
+func parseUserLine(line string) (name, tag, schedule string) {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return "", "", ""
+	}
+
+	name = words[0]
+	for i, w := range words[1:] {
+		if strings.HasPrefix(w, "@") {
+			schedule = strings.Join(words[i+1:], " ")
+			words = words[:i+1]
+			break
+		}
+	}
+	tag = strings.Join(words[1:], " ")
+	return name, tag, schedule
+}
+
+// formatUserLine is the reverse of parseUserLine.
+func formatUserLine(name, tag, schedule string) string {
+	line := name
+	if tag != "" {
+		line += " " + tag
+	}
+	if schedule != "" {
+		if !strings.HasPrefix(schedule, "@") {
+			schedule = "@every " + schedule
+		}
+		line += " " + schedule
+	}
+	return line
+}
+
+// addBlog verifies a blog and adds it to the list of blogs and to the
+// user file, so it gets downloaded from the next session on.
+func addBlog(name, tag, schedule string) (*User, error) {
+	if schedule != "" {
+		if _, err := parseSchedule(schedule); err != nil {
+			return nil, err
+		}
+	}
+
+	if blogs.Get(name) != nil {
+		return nil, errors.New("addBlog: blog already added: " + name)
+	}
+
+	u, err := newUser(name)
+	if err != nil {
+		return nil, err
+	}
+	u.tag = tag
+	u.schedule = schedule
+	loadUser(u)
+
+	if !blogs.Add(u) {
+		gStats.forget(u)
+		return nil, errors.New("addBlog: blog already added: " + name)
+	}
+
+	line := formatUserLine(name, tag, schedule)
+
+	file, err := os.OpenFile(userFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return u, err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, line)
+	return u, err
+}
+
+// removeBlog removes a blog from the list of blogs, and every line for
+// it from the user file. Files that were already downloaded are kept.
+func removeBlog(name string) error {
+	blogs.Remove(name)
+
+	return editUserFile(name, func(string) string { return "" })
+}
+
+// setBlogTag changes the tag that's downloaded for a blog, in the user
+// file and from the next session on. An empty tag downloads everything.
+func setBlogTag(name, tag string) error {
+	u := blogs.Get(name)
+	if u == nil {
+		return errors.New("setBlogTag: no such blog: " + name)
+	}
+	u.setTag(tag)
+
+	return editUserFile(name, func(line string) string {
+		_, _, schedule := parseUserLine(line)
+		return formatUserLine(name, tag, schedule)
+	})
+}
+
+// setBlogSchedule changes the schedule of a blog, in the user file and
+// in the database. An empty schedule uses the default one.
+func setBlogSchedule(name, schedule string) error {
+	u := blogs.Get(name)
+	if u == nil {
+		return errors.New("setBlogSchedule: no such blog: " + name)
+	}
+	if schedule != "" {
+		if _, err := parseSchedule(schedule); err != nil {
+			return err
+		}
+	}
+	u.setSchedule(schedule)
+
+	return editUserFile(name, func(line string) string {
+		_, tag, _ := parseUserLine(line)
+		return formatUserLine(name, tag, schedule)
+	})
+}
+
+// editUserFile replaces every line of the user file for the given blog
+// with what edit returns for it. Lines are removed if edit returns "".
+func editUserFile(name string, edit func(line string) string) error {
+	contents, err := ioutil.ReadFile(userFile)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		text := strings.Trim(line, " \n\r\t")
+		if n, _, _ := parseUserLine(text); n != "" && n == name {
+			text = edit(text)
+		}
+		if text == "" {
+			continue
+		}
+		lines = append(lines, text)
+	}
+
+	return ioutil.WriteFile(userFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
 }
 
 func getUsersToDownload() []*User {
@@ -109,7 +252,7 @@ func getUsersToDownload() []*User {
 	for _, user := range users {
 		u, err := newUser(user)
 		if err != nil {
-			log.Println(err)
+			checkNewUserError(user, err)
 			continue
 		}
 		userBlogs = append(userBlogs, u)
@@ -119,129 +262,294 @@ func getUsersToDownload() []*User {
 
 	if len(userBlogs) == 0 {
 		fmt.Fprintln(os.Stderr, "No users detected.")
-		os.Exit(1)
+		writeReport(os.Stderr, failures.List())
+		os.Exit(failures.exitCode(nil))
 	}
 
 	return userBlogs
 }
 
+// checkNewUserError logs an error returned by newUser, and adds it to
+// the error report. Blogs that don't exist anymore are kept track of, so
+// they can be reported as terminated.
+func checkNewUserError(name string, err error) {
+	slog.Error("can't add a blog", "blog", name, "err", err)
+	recordInvalidBlog(name, err)
+	if errors.Is(err, errUserNotFound) {
+		vanishedBlogs = append(vanishedBlogs, name)
+	}
+}
+
 func verifyFlags() {
 	if cfg.NumDownloaders < 1 {
-		log.Println("Invalid number of downloaders, setting to default")
+		slog.Warn("invalid number of downloaders, using the default", "num_downloaders", cfg.NumDownloaders, "default", 10)
 		cfg.NumDownloaders = 10
 	}
 
 	if cfg.RequestRate < 1 {
-		log.Println("Invalid request rate, setting to default")
+		slog.Warn("invalid request rate, using the default", "rate", cfg.RequestRate, "default", 4)
 		cfg.RequestRate = 4
 	}
 
 	if cfg.RequestRate > 15 {
-		log.Println("WARNING: Request rate is over 15 per second. Tumblr may throttle/block you from downloading. Continue at your own risk.")
+		slog.Warn("request rate is over 15 per second. Tumblr may throttle or block you from downloading. Continue at your own risk", "rate", cfg.RequestRate)
+	}
+
+	if cfg.ShutdownTimeout.Duration <= 0 {
+		cfg.ShutdownTimeout.Duration = 30 * time.Second
+	}
+
+	if dryRun {
+		// A dry run checks every blog once.
+		cfg.ServerMode = false
+		if planFormat != "text" && planFormat != "json" {
+			slog.Warn("invalid plan format, using text", "plan_format", planFormat)
+			planFormat = "text"
+		}
+	}
+
+	if cfg.ServerSleep.Duration <= 0 {
+		slog.Warn("invalid sleep time, using the default", "sleep_time", cfg.ServerSleep, "default", time.Hour)
+		cfg.ServerSleep.Duration = time.Hour
+	}
+	verifyScheduleConfig(&cfg.Schedule)
+
+	verifyConvertConfig(&cfg.Convert)
+	setupHooks(&cfg.Hooks)
+
+	s, err := parsePhotoSize(cfg.PhotoSize)
+	if err != nil {
+		slog.Warn("invalid photo size, using the default", "photo_size", cfg.PhotoSize, "err", err)
+	} else {
+		photoSizeStrategy = s
 	}
 }
 
 func main() {
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	pBar.Output = statusOutput
+	if err := setupPaths(); err != nil {
+		log.Fatal(err)
+	}
+	loadConfig()
+
+	if flag.Arg(0) == "db" {
+		os.Exit(runDBCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "query" {
+		os.Exit(runQueryCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "search" {
+		os.Exit(runSearchCommand(flag.Args()[1:]))
+	}
+
 	verifyFlags()
+	setupResolvers(cfg.Resolvers)
 
 	walkblock := make(chan struct{})
+	var walkErr error
 	go func() {
-		fmt.Println("Scanning directory")
+		slog.Info("scanning the download directory", "dir", cfg.DownloadDirectory)
 		//filepath.Walk(cfg.DownloadDirectory, DirectoryScanner)
-		GetAllCurrentFiles()
-		fmt.Println("Done scanning.")
+		walkErr = GetAllCurrentFiles()
+		slog.Info("done scanning")
 		close(walkblock)
 	}()
 
-	userBlogs := getUsersToDownload()
-	setupDatabase(userBlogs)
+	blogs.Set(getUsersToDownload())
+	setupDatabase(blogs.List())
 	defer database.Close()
+	setupCatalog()
+	if catalog != nil {
+		defer catalog.Close()
+	}
+	if !dryRun {
+		checkTerminatedBlogs(vanishedBlogs)
+	}
 
 	// Here, we're done parsing flags.
 	setupSignalInfo()
+	// The API can change the blogs and the database, which a dry run
+	// leaves alone.
+	if !dryRun {
+		setupAPI()
+	}
+	if cfg.ServerMode {
+		setupReload()
+	}
 	<-walkblock
-	fileChannels := make([]<-chan File, len(userBlogs)) // FIXME: Seems dirty.
+	if walkErr != nil {
+		slog.Error("can't scan the download directory", "dir", cfg.DownloadDirectory, "err", walkErr)
+		exit(exitFailure)
+	}
 
+	// Outside of server mode, every blog is checked once, whatever
+	// its schedule is. A server picks up the schedules where it left
+	// them.
+	runAll := !cfg.ServerMode
 	for {
+		applyPendingReload()
+		if due := dueBlogs(blogs.List(), time.Now(), runAll); len(due) != 0 {
+			runSession(due)
+		}
 
-		limiter := make(chan time.Time, 10*cfg.RequestRate)
-		ticker := time.NewTicker(time.Second / time.Duration(cfg.RequestRate))
-
-		go func() {
-			for t := range ticker.C {
-				select {
-				case limiter <- t:
-				default:
-				}
-			}
-		}()
+		if !cfg.ServerMode || stopping() {
+			break
+		}
+		cfg.ForceCheck = false
 
-		// Set up the scraping process.
+		wait := cfg.ServerSleep.Duration
+		if next := nextWakeup(blogs.List()); !next.IsZero() {
+			wait = time.Until(next)
+			slog.Info("waiting for the next blog", "due", next.Format("2006-01-02 15:04:05"))
+		}
 
-		for i, user := range userBlogs {
-			fileChan := scrape(user, limiter)
-			fileChannels[i] = fileChan
+		select {
+		case <-time.After(wait):
+		case <-runNow:
+			slog.Info("starting the next session early")
+		case <-stopCtx.Done():
+		}
+		if stopping() {
+			break
 		}
+		runAll = takeRunAll()
+	}
 
-		done := make(chan struct{})
-		defer close(done)
-		mergedFiles := merge(done, fileChannels)
+	if code := exitCode(); code != 0 {
+		exit(code)
+	}
+}
+
+// exit closes the database and the catalog, which deferred calls don't
+// do when the program exits, and exits with code.
+func exit(code int) {
+	database.Close()
+	if catalog != nil {
+		catalog.Close()
+	}
+	os.Exit(code)
+}
 
-		// Set up progress bars.
+// runSession scrapes every user, and downloads everything that was found.
+func runSession(userBlogs []*User) {
+	run := runRecord{Start: time.Now()}
+	before := gStats.Snapshot()
+	limiter := make(chan time.Time, 10*cfg.RequestRate)
+	ticker := time.NewTicker(time.Second / time.Duration(cfg.RequestRate))
+	defer ticker.Stop()
 
-		if cfg.UseProgressBar {
-			pBar.Start()
+	go func() {
+		for t := range ticker.C {
+			select {
+			case limiter <- t:
+			default:
+			}
 		}
+	}()
+
+	// Set up the scraping process.
 
-		// Set up downloaders.
+	fileChannels := make([]<-chan File, len(userBlogs))
+	for i, user := range userBlogs {
+		user.reset()
+		fileChan := scrape(user, limiter)
+		fileChannels[i] = fileChan
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	mergedFiles := merge(done, fileChannels)
+	blogs.setQueue(mergedFiles)
+
+	// Set up progress bars.
+
+	if cfg.UseProgressBar {
+		pBar.Start()
+	}
+
+	// Set up downloaders.
 
-		var downloaderWg sync.WaitGroup
-		downloaderWg.Add(cfg.NumDownloaders)
+	var downloaderWg sync.WaitGroup
+	downloaderWg.Add(cfg.NumDownloaders)
 
-		for i := 0; i < cfg.NumDownloaders; i++ {
-			go func(j int) {
+	for i := 0; i < cfg.NumDownloaders; i++ {
+		go func(j int) {
+			if dryRun {
+				planner(limiter, mergedFiles)
+			} else {
 				downloader(j, limiter, mergedFiles) // mergedFiles will close when scrapers are all done
-				downloaderWg.Done()
-			}(i)
-		}
+			}
+			downloaderWg.Done()
+		}(i)
+	}
 
-		downloaderWg.Wait() // Waits for all downloads to complete.
+	downloaderWg.Wait() // Waits for all downloads to complete.
+	usersDoneWg.Wait()
 
-		if cfg.UseProgressBar {
-			pBar.Finish()
+	if cfg.UseProgressBar {
+		pBar.Finish()
+	}
+	report := failures.endSession(userBlogs)
+
+	if dryRun {
+		if err := writePlan(os.Stdout, planFormat); err != nil {
+			slog.Error("can't write the plan", "err", err)
 		}
+		writeReport(os.Stderr, report)
+		return
+	}
 
-		updateDatabaseVersion()
+	updateDatabaseVersion()
+
+	after := gStats.Snapshot()
+	run.End = time.Now()
+	run.FilesFound = after.FilesFound - before.FilesFound
+	run.FilesDownloaded = after.FilesDownloaded - before.FilesDownloaded
+	run.BytesDownloaded = after.BytesDownloaded - before.BytesDownloaded
+	run.Interrupted = stopping()
+	for _, u := range userBlogs {
+		run.Blogs = append(run.Blogs, u.name)
+		run.Errors += atomic.LoadUint64(&u.errors)
+	}
+	recordRun(run)
 
-		fmt.Println("Downloading complete.")
-		gStats.PrintStatus()
+	runSessionHook()
+	notifySession()
 
-		if !cfg.ServerMode {
-			break
+	slog.Info("downloading complete")
+	if jsonSummary {
+		summary := newSessionSummary(run, before, after, userBlogs)
+		if report != nil {
+			summary.Errors = report
 		}
-
-		fmt.Println("Sleeping for", cfg.ServerSleep)
-		time.Sleep(cfg.ServerSleep)
-		cfg.ForceCheck = false
-		ticker.Stop()
+		if err := writeSummary(os.Stdout, summary); err != nil {
+			slog.Error("can't write the summary", "err", err)
+		}
+	} else {
+		gStats.PrintStatus()
 	}
+	writeReport(statusOutput, report)
 }
 
 func showProgress(s ...interface{}) {
 	if cfg.UseProgressBar {
 		pBar.Update()
 	} else if len(s) > 0 {
-		fmt.Println(s...)
+		fmt.Fprintln(statusOutput, s...)
 	}
 }
 
 func checkError(err error, args ...interface{}) {
 	if err != nil {
+		msg := "error"
 		if len(args) != 0 {
-			log.Println(args, err)
-		} else {
-			log.Println(err)
+			msg = fmt.Sprint(args...)
 		}
+		slog.Error(msg, "err", err)
 	}
 }
 
@@ -254,21 +562,3 @@ func checkFatalError(err error, args ...interface{}) {
 		}
 	}
 }
-
-func setupSignalInfo() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGQUIT)
-	go func() {
-		for {
-			s := <-sigChan
-			switch s {
-			case syscall.SIGINT:
-				database.Close()
-				gStats.PrintStatus()
-				os.Exit(1)
-			case syscall.SIGQUIT:
-				gStats.PrintStatus()
-			}
-		}
-	}()
-}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsPrefix is put in front of the name of every exported metric.
+const metricsPrefix = "tumblr_downloader_"
+
+// requestStats counts HTTP responses and retries for each kind of
+// request: "scrape" for API pages, "download" for files and "probe" for
+// checking photo sizes.
+type requestStats struct {
+	sync.Mutex
+	statuses map[string]map[int]uint64
+	retries  map[string]uint64
+
+	// limiterWait is the total time spent waiting on the rate limiter,
+	// in nanoseconds.
+	limiterWait  uint64
+	limiterWaits uint64
+}
+
+var reqStats = requestStats{
+	statuses: make(map[string]map[int]uint64),
+	retries:  make(map[string]uint64),
+}
+
+// recordStatus counts a response of the given kind of request.
+func (r *requestStats) recordStatus(kind string, code int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.statuses[kind] == nil {
+		r.statuses[kind] = make(map[int]uint64)
+	}
+	r.statuses[kind][code]++
+}
+
+// recordRetry counts a request of the given kind that failed and will
+// be tried again.
+func (r *requestStats) recordRetry(kind string) {
+	r.Lock()
+	r.retries[kind]++
+	r.Unlock()
+}
+
+// waitLimiter waits for the rate limiter, and keeps track of how long
+// that took.
+func waitLimiter(limiter <-chan time.Time) {
+	start := time.Now()
+	<-limiter
+	recordLimiterWait(time.Since(start))
+}
+
+func recordLimiterWait(d time.Duration) {
+	atomic.AddUint64(&reqStats.limiterWait, uint64(d))
+	atomic.AddUint64(&reqStats.limiterWaits, 1)
+}
+
+// metricsHandler serves every metric in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// A metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric.
+func (m metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(m.w, "# TYPE %s%s %s\n", metricsPrefix, name, typ)
+}
+
+// sample writes a single value of a metric. labels are pairs of label
+// names and values.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	var l string
+	if len(labels) != 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		l = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s%s%s %s\n", metricsPrefix, name, l,
+		strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// single writes a metric with a single unlabeled value.
+func (m metricsWriter) single(name, typ, help string, value float64) {
+	m.family(name, typ, help)
+	m.sample(name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func writeMetrics(w io.Writer) {
+	m := metricsWriter{w}
+	s := gStats.Snapshot()
+
+	m.single("files_downloaded_total", "counter", "Files downloaded.", float64(s.FilesDownloaded))
+	m.single("files_found_total", "counter", "Files found while scraping.", float64(s.FilesFound))
+	m.single("files_already_existing_total", "counter", "Files found that were already downloaded.", float64(s.AlreadyExists))
+	m.single("files_hardlinked_total", "counter", "Files hardlinked instead of downloaded.", float64(s.Hardlinked))
+	m.single("resolver_misses_total", "counter", "Linked files that couldn't be found.", float64(s.ResolverMisses))
+	m.single("photos_upgraded_total", "counter", "Photos replaced by a larger version.", float64(s.Upgraded))
+	m.single("images_converted_total", "counter", "Images converted into another format.", float64(s.Converted))
+	m.single("hook_failures_total", "counter", "Hook commands that failed or timed out.", float64(s.HookFailures))
+	m.single("downloaded_bytes_total", "counter", "Bytes of files downloaded.", float64(s.BytesDownloaded))
+	m.single("overhead_bytes_total", "counter", "Bytes of JSON downloaded while scraping.", float64(s.BytesOverhead))
+	m.single("saved_bytes_total", "counter", "Bytes not downloaded thanks to hardlinking.", float64(s.BytesSaved))
+
+	blogMetrics := []struct {
+		name, typ, help string
+		value           func(b BlogSnapshot) float64
+	}{
+		{"blog_active", "gauge", "Whether a blog is being scraped or downloaded.",
+			func(b BlogSnapshot) float64 {
+				if b.Active {
+					return 1
+				}
+				return 0
+			}},
+		// These start over with every session of a blog, so they're
+		// gauges.
+		{"blog_session_files_found", "gauge", "Files found on a blog during its current or last session.",
+			func(b BlogSnapshot) float64 { return float64(b.FilesFound) }},
+		{"blog_session_files_processed", "gauge", "Files of a blog processed during its current or last session.",
+			func(b BlogSnapshot) float64 { return float64(b.FilesProcessed) }},
+		{"blog_session_files_downloaded", "gauge", "Files of a blog downloaded during its current or last session.",
+			func(b BlogSnapshot) float64 { return float64(b.FilesDownloaded) }},
+		{"blog_session_errors", "gauge", "Errors of a blog during its current or last session.",
+			func(b BlogSnapshot) float64 { return float64(b.Errors) }},
+	}
+	for _, bm := range blogMetrics {
+		m.family(bm.name, bm.typ, bm.help)
+		for _, b := range s.Blogs {
+			m.sample(bm.name, bm.value(b), "blog", b.Name)
+		}
+	}
+
+	reqStats.Lock()
+	m.family("http_responses_total", "counter", "HTTP responses by kind of request and status code.")
+	kinds := make([]string, 0, len(reqStats.statuses))
+	for kind := range reqStats.statuses {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		codes := make([]int, 0, len(reqStats.statuses[kind]))
+		for code := range reqStats.statuses[kind] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			m.sample("http_responses_total", float64(reqStats.statuses[kind][code]),
+				"kind", kind, "code", strconv.Itoa(code))
+		}
+	}
+
+	m.family("http_retries_total", "counter", "HTTP requests that failed and were retried, by kind of request.")
+	kinds = kinds[:0]
+	for kind := range reqStats.retries {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		m.sample("http_retries_total", float64(reqStats.retries[kind]), "kind", kind)
+	}
+	reqStats.Unlock()
+
+	wait := time.Duration(atomic.LoadUint64(&reqStats.limiterWait))
+	m.single("limiter_wait_seconds_total", "counter", "Time spent waiting on the rate limiter.", wait.Seconds())
+	m.single("limiter_waits_total", "counter", "Times the rate limiter was waited on.", float64(atomic.LoadUint64(&reqStats.limiterWaits)))
+
+	m.single("queue_depth", "gauge", "Files waiting to be downloaded.", float64(blogs.QueueDepth()))
+}
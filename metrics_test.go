@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEscapeLabel(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"demo", "demo"},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\nb`},
+	}
+
+	for i, test := range tests {
+		if out := escapeLabel(test.in); out != test.out {
+			t.Errorf("#%d: escapeLabel(%s)=%s; want %s", i, test.in, out, test.out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	oldUsers := blogs.List()
+	defer blogs.Set(oldUsers)
+
+	u := &User{name: "demo", filesFound: 7, errors: 2}
+	blogs.Set([]*User{u})
+	gStats.setActive(u, true)
+	defer func() {
+		gStats.nowScraping.Lock()
+		delete(gStats.nowScraping.Blog, u)
+		gStats.nowScraping.Unlock()
+	}()
+
+	reqStats.recordStatus("download", 404)
+	reqStats.recordRetry("scrape")
+
+	w := apiRequest(t, "GET", "/metrics")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics=%d; want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+
+	want := []string{
+		"# TYPE tumblr_downloader_files_downloaded_total counter\n",
+		"# TYPE tumblr_downloader_queue_depth gauge\n",
+		"tumblr_downloader_blog_active{blog=\"demo\"} 1\n",
+		"# TYPE tumblr_downloader_blog_session_files_found gauge\n",
+		"tumblr_downloader_blog_session_files_found{blog=\"demo\"} 7\n",
+		"tumblr_downloader_blog_session_errors{blog=\"demo\"} 2\n",
+		"tumblr_downloader_http_responses_total{kind=\"download\",code=\"404\"} ",
+		"tumblr_downloader_http_retries_total{kind=\"scrape\"} ",
+		"tumblr_downloader_limiter_wait_seconds_total ",
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line) {
+			t.Errorf("GET /metrics is missing %q", line)
+		}
+	}
+}
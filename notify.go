@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// NotifyConfig contains the places notifications are sent to.
+type NotifyConfig struct {
+	// Webhooks are URLs that notifications are POSTed to as JSON.
+	Webhooks []string `toml:"webhooks"`
+	// File is appended with one JSON notification per line.
+	File string `toml:"file"`
+	// Socket is a Unix socket that notifications are written to,
+	// one JSON notification per line.
+	Socket string `toml:"socket"`
+
+	// FailureThreshold is the number of errors in a row a blog can
+	// have before a failure notification is sent. 0 disables them.
+	FailureThreshold int `toml:"failure_threshold"`
+}
+
+// A notification is sent when a blog gets new content, when a download
+// session ends, and when a blog keeps failing.
+type notification struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	Blog  *BlogSnapshot  `json:"blog,omitempty"`
+	Stats *StatsSnapshot `json:"stats,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+var (
+	notifyClient = &http.Client{Timeout: 30 * time.Second}
+	notifyWg     sync.WaitGroup
+
+	// notifyFileLock keeps lines written to the notification file
+	// from being mixed up.
+	notifyFileLock sync.Mutex
+)
+
+func (c NotifyConfig) enabled() bool {
+	return len(c.Webhooks) != 0 || c.File != "" || c.Socket != ""
+}
+
+// notifyBlog sends a notification for a blog that got new content.
+func notifyBlog(u *User) {
+	b := u.Snapshot()
+	sendNotification(notification{Event: "blog", Blog: &b})
+}
+
+// notifyFailure sends a notification for a blog that keeps failing.
+func notifyFailure(u *User, err error) {
+	b := u.Snapshot()
+	sendNotification(notification{Event: "failure", Blog: &b, Error: err.Error()})
+}
+
+// notifySession sends a summary of the download session that just
+// ended, and waits for every notification to be sent.
+func notifySession() {
+	s := gStats.Snapshot()
+	sendNotification(notification{Event: "session", Stats: &s})
+	notifyWg.Wait()
+}
+
+// sendNotification sends n to every configured sink in the background.
+// Sinks that fail are logged and otherwise ignored.
+func sendNotification(n notification) {
+	c := config().Notify
+	if !c.enabled() {
+		return
+	}
+	n.Time = time.Now()
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("can't encode a notification", "event", n.Event, "err", err)
+		return
+	}
+
+	notifyWg.Add(1)
+	go func() {
+		defer notifyWg.Done()
+
+		for _, u := range c.Webhooks {
+			if err := postWebhook(u, data); err != nil {
+				slog.Warn("notification failed", "event", n.Event, "url", u, "err", err)
+			}
+		}
+
+		if c.File != "" {
+			if err := appendNotification(c.File, data); err != nil {
+				slog.Warn("notification failed", "event", n.Event, "path", c.File, "err", err)
+			}
+		}
+
+		if c.Socket != "" {
+			if err := writeSocket(c.Socket, data); err != nil {
+				slog.Warn("notification failed", "event", n.Event, "path", c.Socket, "err", err)
+			}
+		}
+	}()
+}
+
+func postWebhook(u string, data []byte) error {
+	resp, err := notifyClient.Post(u, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return nil
+}
+
+func appendNotification(path string, data []byte) error {
+	notifyFileLock.Lock()
+	defer notifyFileLock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeSocket(path string, data []byte) error {
+	conn, err := net.DialTimeout("unix", path, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
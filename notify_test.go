@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	received := make(chan notification, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		received <- n
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.Notify = NotifyConfig{
+		Webhooks:         []string{ts.URL},
+		File:             path.Join(dir, "notifications.json"),
+		FailureThreshold: 2,
+	}
+
+	u := &User{name: "demo", filesDownloaded: 3}
+	notifyBlog(u)
+
+	u.recordError(errors.New("first"))
+	u.recordSuccess()
+	u.recordError(errors.New("second"))
+	u.recordError(errors.New("third"))
+	u.recordError(errors.New("fourth"))
+
+	notifySession()
+	close(received)
+
+	var events []string
+	for n := range received {
+		events = append(events, n.Event)
+		switch n.Event {
+		case "blog":
+			if n.Blog == nil || n.Blog.Name != "demo" || n.Blog.FilesDownloaded != 3 {
+				t.Errorf("blog notification = %+v; want demo with 3 files", n.Blog)
+			}
+		case "failure":
+			if n.Error != "third" {
+				t.Errorf("failure notification error = %q; want third", n.Error)
+			}
+		case "session":
+			if n.Stats == nil {
+				t.Error("session notification has no stats")
+			}
+		}
+	}
+
+	if len(events) != 3 {
+		t.Errorf("webhook got %v; want blog, failure and session", events)
+	}
+
+	f, err := os.Open(cfg.Notify.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("notification file has %d lines; want 3", lines)
+	}
+
+	// A dry run doesn't notify about failures.
+	dryRun = true
+	defer func() { dryRun = false }()
+	other := &User{name: "other"}
+	other.recordError(errors.New("first"))
+	other.recordError(errors.New("second"))
+	if info, err := os.Stat(cfg.Notify.File); err != nil || info.Size() != size {
+		t.Errorf("notification file changed in a dry run: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path"
+	"regexp"
+)
+
+// appName names the directories the downloader keeps its files in.
+const appName = "tumblr-downloader"
+
+var profileRegex = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+var (
+	// Paths given on the command line.
+	configPath, listPath, dbPath string
+
+	// profileName is the profile in use, if any. Each profile has its
+	// own config, blog list, database and download directory.
+	profileName string
+
+	// profileDataDir is where the profile's database and downloads are
+	// kept. It's empty if no profile is used.
+	profileDataDir string
+)
+
+func init() {
+	flag.StringVar(&configPath, "config", "", "The config file to use.")
+	flag.StringVar(&listPath, "list", "", "The file that lists the blogs to download.")
+	flag.StringVar(&dbPath, "db", "", "The database file to use.")
+	flag.StringVar(&profileName, "profile", "", "A profile with its own config, blog list, database and downloads.")
+}
+
+// xdgDirs returns the directories the config and the data of the
+// downloader go in, following the XDG base directory spec.
+func xdgDirs() (configDir, dataDir string) {
+	home, _ := os.UserHomeDir()
+
+	configDir = os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = path.Join(home, ".config")
+	}
+	dataDir = os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		dataDir = path.Join(home, ".local", "share")
+	}
+	return path.Join(configDir, appName), path.Join(dataDir, appName)
+}
+
+// setupPaths works out where the config, the blog list and the database
+// are. Paths given on the command line are used as they are. Otherwise,
+// files in the current directory are used if they exist, like older
+// versions did, and the XDG directories if they don't.
+//
+// Profiles keep their files in profiles/<name> of the XDG directories.
+// A profile without its own config uses the main one.
+func setupPaths() error {
+	configDir, dataDir := xdgDirs()
+	mainConfig := choosePath(configPath, "config.toml", configDir, true)
+
+	if profileName == "" {
+		configFile = mainConfig
+		userFile = choosePath(listPath, "download.txt", configDir, true)
+		databaseFile = choosePath(dbPath, "tumblr-update.db", dataDir, true)
+		return nil
+	}
+
+	if !profileRegex.MatchString(profileName) {
+		return errors.New("invalid profile name: " + profileName)
+	}
+	configDir = path.Join(configDir, "profiles", profileName)
+	profileDataDir = path.Join(dataDir, "profiles", profileName)
+
+	configFile = choosePath(configPath, "config.toml", configDir, false)
+	if configPath == "" && !fileExists(configFile) {
+		configFile = mainConfig
+	}
+	userFile = choosePath(listPath, "download.txt", configDir, false)
+	databaseFile = choosePath(dbPath, "tumblr-update.db", profileDataDir, false)
+	return nil
+}
+
+// choosePath returns the path given on the command line, or the default
+// one for a file. If legacy is set, a file in the current directory is
+// used if there is one.
+func choosePath(given, name, dir string, legacy bool) string {
+	switch {
+	case given != "":
+		return given
+	case legacy && fileExists(name):
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// profileDirectory resolves a download directory from the config. In a
+// profile, relative directories are inside the profile's data directory,
+// so that profiles sharing a config don't share downloads.
+func profileDirectory(dir string) string {
+	if profileDataDir == "" || path.IsAbs(dir) {
+		return dir
+	}
+	return path.Join(profileDataDir, dir)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// setupPathTest runs a test in an empty directory, with the XDG
+// directories inside it. The returned function restores everything.
+func setupPathTest(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldEnv := []string{os.Getenv("XDG_CONFIG_HOME"), os.Getenv("XDG_DATA_HOME")}
+	os.Setenv("XDG_CONFIG_HOME", path.Join(dir, "config"))
+	os.Setenv("XDG_DATA_HOME", path.Join(dir, "data"))
+
+	oldFiles := []string{configFile, userFile, databaseFile, configPath, listPath, dbPath, profileName, profileDataDir}
+
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+		os.Setenv("XDG_CONFIG_HOME", oldEnv[0])
+		os.Setenv("XDG_DATA_HOME", oldEnv[1])
+		configFile, userFile, databaseFile = oldFiles[0], oldFiles[1], oldFiles[2]
+		configPath, listPath, dbPath = oldFiles[3], oldFiles[4], oldFiles[5]
+		profileName, profileDataDir = oldFiles[6], oldFiles[7]
+	}
+}
+
+func TestSetupPaths(t *testing.T) {
+	dir, cleanup := setupPathTest(t)
+	defer cleanup()
+
+	config := path.Join(dir, "config", appName)
+	data := path.Join(dir, "data", appName)
+
+	tests := []struct {
+		name                  string
+		files                 []string
+		configPath, profile   string
+		config, list, db, dir string
+	}{
+		{"xdg", nil, "", "",
+			config + "/config.toml", config + "/download.txt", data + "/tumblr-update.db", "downloads"},
+		{"legacy", []string{"config.toml", "download.txt"}, "", "",
+			"config.toml", "download.txt", data + "/tumblr-update.db", "downloads"},
+		{"flags", []string{"config.toml"}, "other.toml", "",
+			"other.toml", config + "/download.txt", data + "/tumblr-update.db", "downloads"},
+		{"profile", []string{config + "/config.toml"}, "", "art",
+			config + "/config.toml", config + "/profiles/art/download.txt",
+			data + "/profiles/art/tumblr-update.db", data + "/profiles/art/downloads"},
+		{"profile with legacy config", []string{"config.toml"}, "", "art",
+			"config.toml", config + "/profiles/art/download.txt",
+			data + "/profiles/art/tumblr-update.db", data + "/profiles/art/downloads"},
+		{"profile config", []string{config + "/profiles/art/config.toml"}, "", "art",
+			config + "/profiles/art/config.toml", config + "/profiles/art/download.txt",
+			data + "/profiles/art/tumblr-update.db", data + "/profiles/art/downloads"},
+	}
+
+	for i, test := range tests {
+		os.RemoveAll(path.Join(dir, "config"))
+		os.Remove("config.toml")
+		os.Remove("download.txt")
+		for _, f := range test.files {
+			os.MkdirAll(path.Dir(f), 0755)
+			if err := ioutil.WriteFile(f, []byte(`directory = "downloads"`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		configPath, profileName, profileDataDir = test.configPath, test.profile, ""
+		if err := setupPaths(); err != nil {
+			t.Errorf("#%d: %s: setupPaths: %v", i, test.name, err)
+			continue
+		}
+		if configFile != test.config || userFile != test.list || databaseFile != test.db {
+			t.Errorf("#%d: %s: paths %s, %s, %s; want %s, %s, %s", i, test.name,
+				configFile, userFile, databaseFile, test.config, test.list, test.db)
+		}
+
+		if test.configPath != "" {
+			// The config given on the command line doesn't exist.
+			if _, err := readConfig(); err == nil {
+				t.Errorf("#%d: %s: reading a missing config given on the command line succeeded", i, test.name)
+			}
+			continue
+		}
+		c, err := readConfig()
+		if err != nil {
+			t.Errorf("#%d: %s: readConfig: %v", i, test.name, err)
+		} else if len(test.files) == 0 && c.DownloadDirectory != "." {
+			t.Errorf("#%d: %s: directory without a config=%s; want .", i, test.name, c.DownloadDirectory)
+		} else if len(test.files) != 0 && c.DownloadDirectory != test.dir {
+			t.Errorf("#%d: %s: directory=%s; want %s", i, test.name, c.DownloadDirectory, test.dir)
+		}
+	}
+
+	profileName = "../escape"
+	if err := setupPaths(); err == nil {
+		t.Error("setupPaths accepted an invalid profile name")
+	}
+}
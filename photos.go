@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A photoStrategy decides which size of a photo gets downloaded.
+type photoStrategy struct {
+	// max is the largest size allowed, in pixels. 0 means no limit.
+	max int
+	// probe enables looking for sizes that the API doesn't list.
+	probe bool
+}
+
+// defaultPhotoSize is the photo size used when none is configured.
+const defaultPhotoSize = "1280"
+
+var photoSizeStrategy = photoStrategy{max: 1280}
+
+// A photoRewrite turns the URL of a 1280px photo into the URL of a
+// larger version that tumblr doesn't list in the API.
+type photoRewrite struct {
+	px   int // 0 for the original upload, which has no fixed size.
+	from *regexp.Regexp
+	to   string
+}
+
+// photoRewrites are ordered from largest to smallest.
+var photoRewrites = []photoRewrite{
+	{0, regexp.MustCompile(`^https?://\d+\.media\.tumblr\.com/(\w+)/(tumblr_\w+)_1280\.(\w+)$`), "https://data.tumblr.com/${1}/${2}_raw.${3}"},
+	{2048, regexp.MustCompile(`/s1280x1920/`), "/s2048x3072/"},
+	{2048, regexp.MustCompile(`_1280\.(\w+)$`), "_2048.${1}"},
+}
+
+// parsePhotoSize reads a photo size strategy. Valid values are "max",
+// a fixed size like "500", or a limit like "<=2048".
+func parsePhotoSize(s string) (photoStrategy, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == defaultPhotoSize:
+		return photoStrategy{max: 1280}, nil
+	case s == "max":
+		return photoStrategy{probe: true}, nil
+	case strings.HasPrefix(s, "<="):
+		px, err := strconv.Atoi(strings.TrimSpace(s[2:]))
+		if err != nil || px < 1 {
+			return photoStrategy{}, errors.New("invalid photo size limit: " + s)
+		}
+		return photoStrategy{max: px, probe: px > 1280}, nil
+	}
+
+	px, err := strconv.Atoi(s)
+	if err != nil || px < 1 {
+		return photoStrategy{}, errors.New("invalid photo size: " + s)
+	}
+	return photoStrategy{max: px}, nil
+}
+
+func (s photoStrategy) allows(px int) bool {
+	if s.max == 0 {
+		return true
+	}
+	return px != 0 && px <= s.max
+}
+
+// choosePhoto returns the File for the largest size of a photo that
+// the strategy allows. If the strategy probes for larger sizes, their
+// URLs are stored in the File's variants, to be checked before it's
+// downloaded.
+func choosePhoto(p Post, s photoStrategy) File {
+	sizes := []struct {
+		px  int
+		url string
+	}{
+		{1280, p.PhotoURL},
+		{500, p.PhotoURL500},
+		{400, p.PhotoURL400},
+		{250, p.PhotoURL250},
+		{100, p.PhotoURL100},
+		{75, p.PhotoURL75},
+	}
+
+	var chosen string
+	for _, size := range sizes {
+		if size.url == "" {
+			continue
+		}
+		chosen = size.url
+		if s.allows(size.px) {
+			break
+		}
+	}
+	if chosen == "" {
+		chosen = p.PhotoURL
+	}
+
+	f := newFile(chosen)
+	if s.probe && chosen == p.PhotoURL {
+		for _, r := range photoRewrites {
+			if !s.allows(r.px) || !r.from.MatchString(chosen) {
+				continue
+			}
+			f.variants = append(f.variants, r.from.ReplaceAllString(chosen, r.to))
+		}
+	}
+	return f
+}
+
+// probeClient is used to check files without downloading them, so a
+// server that stalls can't hold up a downloader.
+var probeClient = &http.Client{Timeout: 30 * time.Second}
+
+// probeSize checks if a URL exists with a HEAD request, and returns
+// the size of the file behind it. The size is -1 if the server doesn't
+// say. err is set if the server couldn't be asked.
+func probeSize(u string) (size int64, ok bool, err error) {
+	resp, err := probeClient.Head(u)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+	reqStats.recordStatus("probe", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return 0, false, nil
+	}
+	if resp.ContentLength < 0 {
+		return -1, true, nil
+	}
+	return resp.ContentLength, true, nil
+}
+
+// hasPhotoVariant reports if a larger version of a photo than the one
+// in f is already downloaded.
+func hasPhotoVariant(f File) bool {
+	// The variants were probed before, and the largest one was kept.
+	if name, ok := largestVariant(f.User.name, f.Filename); ok {
+		if _, err := os.Stat(path.Join(cfg.DownloadDirectory, f.User.name, name)); err == nil {
+			return true
+		}
+	}
+
+	for _, v := range f.variants {
+		name := path.Base(v)
+		if name == f.Filename {
+			continue
+		}
+		if _, err := os.Stat(path.Join(cfg.DownloadDirectory, f.User.name, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadPhoto checks every variant of a photo, and downloads the
+// largest one that exists. Smaller copies of the photo that were
+// downloaded before are replaced by it, once it's on disk.
+func downloadPhoto(f File, limiter <-chan time.Time) {
+	u := f.User
+	best, _, smaller, have := largestPhoto(f, limiter)
+	if have {
+		u.skipFile(f, "largest version already downloaded")
+		return
+	}
+
+	if stopping() {
+		best.discard()
+		return
+	}
+
+	if len(smaller) == 0 {
+		if u.checkFile(best) {
+			return
+		}
+	} else {
+		// The larger version replaces a copy on disk, so it's
+		// downloaded either way, but other blogs can still link it.
+		FileTracker.Add(best.Filename, path.Join(cfg.DownloadDirectory, u.name, best.Filename))
+	}
+
+	waitLimiter(limiter)
+	showProgress(best)
+	saved := best.Download()
+	if saved == "" {
+		return
+	}
+
+	for _, p := range smaller {
+		if path.Base(p) == best.Filename || p == saved {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			slog.Warn("can't remove a smaller copy of a photo", "path", p, "err", err)
+			continue
+		}
+		slog.Info("replaced a photo with a larger version", best.logFields("path", p, "with", best.Filename)...)
+	}
+	if len(smaller) != 0 {
+		atomic.AddUint64(&gStats.upgraded, 1)
+	}
+}
+
+// largestPhoto finds the largest variant of a photo that exists, and the
+// copies of the photo that are already on disk. have is true if the
+// largest one is among them. bestSize is -1 if no variant was found, or
+// if the size of the one found isn't known. Variants of unknown size
+// are only used if no size is known.
+func largestPhoto(f File, limiter <-chan time.Time) (best File, bestSize int64, smaller []string, have bool) {
+	u := f.User
+	best = f
+	bestSize = -1
+	found, answered := false, true
+
+	for _, v := range f.variants {
+		waitLimiter(limiter)
+		size, ok, err := probeSize(v)
+		if err != nil {
+			answered = false
+		}
+		if ok && (size > bestSize || !found) {
+			best.URL, best.Filename = v, path.Base(v)
+			bestSize = size
+			found = true
+		}
+	}
+	// Without an answer for every variant, the largest one may not be
+	// known yet.
+	if answered && !dryRun {
+		recordLargest(u.name, f.Filename, best.Filename)
+	}
+	best.variants = nil
+
+	// Find every smaller copy that's already on disk.
+	for _, name := range append([]string{f.Filename}, variantNames(f)...) {
+		p := path.Join(cfg.DownloadDirectory, u.name, name)
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if name == best.Filename && (bestSize < 0 || info.Size() >= bestSize) {
+			// The best version is already here.
+			return best, bestSize, nil, true
+		}
+		smaller = append(smaller, p)
+	}
+	return best, bestSize, smaller, false
+}
+
+func variantNames(f File) []string {
+	names := make([]string, 0, len(f.variants))
+	for _, v := range f.variants {
+		names = append(names, path.Base(v))
+	}
+	return names
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/burntsushi/toml"
+)
+
+func TestParsePhotoSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		s      string
+		result photoStrategy
+		err    bool
+	}{
+		{"", photoStrategy{max: 1280}, false},
+		{"max", photoStrategy{probe: true}, false},
+		{"500", photoStrategy{max: 500}, false},
+		{"<=2048", photoStrategy{max: 2048, probe: true}, false},
+		{"<= 400", photoStrategy{max: 400}, false},
+		{"big", photoStrategy{}, true},
+		{"<=0", photoStrategy{}, true},
+	}
+
+	for i, test := range tests {
+		result, err := parsePhotoSize(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("#%d: parsePhotoSize(%q) error = %v; want error %t", i, test.s, err, test.err)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("#%d: parsePhotoSize(%q)=%+v; want %+v", i, test.s, result, test.result)
+		}
+	}
+}
+
+func TestDefaultPhotoSize(t *testing.T) {
+	t.Parallel()
+	var c Config
+	if _, err := toml.DecodeFile("config.toml", &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.PhotoSize != defaultPhotoSize {
+		t.Errorf("config.toml photo_size=%q; want %q", c.PhotoSize, defaultPhotoSize)
+	}
+	s, err := parsePhotoSize(defaultPhotoSize)
+	if err != nil || s != photoSizeStrategy {
+		t.Errorf("parsePhotoSize(%q)=%+v, %v; want %+v", defaultPhotoSize, s, err, photoSizeStrategy)
+	}
+}
+
+func TestChoosePhoto(t *testing.T) {
+	t.Parallel()
+	oldStyle := Post{
+		PhotoURL:    "http://41.media.tumblr.com/0123abcd/tumblr_abc123_1280.jpg",
+		PhotoURL500: "http://41.media.tumblr.com/0123abcd/tumblr_abc123_500.jpg",
+		PhotoURL75:  "http://41.media.tumblr.com/0123abcd/tumblr_abc123_75sq.jpg",
+	}
+	newStyle := Post{
+		PhotoURL:    "https://64.media.tumblr.com/aaa/bbb/s1280x1920/ccc.png",
+		PhotoURL500: "https://64.media.tumblr.com/aaa/bbb/s500x750/ccc.png",
+	}
+
+	tests := []struct {
+		post     Post
+		size     string
+		url      string
+		variants []string
+	}{
+		{oldStyle, "1280", oldStyle.PhotoURL, nil},
+		{oldStyle, "500", oldStyle.PhotoURL500, nil},
+		{oldStyle, "<=499", oldStyle.PhotoURL75, nil},
+		{oldStyle, "10", oldStyle.PhotoURL75, nil},
+		{oldStyle, "max", oldStyle.PhotoURL, []string{
+			"https://data.tumblr.com/0123abcd/tumblr_abc123_raw.jpg",
+			"http://41.media.tumblr.com/0123abcd/tumblr_abc123_2048.jpg",
+		}},
+		{oldStyle, "<=2048", oldStyle.PhotoURL, []string{
+			"http://41.media.tumblr.com/0123abcd/tumblr_abc123_2048.jpg",
+		}},
+		{newStyle, "max", newStyle.PhotoURL, []string{
+			"https://64.media.tumblr.com/aaa/bbb/s2048x3072/ccc.png",
+		}},
+	}
+
+	for i, test := range tests {
+		s, err := parsePhotoSize(test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := choosePhoto(test.post, s)
+		if f.URL != test.url {
+			t.Errorf("#%d: choosePhoto(%s).URL=%s; want %s", i, test.size, f.URL, test.url)
+		}
+		if len(f.variants) != len(test.variants) {
+			t.Errorf("#%d: choosePhoto(%s).variants=%v; want %v", i, test.size, f.variants, test.variants)
+			continue
+		}
+		for j := range f.variants {
+			if f.variants[j] != test.variants[j] {
+				t.Errorf("#%d: choosePhoto(%s).variants[%d]=%s; want %s", i, test.size, j, f.variants[j], test.variants[j])
+			}
+		}
+	}
+}
+
+func TestLargestPhoto(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := cfg.DownloadDirectory
+	cfg.DownloadDirectory = dir
+	defer func() { cfg.DownloadDirectory = oldDir }()
+
+	probes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		switch path.Base(r.URL.Path) {
+		case "a_2048.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("Content-Length", "2048")
+		case "a_raw.jpg":
+			// The size isn't known.
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.WriteHeader(http.StatusOK)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}))
+	defer ts.Close()
+
+	u := &User{name: "demo"}
+	f := File{User: u, URL: ts.URL + "/a_1280.jpg", Filename: "a_1280.jpg",
+		variants: []string{ts.URL + "/a_raw.jpg", ts.URL + "/a_2048.jpg", ts.URL + "/a_4096.jpg"}}
+
+	limiter := make(chan time.Time)
+	close(limiter)
+	best, size, smaller, have := largestPhoto(f, limiter)
+	if best.Filename != "a_2048.jpg" || size != 2048 || len(smaller) != 0 || have {
+		t.Errorf("largestPhoto=%s, %d, %v, %t; want a_2048.jpg, 2048", best.Filename, size, smaller, have)
+	}
+
+	// Once the largest version is downloaded, it's known without
+	// probing again.
+	if hasPhotoVariant(f) {
+		t.Error("hasPhotoVariant=true before the photo was downloaded")
+	}
+	os.MkdirAll(path.Join(dir, "demo"), 0755)
+	ioutil.WriteFile(path.Join(dir, "demo", "a_2048.jpg"), nil, 0644)
+	f.variants = nil
+	probes = 0
+	if !hasPhotoVariant(f) || probes != 0 {
+		t.Errorf("hasPhotoVariant=false after the largest version was downloaded, with %d probes", probes)
+	}
+}
+
+func TestDownloadPhotoUpgradeFails(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := cfg.DownloadDirectory
+	cfg.DownloadDirectory = dir
+	defer func() { cfg.DownloadDirectory = oldDir }()
+
+	// The larger version is there when it's probed, but can't be
+	// downloaded.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) != "b_2048.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", "2048")
+		if r.Method != "HEAD" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	smaller := path.Join(dir, "demo", "b_1280.jpg")
+	os.MkdirAll(path.Dir(smaller), 0755)
+	ioutil.WriteFile(smaller, []byte("photo"), 0644)
+
+	u := &User{name: "demo"}
+	f := File{User: u, URL: ts.URL + "/b_1280.jpg", Filename: "b_1280.jpg",
+		variants: []string{ts.URL + "/b_2048.jpg"}}
+	limiter := make(chan time.Time)
+	close(limiter)
+	upgraded := gStats.upgraded
+	u.downloadWg.Add(1)
+	downloadPhoto(f, limiter)
+	failures.endSession(nil)
+
+	if _, err := os.Stat(smaller); err != nil {
+		t.Errorf("smaller copy removed after the larger one failed: %v", err)
+	}
+	if gStats.upgraded != upgraded {
+		t.Error("a failed upgrade was counted")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+)
+
+// quarantineDirName is the folder inside the download directory where
+// responses from tumblr that couldn't be parsed are kept, in a folder
+// for each blog.
+const quarantineDirName = "_quarantine"
+
+// quarantine saves a response that couldn't be parsed, and returns
+// where it was saved. The same name is overwritten, so a page that
+// keeps failing only has its last response kept. Nothing is saved in a
+// dry run.
+func quarantine(blog, name string, contents []byte) string {
+	if dryRun {
+		return ""
+	}
+	dir := path.Join(cfg.DownloadDirectory, quarantineDirName, blog)
+	p := path.Join(dir, name+".json")
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(p, contents, 0644)
+	}
+	if err != nil {
+		slog.Warn("can't quarantine a response", "blog", blog, "path", p, "err", err)
+		return ""
+	}
+	return p
+}
+
+// quarantinePosts saves the posts of a page that couldn't be decoded.
+// Posts with an ID are kept as unfinished, so they're tried again in the
+// next session. page is empty for posts that were asked for one at a
+// time, and offset is -1.
+func quarantinePosts(u *User, bad []badPost, page string, offset int) {
+	for i, b := range bad {
+		name := fmt.Sprint("post-", b.ID)
+		if b.ID == 0 {
+			name = fmt.Sprint("post-unknown-", i+1)
+		}
+		if page != "" {
+			name = page + "-" + name
+		}
+
+		saved := quarantine(u.name, name, b.Raw)
+		slog.Error("can't parse a post", "blog", u.name, "post_id", b.ID, "saved", saved, "err", b.Err)
+		u.recordError(b.Err)
+
+		var postURL string
+		if b.ID != 0 {
+			postURL = tumblrPostURL(u, b.ID).String()
+			u.progress.add(b.ID, offset, 0)
+			u.progress.fail(b.ID)
+		}
+		failures.add(failure{Blog: u.name, Cause: causeParse, URL: postURL, Error: b.Err.Error(), Saved: saved})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const queryUsage = `Usage: tumblr-downloader query [flags]
+
+Lists files in the catalog. The catalog has to be enabled in the config.
+
+Flags:
+`
+
+// dateLayouts are the formats -since and -until accept, from the most
+// precise.
+var dateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// parseDate parses a date given to -since or -until. A date without a
+// day or a month stands for its first day.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q: use YYYY-MM-DD, YYYY-MM or YYYY", s)
+}
+
+// runQueryCommand runs the query subcommand, and returns the exit code.
+func runQueryCommand(args []string) int {
+	var q catalogQuery
+	var since, until, format string
+
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, queryUsage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&q.Blog, "blog", "", "Only files from this blog.")
+	flags.StringVar(&q.Tag, "tag", "", "Only files from posts with this tag.")
+	flags.StringVar(&q.Type, "type", "", "Only files from posts of this type, like photo or video.")
+	flags.Int64Var(&q.Post, "post", 0, "Only files from this post.")
+	flags.StringVar(&q.Text, "text", "", "Only files whose caption or tags match this full-text search.")
+	flags.StringVar(&since, "since", "", "Only files posted on or after this date.")
+	flags.StringVar(&until, "until", "", "Only files posted before this date.")
+	flags.StringVar(&format, "format", "table", "Output format: table, json or csv.")
+	flags.IntVar(&q.Limit, "limit", 0, "The most files to list. 0 lists all of them.")
+	flags.Parse(args)
+
+	var err error
+	if since != "" {
+		if q.Since, err = parseDate(since); err != nil {
+			fmt.Fprintln(os.Stderr, "query:", err)
+			return 2
+		}
+	}
+	if until != "" {
+		if q.Until, err = parseDate(until); err != nil {
+			fmt.Fprintln(os.Stderr, "query:", err)
+			return 2
+		}
+	}
+
+	write, ok := queryFormats[format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "query: unknown format %q\n", format)
+		return 2
+	}
+
+	if !cfg.Catalog.Enabled && !fileExists(catalogPath()) {
+		fmt.Fprintln(os.Stderr, "query: the catalog isn't enabled in", configFile)
+		return 1
+	}
+	db, err := openCatalog(catalogPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "query:", err)
+		return 1
+	}
+	defer db.Close()
+
+	entries, err := queryCatalog(db, q)
+	if err == nil {
+		err = write(os.Stdout, entries)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "query:", err)
+		return 1
+	}
+	return 0
+}
+
+// queryFormats write query results in each output format.
+var queryFormats = map[string]func(io.Writer, []catalogEntry) error{
+	"table": writeQueryTable,
+	"json":  writeQueryJSON,
+	"csv":   writeQueryCSV,
+}
+
+func writeQueryTable(w io.Writer, entries []catalogEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BLOG\tPOST\tPOSTED\tTYPE\tSIZE\tPATH")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", e.Blog, e.PostID, e.Posted.Local().Format("2006-01-02"),
+			e.Type, byteSize(uint64(e.Size)), e.Path)
+	}
+	return tw.Flush()
+}
+
+func writeQueryJSON(w io.Writer, entries []catalogEntry) error {
+	if entries == nil {
+		entries = []catalogEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func writeQueryCSV(w io.Writer, entries []catalogEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"blog", "post_id", "type", "tags", "caption", "name", "url", "path", "size", "sha256", "posted", "downloaded"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Blog, strconv.FormatInt(e.PostID, 10), e.Type, strings.Join(e.Tags, ", "), e.Caption,
+			e.Name, e.URL, e.Path, strconv.FormatInt(e.Size, 10), e.Hash,
+			e.Posted.Format(time.RFC3339), e.Downloaded.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+var redgifsSearch = regexp.MustCompile(`https?:\/\/(?:www\.|v3\.)?redgifs\.com\/(?:watch|ifr)\/(\w+)`)
+
+func init() {
+	registerResolver("redgifs", func(ResolverConfig) Resolver {
+		return &redgifsResolver{apiBase: "https://api.redgifs.com"}
+	})
+}
+
+// redgifsResolver finds videos linked from redgifs, gfycat's successor.
+type redgifsResolver struct {
+	apiBase string
+
+	// The API needs a temporary token, which is reused until it's
+	// turned down. Resolvers run from several downloaders, so it's
+	// guarded by the mutex.
+	sync.Mutex
+	token string
+}
+
+// errRedgifsAuth is returned by get when the token is turned down.
+var errRedgifsAuth = errors.New("redgifs: token turned down")
+
+func (*redgifsResolver) Name() string { return "redgifs" }
+
+func (*redgifsResolver) Match(s string) []string {
+	if cfg.IgnoreVideos {
+		return nil
+	}
+
+	var ids []string
+	for _, m := range redgifsSearch.FindAllStringSubmatch(s, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func (r *redgifsResolver) Resolve(id string) ([]File, error) {
+	token, err := r.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var gif struct {
+		Gif struct {
+			URLs struct {
+				HD string `json:"hd"`
+				SD string `json:"sd"`
+			} `json:"urls"`
+		} `json:"gif"`
+	}
+	err = r.get("/v2/gifs/"+id, token, &gif)
+	if errors.Is(err, errRedgifsAuth) {
+		// The token expired. A new one is fetched once.
+		r.dropToken(token)
+		if token, err = r.getToken(); err != nil {
+			return nil, err
+		}
+		err = r.get("/v2/gifs/"+id, token, &gif)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u := gif.Gif.URLs.HD
+	if u == "" {
+		u = gif.Gif.URLs.SD
+	}
+	if u == "" {
+		return nil, errors.New("redgifs: no video found for " + id)
+	}
+	return []File{newFile(u)}, nil
+}
+
+func (r *redgifsResolver) getToken() (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.token != "" {
+		return r.token, nil
+	}
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := r.get("/v2/auth/temporary", "", &auth); err != nil {
+		return "", err
+	}
+
+	r.token = auth.Token
+	return r.token, nil
+}
+
+// dropToken forgets a token that was turned down, unless another
+// downloader already replaced it.
+func (r *redgifsResolver) dropToken(token string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.token == token {
+		r.token = ""
+	}
+}
+
+func (r *redgifsResolver) get(endpoint, token string, v interface{}) error {
+	req, err := http.NewRequest("GET", r.apiBase+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := resolverClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if token != "" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("%w: %s returned %s", errRedgifsAuth, endpoint, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("redgifs: %s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
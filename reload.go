@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// watchInterval is how often the config and user files are checked for
+// changes in server mode.
+const watchInterval = 5 * time.Second
+
+var (
+	// reloadRequests asks for the config and the blog list to be
+	// reloaded.
+	reloadRequests = make(chan struct{}, 1)
+
+	// configReloadPending is set when a new config is waiting to be
+	// applied at the end of the current session.
+	configReloadPending int32
+)
+
+// requestReload asks for the config and the blog list to be reloaded.
+func requestReload() {
+	select {
+	case reloadRequests <- struct{}{}:
+	default:
+		// A reload is already pending.
+	}
+}
+
+// setupReload reloads the config and the blog list on request, and
+// when their files change. The blog list is reloaded right away, but
+// the config is only applied between sessions, so that nothing that's
+// running sees it change.
+func setupReload() {
+	go func() {
+		for range reloadRequests {
+			reloadBlogs()
+			atomic.StoreInt32(&configReloadPending, 1)
+			wakeUp()
+		}
+	}()
+
+	go watchFiles(watchInterval, configFile, userFile)
+}
+
+// applyPendingReload reloads the config if that was asked for. It must
+// only be called between sessions.
+func applyPendingReload() {
+	if atomic.SwapInt32(&configReloadPending, 0) == 1 {
+		reloadConfig()
+	}
+}
+
+// watchFiles requests a reload whenever one of the files is modified.
+func watchFiles(interval time.Duration, files ...string) {
+	modTimes := make([]time.Time, len(files))
+	for i, f := range files {
+		modTimes[i] = modTime(f)
+	}
+
+	for range time.Tick(interval) {
+		changed := false
+		for i, f := range files {
+			if t := modTime(f); !t.Equal(modTimes[i]) {
+				modTimes[i] = t
+				changed = true
+			}
+		}
+		if changed {
+			requestReload()
+		}
+	}
+}
+
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig reads the config file again, and applies it. Options
+// given on the command line are kept.
+func reloadConfig() {
+	newCfg, err := readConfig()
+	if err != nil {
+		slog.Warn("can't reload the config, keeping the current one", "path", configFile, "err", err)
+		return
+	}
+
+	flags := commandLineFlags()
+
+	cfgLock.Lock()
+	old := cfg
+	cfg = newCfg
+	for name, value := range flags {
+		flag.Set(name, value)
+	}
+	cfg.version = old.version
+	cfg.ForceCheck = old.ForceCheck
+
+	verifyFlags()
+	cfgLock.Unlock()
+	setupResolvers(cfg.Resolvers)
+
+	changes := configDiff("", reflect.ValueOf(old), reflect.ValueOf(cfg))
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		slog.Info("config changed", "change", c)
+	}
+
+	if old.DownloadDirectory != cfg.DownloadDirectory {
+		if err := GetAllCurrentFiles(); err != nil {
+			slog.Error("can't scan the download directory", "dir", cfg.DownloadDirectory, "err", err)
+		}
+	}
+	if old.API != cfg.API {
+		slog.Warn("changes to [api] only apply after a restart")
+	}
+}
+
+// configDiff lists the config options that differ between a and b, by
+// the names they have in the config file.
+func configDiff(prefix string, a, b reflect.Value) []string {
+	var changes []string
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		name = prefix + name
+
+		va, vb := a.Field(i), b.Field(i)
+		if reflect.DeepEqual(va.Interface(), vb.Interface()) {
+			continue
+		}
+
+		if _, ok := va.Interface().(fmt.Stringer); !ok && va.Kind() == reflect.Struct {
+			changes = append(changes, configDiff(name+".", va, vb)...)
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, va.Interface(), vb.Interface()))
+	}
+	return changes
+}
+
+// reloadBlogs reads the user file again. New blogs are added, blogs
+// that aren't in it anymore are removed, and changed tags and schedules
+// are applied. Blogs given on the command line are always kept.
+func reloadBlogs() {
+	entries, err := readUserEntries()
+	if err != nil {
+		slog.Warn("can't reload the blog list, keeping the current blogs", "path", userFile, "err", err)
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, name := range flag.Args() {
+		keep[name] = true
+	}
+
+	for _, e := range entries {
+		keep[e.name] = true
+
+		u := blogs.Get(e.name)
+		if u == nil {
+			u, err = newUser(e.name)
+			if err != nil {
+				checkNewUserError(e.name, err)
+				continue
+			}
+			u.tag, u.schedule = e.tag, e.schedule
+			loadUser(u)
+			if blogs.Add(u) {
+				slog.Info("blog added", "blog", e.name, "tag", e.tag, "schedule", e.schedule)
+			}
+			continue
+		}
+
+		tag, schedule := u.settings()
+		if tag != e.tag {
+			u.setTag(e.tag)
+			slog.Info("blog tag changed", "blog", e.name, "from", tag, "to", e.tag)
+		}
+		if schedule != e.schedule {
+			u.setSchedule(e.schedule)
+			slog.Info("blog schedule changed", "blog", e.name, "from", schedule, "to", e.schedule)
+		}
+	}
+
+	for _, u := range blogs.List() {
+		if !keep[u.name] {
+			blogs.Remove(u.name)
+			slog.Info("blog removed", "blog", u.name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := Config{RequestRate: 4, DownloadDirectory: "downloads"}
+	a.ServerSleep.Duration = time.Minute
+	a.Convert.Formats = map[string]string{"webp": "png"}
+
+	b := a
+	b.RequestRate = 8
+	b.ServerSleep.Duration = time.Hour
+	b.Convert.Formats = map[string]string{"webp": "jpeg"}
+	b.Hooks.File = []string{"echo"}
+
+	want := []string{
+		"rate: 4 -> 8",
+		"sleep_time: 1m0s -> 1h0m0s",
+		"convert.formats: map[webp:png] -> map[webp:jpeg]",
+		"hooks.file: [] -> [echo]",
+	}
+
+	changes := configDiff("", reflect.ValueOf(a), reflect.ValueOf(b))
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("configDiff=%q; want %q", changes, want)
+	}
+
+	if changes := configDiff("", reflect.ValueOf(a), reflect.ValueOf(a)); len(changes) != 0 {
+		t.Errorf("configDiff of the same config=%q; want nothing", changes)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg, oldConfigFile, oldResolvers := cfg, configFile, activeResolvers
+	defer func() { cfg, configFile, activeResolvers = oldCfg, oldConfigFile, oldResolvers }()
+
+	configFile = path.Join(dir, "config.toml")
+	err = ioutil.WriteFile(configFile, []byte(`
+rate = 6
+num_downloaders = 3
+directory = "."
+sleep_time = "2h"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.DownloadDirectory = "."
+	reloadConfig()
+
+	if cfg.RequestRate != 6 || cfg.NumDownloaders != 3 || cfg.ServerSleep.Duration != 2*time.Hour {
+		t.Errorf("after reload: rate=%d, num_downloaders=%d, sleep_time=%s; want 6, 3, 2h",
+			cfg.RequestRate, cfg.NumDownloaders, cfg.ServerSleep)
+	}
+
+	// A broken config file keeps the current config.
+	ioutil.WriteFile(configFile, []byte("rate = ["), 0644)
+	reloadConfig()
+	if cfg.RequestRate != 6 {
+		t.Errorf("after a broken reload: rate=%d; want 6", cfg.RequestRate)
+	}
+}
+
+func TestReloadBlogs(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldUserFile := userFile
+	defer func() { userFile = oldUserFile }()
+	userFile = path.Join(dir, "download.txt")
+
+	oldUsers := blogs.List()
+	defer blogs.Set(oldUsers)
+	demo := &User{name: "demo", tag: "cats"}
+	blogs.Set([]*User{demo, {name: "gone"}})
+
+	err = ioutil.WriteFile(userFile, []byte("demo dogs @daily\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadBlogs()
+
+	if users := blogs.List(); len(users) != 1 || users[0] != demo {
+		t.Fatalf("blogs after reload=%v; want [demo]", users)
+	}
+	if tag, schedule := demo.settings(); tag != "dogs" || schedule != "@daily" {
+		t.Errorf("demo after reload: tag=%q, schedule=%q; want dogs, @daily", tag, schedule)
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "download.txt")
+	if err := ioutil.WriteFile(file, []byte("demo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain any reload requested by other tests.
+	select {
+	case <-reloadRequests:
+	default:
+	}
+
+	go watchFiles(10*time.Millisecond, file)
+	time.Sleep(50 * time.Millisecond)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+
+	select {
+	case <-reloadRequests:
+	case <-time.After(time.Second):
+		t.Error("changing a watched file didn't request a reload")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Exit codes, besides 128 plus the number of a signal that stopped the
+// downloader. Invalid input is 2, like it is for invalid flags.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitInvalid = 2
+	exitPartial = 3
+)
+
+// Why something failed.
+const (
+	causeDownload = "download"
+	causeResolve  = "resolve"
+	causeScrape   = "scrape"
+	causeParse    = "parse"
+	causeInvalid  = "invalid blog"
+	causeNotFound = "blog not found"
+)
+
+// maxReportedURLs is the number of URLs shown for each blog and cause
+// in the report. All of them are in the JSON summary.
+const maxReportedURLs = 20
+
+// A failure is something that was given up on. Failures of the same
+// URL, for the same reason, are counted together.
+type failure struct {
+	Blog  string `json:"blog"`
+	Cause string `json:"cause"`
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error"`
+	// Saved is where what couldn't be parsed was saved.
+	Saved string `json:"saved,omitempty"`
+	Count int    `json:"count"`
+}
+
+// A failureReport collects what failed during a session, so it can be
+// shown at the end of it.
+type failureReport struct {
+	sync.Mutex
+	failures []*failure
+	// invalid are the blogs that couldn't be added before or during
+	// the session.
+	invalid []*failure
+	// code is the exit code of the last session.
+	code int
+}
+
+var failures failureReport
+
+// add records a failure.
+func (r *failureReport) add(f failure) {
+	r.Lock()
+	defer r.Unlock()
+
+	list := &r.failures
+	if f.Cause == causeInvalid || f.Cause == causeNotFound {
+		list = &r.invalid
+	}
+	for _, g := range *list {
+		if g.Blog == f.Blog && g.Cause == f.Cause && g.URL == f.URL {
+			g.Count++
+			g.Error, g.Saved = f.Error, f.Saved
+			return
+		}
+	}
+	f.Count = 1
+	*list = append(*list, &f)
+}
+
+// endSession returns the failures of a session, and decides its exit
+// code. The failures and invalid blogs are forgotten, so the next
+// session starts over.
+func (r *failureReport) endSession(userBlogs []*User) []failure {
+	list := r.List()
+	code := r.exitCode(userBlogs)
+
+	r.Lock()
+	r.failures = nil
+	r.invalid = nil
+	r.code = code
+	r.Unlock()
+	return list
+}
+
+// lastCode returns the exit code of the last session.
+func (r *failureReport) lastCode() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.code
+}
+
+// recordFailure adds something that was given up on to the report.
+func recordFailure(blog, cause, url string, err error) {
+	failures.add(failure{Blog: blog, Cause: cause, URL: url, Error: err.Error()})
+}
+
+// recordInvalidBlog adds a blog that couldn't be added to the report.
+// Blogs that couldn't be checked because tumblr couldn't be reached
+// aren't invalid, so they're a failure of the session instead.
+func recordInvalidBlog(name string, err error) {
+	cause := causeScrape
+	switch {
+	case errors.Is(err, errInvalidName):
+		cause = causeInvalid
+	case errors.Is(err, errUserNotFound):
+		cause = causeNotFound
+	}
+	recordFailure(name, cause, "", err)
+}
+
+// List returns the invalid blogs, and then the failures sorted by blog,
+// cause and URL.
+func (r *failureReport) List() []failure {
+	r.Lock()
+	defer r.Unlock()
+
+	var invalid, list []failure
+	for _, f := range r.invalid {
+		invalid = append(invalid, *f)
+	}
+	for _, f := range r.failures {
+		list = append(list, *f)
+	}
+	sort.SliceStable(invalid, func(i, j int) bool { return invalid[i].Blog < invalid[j].Blog })
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Blog != b.Blog {
+			return a.Blog < b.Blog
+		}
+		if a.Cause != b.Cause {
+			return a.Cause < b.Cause
+		}
+		return a.URL < b.URL
+	})
+	return append(invalid, list...)
+}
+
+// exitCode decides how a session went, from its failures and the blogs
+// that were in it. A blog failed if something failed for it, and
+// nothing was downloaded. Without any blogs, the input was invalid,
+// unless tumblr couldn't be reached to check them.
+func (r *failureReport) exitCode(userBlogs []*User) int {
+	r.Lock()
+	defer r.Unlock()
+
+	failed := make(map[string]bool)
+	for _, f := range r.failures {
+		failed[f.Blog] = true
+	}
+	worked := 0
+	for _, u := range userBlogs {
+		if !failed[u.name] || u.Snapshot().FilesDownloaded != 0 {
+			worked++
+		}
+	}
+
+	switch {
+	case len(userBlogs) == 0 && len(r.failures) != 0:
+		return exitFailure
+	case len(userBlogs) == 0:
+		return exitInvalid
+	case worked == 0:
+		return exitFailure
+	case len(r.failures) != 0 || len(r.invalid) != 0:
+		return exitPartial
+	}
+	return exitOK
+}
+
+// writeReport shows the failures grouped by blog and cause. Nothing is
+// written if nothing failed.
+func writeReport(w io.Writer, list []failure) {
+	if len(list) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Errors:")
+	for i := 0; i < len(list); {
+		f := list[i]
+		if f.Cause == causeInvalid || f.Cause == causeNotFound {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", f.Blog, f.Cause, f.Error)
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(list) && list[j].Blog == f.Blog && list[j].Cause == f.Cause {
+			j++
+		}
+		fmt.Fprintf(w, "  %s: %s failed for %d URLs\n", f.Blog, f.Cause, j-i)
+		for k, g := range list[i:j] {
+			if k == maxReportedURLs {
+				fmt.Fprintf(w, "    ... and %d more\n", j-i-k)
+				break
+			}
+			line := "    " + g.Error
+			if g.URL != "" {
+				line = "    " + g.URL + " - " + g.Error
+			}
+			if g.Count > 1 {
+				line += fmt.Sprintf(" (%d times)", g.Count)
+			}
+			if g.Saved != "" {
+				line += " - saved in " + g.Saved
+			}
+			fmt.Fprintln(w, line)
+		}
+		i = j
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFailureReportExitCode(t *testing.T) {
+	demo, other := &User{name: "demo"}, &User{name: "other"}
+	errTest := errors.New("test")
+
+	tests := []struct {
+		failures  []failure
+		userBlogs []*User
+		downloads uint64
+		want      int
+	}{
+		{nil, []*User{demo, other}, 0, exitOK},
+		{[]failure{{Blog: "demo", Cause: causeDownload, URL: "a"}}, []*User{demo, other}, 0, exitPartial},
+		{[]failure{{Blog: "demo", Cause: causeDownload, URL: "a"}, {Blog: "other", Cause: causeParse, URL: "b"}}, []*User{demo, other}, 0, exitFailure},
+		// demo downloaded something, so it didn't fail.
+		{[]failure{{Blog: "demo", Cause: causeDownload, URL: "a"}}, []*User{demo}, 1, exitPartial},
+		{[]failure{{Blog: "bad!", Cause: causeInvalid}}, []*User{demo}, 0, exitPartial},
+		{[]failure{{Blog: "bad!", Cause: causeInvalid}}, nil, 0, exitInvalid},
+		{[]failure{{Blog: "gone", Cause: causeScrape}}, nil, 0, exitFailure},
+	}
+
+	for i, test := range tests {
+		var r failureReport
+		for _, f := range test.failures {
+			f.Error = errTest.Error()
+			r.add(f)
+		}
+		demo.filesDownloaded = test.downloads
+		r.endSession(test.userBlogs)
+		if code := r.lastCode(); code != test.want {
+			t.Errorf("#%d: exit code %d; want %d", i, code, test.want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var r failureReport
+	recordErr := func(blog, cause, url string) {
+		r.add(failure{Blog: blog, Cause: cause, URL: url, Error: "oops"})
+	}
+	recordErr("demo", causeDownload, "https://x/2.jpg")
+	recordErr("demo", causeParse, "https://demo.tumblr.com/api/read/json")
+	recordErr("demo", causeDownload, "https://x/1.jpg")
+	recordErr("demo", causeDownload, "https://x/1.jpg")
+	recordErr("bad!", causeInvalid, "")
+	for i := 0; i < maxReportedURLs+2; i++ {
+		recordErr("other", causeDownload, fmt.Sprint("https://y/", i))
+	}
+
+	list := r.endSession(nil)
+	if list[0].Blog != "bad!" || list[1].URL != "https://x/1.jpg" || list[1].Count != 2 {
+		t.Errorf("report starts with %+v, %+v; want bad! and https://x/1.jpg twice", list[0], list[1])
+	}
+	if left := r.List(); len(left) != 0 {
+		t.Errorf("failures after the session ended=%+v; want none", left)
+	}
+	// An invalid blog doesn't make the next session partial.
+	r.endSession([]*User{{name: "demo"}})
+	if code := r.lastCode(); code != exitOK {
+		t.Errorf("exit code of the next session %d; want %d", code, exitOK)
+	}
+
+	var out bytes.Buffer
+	writeReport(&out, list)
+	for _, s := range []string{
+		"bad!: invalid blog (oops)",
+		"demo: download failed for 2 URLs\n    https://x/1.jpg - oops (2 times)\n    https://x/2.jpg - oops\n",
+		"demo: parse failed for 1 URLs",
+		"other: download failed for 22 URLs",
+		"... and 2 more",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("report doesn't have %q:\n%s", s, out.String())
+		}
+	}
+
+	out.Reset()
+	writeReport(&out, nil)
+	if out.Len() != 0 {
+		t.Errorf("report without failures=%q", out.String())
+	}
+}
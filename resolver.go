@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// A Resolver finds links to media hosted outside of tumblr in post
+// captions and bodies, and turns them into Files that can be downloaded.
+type Resolver interface {
+	// Name identifies the resolver. It's used to enable the resolver
+	// in the config, and to name the files it finds.
+	Name() string
+
+	// Match returns every link in s that the resolver can handle.
+	// It must not make any requests.
+	Match(s string) []string
+
+	// Resolve returns the downloadable files behind a matched link.
+	Resolve(link string) ([]File, error)
+}
+
+// ResolverConfig contains the settings of every resolver.
+type ResolverConfig struct {
+	Enabled []string `toml:"enabled"`
+
+	ImgurClientID string `toml:"imgur_client_id"`
+	YtDlpPath     string `toml:"ytdlp_path"`
+}
+
+// defaultResolvers are used if the config doesn't list any.
+var defaultResolvers = []string{"gfycat", "imgur", "redgifs"}
+
+// resolverRegistry maps resolver names to functions that create them.
+var resolverRegistry = make(map[string]func(ResolverConfig) Resolver)
+
+// activeResolvers are the resolvers enabled in the config, in order.
+var activeResolvers []Resolver
+
+// resolverClient is shared by all resolvers that make HTTP requests.
+var resolverClient = &http.Client{Timeout: 30 * time.Second}
+
+// registerResolver makes a resolver available to be enabled in the config.
+// It's meant to be called from init functions.
+func registerResolver(name string, fn func(ResolverConfig) Resolver) {
+	if _, ok := resolverRegistry[name]; ok {
+		panic("registerResolver: duplicate resolver " + name)
+	}
+	resolverRegistry[name] = fn
+}
+
+// setupResolvers creates every resolver enabled in the config.
+func setupResolvers(c ResolverConfig) {
+	names := c.Enabled
+	if names == nil {
+		names = defaultResolvers
+	}
+
+	activeResolvers = nil
+	for _, name := range names {
+		fn, ok := resolverRegistry[name]
+		if !ok {
+			slog.Warn("unknown resolver in config", "resolver", name)
+			continue
+		}
+		activeResolvers = append(activeResolvers, fn(c))
+	}
+}
+
+// findLinks runs every active resolver over s, and returns a File for
+// each link found. The files still have to be resolved before they can
+// be downloaded, which is left to the downloaders so that scraping
+// never waits on other sites.
+//
+// If slug isn't empty, the files are named after it, so they can be
+// matched to the post they were found in.
+func findLinks(s, slug string) []File {
+	var files []File
+	for _, r := range activeResolvers {
+		for i, link := range r.Match(s) {
+			f := File{
+				URL:      link,
+				resolver: r,
+			}
+			if slug != "" {
+				f.Filename = fmt.Sprintf("%s_%s_%02d", slug, r.Name(), i+1)
+			}
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// nameLinks names the links that weren't named after a file of their
+// post after the post itself, so every link can be looked up in the
+// database before it's resolved.
+func nameLinks(files []File, postID string) {
+	if postID == "" {
+		return
+	}
+	n := make(map[string]int)
+	for i, f := range files {
+		if f.resolver == nil || f.Filename != "" {
+			continue
+		}
+		n[f.resolver.Name()]++
+		files[i].Filename = fmt.Sprintf("%s_%s_%02d", postID, f.resolver.Name(), n[f.resolver.Name()])
+	}
+}
+
+// isLinkDownloaded reports whether a link was resolved in an earlier
+// session, and every file it led to is still there.
+func (u *User) isLinkDownloaded(f File) bool {
+	names, ok := resolvedLink(u.name, f.Filename)
+	if !ok {
+		return false
+	}
+	for _, name := range names {
+		if _, _, ok := u.findDownloaded(name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadLinked resolves a file found by findLinks, and downloads
+// everything the link points to. Links that can't be resolved are
+// counted and skipped.
+func downloadLinked(f File, limiter <-chan time.Time) {
+	u := f.User
+
+	found, err := f.resolver.Resolve(f.URL)
+	if err != nil {
+		slog.Warn("can't resolve a link", f.logFields("resolver", f.resolver.Name(), "err", err)...)
+		atomic.AddUint64(&gStats.resolverMisses, 1)
+		u.recordError(err)
+		recordFailure(u.name, causeResolve, f.URL, err)
+		u.progress.fail(f.PostID)
+		found = nil
+	}
+
+	// The link itself was counted as one file when it was queued.
+	// Correct that now that we know how many files it leads to.
+	u.incrementFilesFound(len(found) - 1)
+	u.progress.adjust(f.PostID, len(found)-1)
+	atomic.AddInt64(&pBar.Total, int64(len(found)-1))
+
+	for i := range found {
+		if f.Filename != "" {
+			ext := path.Ext(found[i].Filename)
+			if len(found) == 1 {
+				found[i].Filename = f.Filename + ext
+			} else {
+				found[i].Filename = fmt.Sprintf("%s_%02d%s", f.Filename, i+1, ext)
+			}
+		}
+	}
+	if err == nil && f.Filename != "" && !dryRun {
+		names := make([]string, len(found))
+		for i, rf := range found {
+			names[i] = rf.Filename
+		}
+		recordResolved(u.name, f, names)
+	}
+
+	for _, rf := range found {
+		rf.User = u
+		rf.UnixTimestamp = f.UnixTimestamp
+		rf.PostID = f.PostID
+		rf.meta = f.meta
+
+		if stopping() {
+			rf.discard()
+			continue
+		}
+
+		if u.checkFile(rf) {
+			continue
+		}
+
+		waitLimiter(limiter)
+		showProgress(rf)
+		rf.Download()
+	}
+}
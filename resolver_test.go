@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves every link it's given to a fixed set of URLs.
+type fakeResolver struct {
+	links []string
+	urls  []string
+}
+
+func (fakeResolver) Name() string { return "fake" }
+
+func (r fakeResolver) Match(s string) []string { return r.links }
+
+func (r fakeResolver) Resolve(link string) ([]File, error) {
+	var files []File
+	for _, u := range r.urls {
+		files = append(files, newFile(u))
+	}
+	return files, nil
+}
+
+func filenames(files []File) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Filename)
+	}
+	return names
+}
+
+func TestFindLinks(t *testing.T) {
+	old := activeResolvers
+	defer func() { activeResolvers = old }()
+
+	activeResolvers = []Resolver{fakeResolver{
+		links: []string{"a", "b"},
+		urls:  []string{"https://example.com/x.mp4"},
+	}}
+
+	tests := []struct {
+		slug   string
+		result []string
+	}{
+		{"", []string{"", ""}},
+		{"tumblr_abc", []string{"tumblr_abc_fake_01", "tumblr_abc_fake_02"}},
+	}
+
+	for i, test := range tests {
+		files := findLinks("", test.slug)
+		if len(files) != len(test.result) {
+			t.Fatalf("#%d: findLinks found %d files; want %d", i, len(files), len(test.result))
+		}
+		for j, f := range files {
+			if f.Filename != test.result[j] {
+				t.Errorf("#%d: files[%d].Filename=%s; want %s", i, j, f.Filename, test.result[j])
+			}
+		}
+	}
+}
+
+func TestNameLinks(t *testing.T) {
+	r := fakeResolver{}
+	files := []File{
+		{Filename: "tumblr_abc.jpg"},
+		{URL: "a", resolver: r},
+		{URL: "b", resolver: r, Filename: "tumblr_abc_fake_01"},
+		{URL: "c", resolver: r},
+	}
+	nameLinks(files, "123")
+
+	want := []string{"tumblr_abc.jpg", "123_fake_01", "tumblr_abc_fake_01", "123_fake_02"}
+	for i, f := range files {
+		if f.Filename != want[i] {
+			t.Errorf("#%d: Filename=%s; want %s", i, f.Filename, want[i])
+		}
+	}
+}
+
+func TestResolvedLinks(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := cfg.DownloadDirectory
+	cfg.DownloadDirectory = dir
+	defer func() { cfg.DownloadDirectory = oldDir }()
+
+	os.MkdirAll(path.Join(dir, "demo"), 0755)
+	ioutil.WriteFile(path.Join(dir, "demo", "123_fake_01_01.mp4"), nil, 0644)
+
+	u := &User{name: "demo"}
+	link := File{URL: "a", Filename: "123_fake_01", PostID: 123}
+	if u.isLinkDownloaded(link) {
+		t.Error("a link that was never resolved is downloaded")
+	}
+
+	recordResolved("demo", link, []string{"123_fake_01_01.mp4", "123_fake_01_02.mp4"})
+	if u.isLinkDownloaded(link) {
+		t.Error("a link is downloaded with one of its files missing")
+	}
+	ioutil.WriteFile(path.Join(dir, "demo", "123_fake_01_02.mp4"), nil, 0644)
+	if !u.isLinkDownloaded(link) {
+		t.Error("a link isn't downloaded with all of its files there")
+	}
+}
+
+func TestImgurResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Client-ID test" {
+			http.Error(w, "no client ID", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/3/album/album1/images":
+			fmt.Fprint(w, `{"data":[{"link":"https://i.imgur.com/one.jpg"},{"link":"https://i.imgur.com/two.png"}]}`)
+		case "/3/image/single":
+			fmt.Fprint(w, `{"data":{"link":"https://i.imgur.com/single.gif"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	r := &imgurResolver{apiBase: ts.URL, fileBase: "https://i.imgur.com", clientID: "test"}
+
+	tests := []struct {
+		link   string
+		result []string
+	}{
+		{"https://i.imgur.com/direct.jpg", []string{"direct.jpg"}},
+		{"https://imgur.com/a/album1", []string{"one.jpg", "two.png"}},
+		{"http://imgur.com/single", []string{"single.gif"}},
+	}
+
+	for i, test := range tests {
+		links := r.Match(`<a href="` + test.link + `">link</a>`)
+		if len(links) != 1 {
+			t.Fatalf("#%d: Match(%s) found %d links; want 1", i, test.link, len(links))
+		}
+
+		files, err := r.Resolve(links[0])
+		if err != nil {
+			t.Fatalf("#%d: Resolve(%s): %s", i, test.link, err)
+		}
+		if len(files) != len(test.result) {
+			t.Fatalf("#%d: Resolve(%s) found %d files; want %d", i, test.link, len(files), len(test.result))
+		}
+		for j, f := range files {
+			if f.Filename != test.result[j] {
+				t.Errorf("#%d: files[%d].Filename=%s; want %s", i, j, f.Filename, test.result[j])
+			}
+		}
+	}
+
+	if _, err := r.Resolve("https://imgur.com/a/missing"); err == nil {
+		t.Error("Resolve of a missing album succeeded")
+	}
+}
+
+func TestRedgifsResolver(t *testing.T) {
+	var tokenRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/auth/temporary":
+			tokenRequests++
+			fmt.Fprint(w, `{"token":"secret"}`)
+		case "/v2/gifs/somegif":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				http.Error(w, "no token", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"gif":{"urls":{"sd":"https://media.redgifs.com/Some-mobile.mp4","hd":"https://media.redgifs.com/Some.mp4"}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	r := &redgifsResolver{apiBase: ts.URL}
+
+	ids := r.Match(`<a href="https://www.redgifs.com/watch/somegif">`)
+	if len(ids) != 1 || ids[0] != "somegif" {
+		t.Fatalf("Match found %v; want [somegif]", ids)
+	}
+
+	for i := 0; i < 2; i++ {
+		files, err := r.Resolve(ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Filename != "Some.mp4" {
+			t.Errorf("Resolve found %v; want [Some.mp4]", filenames(files))
+		}
+	}
+
+	if tokenRequests != 1 {
+		t.Errorf("token requested %d times; want 1", tokenRequests)
+	}
+
+	// An expired token is replaced.
+	r.token = "expired"
+	if files, err := r.Resolve(ids[0]); err != nil || len(files) != 1 {
+		t.Errorf("Resolve with an expired token=%v, %v", filenames(files), err)
+	}
+	if tokenRequests != 2 {
+		t.Errorf("token requested %d times after it expired; want 2", tokenRequests)
+	}
+}
+
+func TestYtDlpResolver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake yt-dlp is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "yt-dlp")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+echo '{"id":"dQw4w9WgXcQ","ext":"mp4","url":"https://example.com/videoplayback?id=1"}'
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := ytdlpResolver{path: script}
+
+	links := r.Match(`<iframe src="https://www.youtube.com/embed/dQw4w9WgXcQ?feature=oembed"></iframe>`)
+	if len(links) != 1 {
+		t.Fatalf("Match found %v; want 1 link", links)
+	}
+
+	files, err := r.Resolve(links[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Filename != "dQw4w9WgXcQ.mp4" {
+		t.Errorf("Resolve found %v; want [dQw4w9WgXcQ.mp4]", filenames(files))
+	}
+
+	r.path = path.Join(dir, "missing")
+	if _, err = r.Resolve(links[0]); err == nil {
+		t.Error("Resolve with a missing yt-dlp succeeded")
+	}
+
+	// A yt-dlp that hangs is stopped when downloads are aborted.
+	r.path = path.Join(dir, "hang")
+	if err = ioutil.WriteFile(r.path, []byte("#!/bin/sh\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldCtx := abortCtx
+	var cancel context.CancelFunc
+	abortCtx, cancel = context.WithCancel(context.Background())
+	defer func() { abortCtx = oldCtx }()
+	cancel()
+	start := time.Now()
+	if _, err = r.Resolve(links[0]); err == nil || time.Since(start) > 10*time.Second {
+		t.Errorf("Resolve with an aborted hanging yt-dlp=%v after %s", err, time.Since(start))
+	}
+}
+
+func TestGfycatResolver(t *testing.T) {
+	var archived bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/auth/temporary":
+			fmt.Fprint(w, `{"token":"secret"}`)
+		case "/v2/gifs/movedgif":
+			fmt.Fprint(w, `{"gif":{"urls":{"hd":"https://media.redgifs.com/MovedGif.mp4"}}}`)
+		case "/wayback/available":
+			if archived && r.URL.Query().Get("url") == "giant.gfycat.com/OldGif.mp4" {
+				fmt.Fprint(w, `{"archived_snapshots":{"closest":{"available":true,"url":"http://web.archive.org/web/20200101000000/https://giant.gfycat.com/OldGif.mp4"}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"archived_snapshots":{}}`)
+		default:
+			// Gfycat itself is gone.
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	r := &gfycatResolver{
+		apiBase:     ts.URL,
+		waybackBase: ts.URL,
+		redgifs:     &redgifsResolver{apiBase: ts.URL},
+	}
+
+	files, err := r.Resolve("MovedGif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].URL != "https://media.redgifs.com/MovedGif.mp4" {
+		t.Errorf("Resolve(MovedGif) = %s; want the redgifs mirror", files[0].URL)
+	}
+
+	if _, err = r.Resolve("OldGif"); err == nil {
+		t.Error("Resolve(OldGif) succeeded without any copy")
+	}
+
+	archived = true
+	files, err = r.Resolve("OldGif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "http://web.archive.org/web/20200101000000id_/https://giant.gfycat.com/OldGif.mp4"
+	if files[0].URL != want {
+		t.Errorf("Resolve(OldGif) = %s; want %s", files[0].URL, want)
+	}
+	if files[0].Filename != "OldGif.mp4" {
+		t.Errorf("Resolve(OldGif).Filename = %s; want OldGif.mp4", files[0].Filename)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduleConfig controls when blogs are checked in server mode.
+type ScheduleConfig struct {
+	// Default is the schedule of blogs that don't have their own.
+	// If it's empty, blogs are checked every sleep_time.
+	Default string `toml:"default"`
+
+	// Backoff makes blogs get checked less often every time they
+	// don't have new posts, up to MaxInterval between checks.
+	Backoff     bool     `toml:"backoff"`
+	MaxInterval duration `toml:"max_interval"`
+}
+
+// duration is a time.Duration that can be read from the config as a
+// number of seconds, or as a string like "1h30m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	if secs, err := strconv.ParseInt(string(text), 10, 64); err == nil {
+		d.Duration = time.Duration(secs) * time.Second
+		return nil
+	}
+
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// parseSchedule parses the schedule of a blog. It can be a duration
+// like "6h", a descriptor like "@daily" or "@every 6h", or a cron
+// expression like "@cron 0 3 * * 1".
+func parseSchedule(spec string) (cron.Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("parseSchedule: empty schedule")
+	}
+
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("parseSchedule: interval must be positive: %s", spec)
+		}
+		return cron.Every(d), nil
+	}
+
+	if strings.HasPrefix(spec, "@cron ") {
+		spec = strings.TrimPrefix(spec, "@cron ")
+	}
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parseSchedule: %s", err)
+	}
+	return s, nil
+}
+
+// verifyScheduleConfig checks the schedule config and sets the defaults.
+func verifyScheduleConfig(c *ScheduleConfig) {
+	if c.Default != "" {
+		if _, err := parseSchedule(c.Default); err != nil {
+			slog.Warn("invalid default schedule, checking blogs every sleep_time", "schedule", c.Default, "sleep_time", cfg.ServerSleep, "err", err)
+			c.Default = ""
+		}
+	}
+
+	if c.MaxInterval.Duration <= 0 {
+		c.MaxInterval.Duration = 7 * 24 * time.Hour
+	}
+}
+
+// blogSchedule returns the schedule for a blog with the given spec,
+// falling back to the default schedule.
+func blogSchedule(spec string) cron.Schedule {
+	if spec != "" {
+		s, err := parseSchedule(spec)
+		if err == nil {
+			return s
+		}
+		slog.Warn("invalid schedule, using the default", "schedule", spec, "err", err)
+	}
+
+	c := config()
+	if c.Schedule.Default != "" {
+		if s, err := parseSchedule(c.Schedule.Default); err == nil {
+			return s
+		}
+	}
+	return cron.Every(c.ServerSleep.Duration)
+}
+
+// nextDue returns when a blog should be checked next, if it was last
+// checked at from. With backoff, every check in a row without new posts
+// doubles the number of scheduled times that are skipped, as long as
+// that stays within MaxInterval.
+func nextDue(s cron.Schedule, from time.Time, idle int) time.Time {
+	next := s.Next(from)
+	c := config().Schedule
+	if !c.Backoff {
+		return next
+	}
+
+	if idle > 30 {
+		idle = 30
+	}
+	for skip := (1 << uint(idle)) - 1; skip > 0; skip-- {
+		later := s.Next(next)
+		if later.Sub(from) > c.MaxInterval.Duration {
+			break
+		}
+		next = later
+	}
+	return next
+}
+
+// scheduleNext works out when a user that was just checked is due
+// again. newPosts is set if the check found new posts.
+func (u *User) scheduleNext(newPosts bool) {
+	u.Lock()
+	if newPosts {
+		u.idleChecks = 0
+	} else {
+		u.idleChecks++
+	}
+	u.nextDue = nextDue(blogSchedule(u.schedule), u.lastChecked, u.idleChecks)
+	rec := scheduleRecord{NextDue: u.nextDue, IdleChecks: u.idleChecks}
+	u.Unlock()
+
+	updateSchedule(u.name, rec)
+}
+
+// setSchedule changes the schedule of a user. The next check is moved
+// to match the new schedule.
+func (u *User) setSchedule(spec string) {
+	u.Lock()
+	u.schedule = spec
+	if !u.lastChecked.IsZero() {
+		u.nextDue = nextDue(blogSchedule(spec), u.lastChecked, u.idleChecks)
+	}
+	rec := scheduleRecord{NextDue: u.nextDue, IdleChecks: u.idleChecks}
+	u.Unlock()
+
+	updateSchedule(u.name, rec)
+}
+
+// isDue reports if a user should be checked at the given time.
+func (u *User) isDue(now time.Time) bool {
+	u.RLock()
+	defer u.RUnlock()
+	return u.pendingRescan || !now.Before(u.nextDue)
+}
+
+// dueBlogs returns the users that should be checked now. If all is
+// set, every user is returned.
+func dueBlogs(users []*User, now time.Time, all bool) []*User {
+	var due []*User
+	for _, u := range users {
+		if all || u.isDue(now) {
+			due = append(due, u)
+		}
+	}
+	return due
+}
+
+// nextWakeup returns the time the next user is due.
+func nextWakeup(users []*User) time.Time {
+	var next time.Time
+	for _, u := range users {
+		u.RLock()
+		due := u.nextDue
+		u.RUnlock()
+
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
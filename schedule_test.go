@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/burntsushi/toml"
+)
+
+func TestParseUserLine(t *testing.T) {
+	tests := []struct {
+		line, name, tag, schedule string
+	}{
+		{"sunsets", "sunsets", "", ""},
+		{"nature-pics forests", "nature-pics", "forests", ""},
+		{"chickenpictures funny faces", "chickenpictures", "funny faces", ""},
+		{"sunsets @every 6h", "sunsets", "", "@every 6h"},
+		{"chickenpictures funny faces @daily", "chickenpictures", "funny faces", "@daily"},
+		{"demo  cats   @cron 0 3 * * 1", "demo", "cats", "@cron 0 3 * * 1"},
+	}
+
+	for i, test := range tests {
+		name, tag, schedule := parseUserLine(test.line)
+		if name != test.name || tag != test.tag || schedule != test.schedule {
+			t.Errorf("#%d: parseUserLine(%s)=%q, %q, %q; want %q, %q, %q", i, test.line,
+				name, tag, schedule, test.name, test.tag, test.schedule)
+		}
+	}
+}
+
+func TestFormatUserLine(t *testing.T) {
+	tests := []struct {
+		name, tag, schedule, line string
+	}{
+		{"sunsets", "", "", "sunsets"},
+		{"sunsets", "beach", "", "sunsets beach"},
+		{"sunsets", "", "6h", "sunsets @every 6h"},
+		{"sunsets", "beach", "@daily", "sunsets beach @daily"},
+	}
+
+	for i, test := range tests {
+		line := formatUserLine(test.name, test.tag, test.schedule)
+		if line != test.line {
+			t.Errorf("#%d: formatUserLine(%s, %s, %s)=%s; want %s", i,
+				test.name, test.tag, test.schedule, line, test.line)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2020, 1, 1, 12, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"6h", from.Add(6 * time.Hour)},
+		{"@every 30m", from.Add(30 * time.Minute)},
+		{"@daily", time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)},
+		{"@cron 0 3 * * *", time.Date(2020, 1, 2, 3, 0, 0, 0, time.Local)},
+	}
+
+	for i, test := range tests {
+		s, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("#%d: parseSchedule(%s): %s", i, test.spec, err)
+			continue
+		}
+		if next := s.Next(from); !next.Equal(test.next) {
+			t.Errorf("#%d: parseSchedule(%s).Next=%s; want %s", i, test.spec, next, test.next)
+		}
+	}
+
+	for _, spec := range []string{"", "-1h", "@sometimes", "@cron 1 2 3"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%s) didn't fail", spec)
+		}
+	}
+}
+
+func TestNextDue(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg.Schedule.MaxInterval.Duration = 10 * time.Hour
+
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, _ := parseSchedule("1h")
+
+	tests := []struct {
+		backoff bool
+		idle    int
+		after   time.Duration
+	}{
+		{false, 0, time.Hour},
+		{false, 5, time.Hour},
+		{true, 0, time.Hour},
+		{true, 1, 2 * time.Hour},
+		{true, 3, 8 * time.Hour},
+		{true, 4, 10 * time.Hour},
+		{true, 100, 10 * time.Hour},
+	}
+
+	for i, test := range tests {
+		cfg.Schedule.Backoff = test.backoff
+		if next := nextDue(s, from, test.idle); !next.Equal(from.Add(test.after)) {
+			t.Errorf("#%d: nextDue(backoff=%t, idle=%d)=%s; want %s", i,
+				test.backoff, test.idle, next, from.Add(test.after))
+		}
+	}
+}
+
+func TestDueBlogs(t *testing.T) {
+	now := time.Now()
+	users := []*User{
+		{name: "due", nextDue: now.Add(-time.Minute)},
+		{name: "new"},
+		{name: "later", nextDue: now.Add(time.Hour)},
+		{name: "rescan", nextDue: now.Add(time.Hour), pendingRescan: true},
+	}
+
+	var names []string
+	for _, u := range dueBlogs(users, now, false) {
+		names = append(names, u.name)
+	}
+	if len(names) != 3 || names[0] != "due" || names[1] != "new" || names[2] != "rescan" {
+		t.Errorf("dueBlogs=%v; want [due new rescan]", names)
+	}
+
+	if due := dueBlogs(users, now, true); len(due) != len(users) {
+		t.Errorf("dueBlogs(all) returned %d blogs; want %d", len(due), len(users))
+	}
+
+	if next := nextWakeup(users[2:]); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("nextWakeup=%s; want %s", next, now.Add(time.Hour))
+	}
+}
+
+func TestDurationConfig(t *testing.T) {
+	tests := []struct {
+		toml string
+		want time.Duration
+	}{
+		{"sleep_time = 60", time.Minute},
+		{`sleep_time = "1h30m"`, 90 * time.Minute},
+	}
+
+	for i, test := range tests {
+		var c Config
+		if _, err := toml.Decode(test.toml, &c); err != nil {
+			t.Errorf("#%d: %s: %s", i, test.toml, err)
+			continue
+		}
+		if c.ServerSleep.Duration != test.want {
+			t.Errorf("#%d: %s gives %s; want %s", i, test.toml, c.ServerSleep.Duration, test.want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/boltdb/bolt"
+)
+
+// The database is laid out like this:
+//
+//	meta   schema version, and the version of the last run
+//	blogs  blog name -> blogRecord
+//	posts  blog name -> bucket of post ID -> postRecord
+//	files  blog name -> bucket of file name -> fileRecord
+//	runs   sequence number -> runRecord
+//
+// Changes to the layout are made by adding a migration.
+var (
+	metaBucket  = []byte("meta")
+	blogsBucket = []byte("blogs")
+	filesBucket = []byte("files")
+	runsBucket  = []byte("runs")
+
+	schemaKey  = []byte("schema")
+	versionKey = []byte("version")
+)
+
+// parserVersion is bumped whenever post parsing changes in a way that
+// finds files older versions missed. Blogs that were last checked in
+// full with an older version have the posts of the types listed in
+// parserChanges fetched and parsed again, and files that aren't on disk
+// are downloaded. The version is stored once that's done, or once a
+// full scrape reaches the end of the blog, even if it took a few
+// sessions.
+const parserVersion = 1
+
+// parserChanges lists the post types whose parsing each parser version
+// after the first changed, by the names tumblr filters posts by: text,
+// quote, photo, link, chat, video or audio. A version that isn't listed
+// changed all of them, so blogs are checked in full once more, like
+// -force does.
+var parserChanges = map[int][]string{}
+
+// reparseTypes returns the post types whose parsing changed after
+// parser version from, up to version to. all is set if every post has
+// to be parsed again.
+func reparseTypes(from, to int) (types []string, all bool) {
+	seen := make(map[string]bool)
+	for v := from + 1; v <= to; v++ {
+		changed, ok := parserChanges[v]
+		if !ok {
+			return nil, true
+		}
+		for _, t := range changed {
+			if !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
+		}
+	}
+	return types, false
+}
+
+// A blogRecord is everything that's known about a blog.
+type blogRecord struct {
+	// UUID identifies the blog in exports, whatever its name is.
+	UUID string `json:"uuid"`
+
+	LastPostID  int64          `json:"last_post_id,omitempty"`
+	LastChecked time.Time      `json:"last_checked"`
+	Schedule    scheduleRecord `json:"schedule"`
+	// Checkpoint is set while a scrape of the blog is unfinished.
+	Checkpoint *checkpoint `json:"checkpoint,omitempty"`
+	// Terminated is when the blog was noticed missing from tumblr.
+	Terminated time.Time `json:"terminated"`
+	// ParserVersion is the parser version the blog was last checked
+	// in full with.
+	ParserVersion int `json:"parser_version,omitempty"`
+}
+
+// fileStatus is what happened to a file.
+type fileStatus string
+
+const (
+	fileDownloaded fileStatus = "downloaded"
+	fileFailed     fileStatus = "failed"
+	// Links are stored once they're resolved, with the files they
+	// led to.
+	fileResolved fileStatus = "resolved"
+)
+
+// A fileRecord is stored for every file downloaded from a blog, keyed
+// by the name it was found under.
+type fileRecord struct {
+	URL    string     `json:"url,omitempty"`
+	Path   string     `json:"path,omitempty"`
+	PostID int64      `json:"post_id,omitempty"`
+	Hash   string     `json:"sha256,omitempty"`
+	Size   int64      `json:"size,omitempty"`
+	Status fileStatus `json:"status"`
+	// Converted is the name the file was converted to, if it was.
+	Converted string `json:"converted,omitempty"`
+	// Resolved are the names of the files a link led to.
+	Resolved []string `json:"resolved,omitempty"`
+	// Largest is the name of the largest version of a photo, once its
+	// versions were probed.
+	Largest string `json:"largest,omitempty"`
+}
+
+// A runRecord sums up a download session.
+type runRecord struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Blogs           []string  `json:"blogs"`
+	FilesFound      uint64    `json:"files_found"`
+	FilesDownloaded uint64    `json:"files_downloaded"`
+	BytesDownloaded uint64    `json:"bytes_downloaded"`
+	Errors          uint64    `json:"errors"`
+	Interrupted     bool      `json:"interrupted,omitempty"`
+}
+
+// A migration upgrades the database from the schema version before it.
+type migration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations[i] upgrades the database from schema version i to i+1.
+// Released migrations must never change, since databases out there
+// were already upgraded by them.
+var migrations = []migration{
+	{"move blogs, schedules, checkpoints and conversions into records", migrateRecords},
+}
+
+// migrateDatabase brings the database up to the latest schema version.
+// Every migration runs in the same transaction, so a failed upgrade
+// leaves the database as it was.
+func migrateDatabase(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		for i := version; i < len(migrations); i++ {
+			slog.Info("migrating the database", "version", i+1, "migration", migrations[i].description)
+			if err = migrations[i].migrate(tx); err != nil {
+				return fmt.Errorf("migration %d: %v", i+1, err)
+			}
+		}
+		return meta.Put(schemaKey, []byte(strconv.Itoa(len(migrations))))
+	})
+}
+
+// schemaVersion returns the schema version of the database. Databases
+// newer than this downloader supports are an error.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+	v := meta.Get(schemaKey)
+	if v == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("bad schema version %q", v)
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("schema version %d is newer than this downloader supports (%d)",
+			version, len(migrations))
+	}
+	return version, nil
+}
+
+// legacyVersion is the last release that used the layout before the
+// schema. Its parser is parser version 1.
+var legacyVersion = semver.MustParse("1.4.0")
+
+// migrateRecords replaces the buckets of earlier versions, which held a
+// single value per blog each, with blog and file records.
+func migrateRecords(tx *bolt.Tx) error {
+	for _, name := range [][]byte{blogsBucket, postsBucket, filesBucket, runsBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	records := make(map[string]*blogRecord)
+	record := func(name []byte) *blogRecord {
+		rec, ok := records[string(name)]
+		if !ok {
+			rec = &blogRecord{}
+			records[string(name)] = rec
+		}
+		return rec
+	}
+
+	// Blogs were checked in full whenever the version changed, so only
+	// blogs last checked by the last release with this layout, or a
+	// later build of it, are up to date.
+	upToDate := false
+	err := forEachOld(tx, "tumblr", func(k, v []byte) error {
+		if string(k) == "_VERSION_" {
+			old, err := semver.Parse(string(v))
+			upToDate = err == nil && old.GTE(legacyVersion)
+			return tx.Bucket(metaBucket).Put(versionKey, v)
+		}
+		id, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("last post of %s: %v", k, err)
+		}
+		record(k).LastPostID = id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachOld(tx, "checked", func(k, v []byte) error {
+		t, err := time.Parse(time.RFC3339, string(v))
+		record(k).LastChecked = t
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachOld(tx, "schedules", func(k, v []byte) error {
+		return json.Unmarshal(v, &record(k).Schedule)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachOld(tx, "checkpoints", func(k, v []byte) error {
+		var c checkpoint
+		record(k).Checkpoint = &c
+		return json.Unmarshal(v, &c)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachOld(tx, "terminated", func(k, v []byte) error {
+		t, err := time.Parse(time.RFC3339, string(v))
+		record(k).Terminated = t
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = forEachOld(tx, "conversions", func(k, v []byte) error {
+		parts := strings.SplitN(string(k), "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		b, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(parts[0]))
+		if err != nil {
+			return err
+		}
+		return putJSON(b, []byte(parts[1]), fileRecord{Status: fileDownloaded, Converted: string(v)})
+	})
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket(blogsBucket)
+	for name, rec := range records {
+		rec.UUID = newUUID()
+		if upToDate {
+			rec.ParserVersion = parserVersion
+		}
+		if err = putJSON(b, []byte(name), rec); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{"tumblr", "checked", "schedules", "checkpoints", "terminated", "conversions"} {
+		if tx.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err = tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachOld calls fn for every key in a bucket of an earlier schema,
+// if the bucket exists.
+func forEachOld(tx *bolt.Tx, name string, fn func(k, v []byte) error) error {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(fn)
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatal(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// runKey turns the sequence number of a run into a key that sorts in
+// the order the runs happened.
+func runKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
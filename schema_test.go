@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// openOldDatabase creates a database with the given buckets and keys,
+// laid out like an earlier version would have left it.
+func openOldDatabase(t *testing.T, buckets map[string]map[string]string) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(path.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for name, keys := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range keys {
+				if err = b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func schemaOf(db *bolt.DB) string {
+	var v string
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			v = string(b.Get(schemaKey))
+		}
+		return nil
+	})
+	return v
+}
+
+func blogOf(t *testing.T, db *bolt.DB, name string) blogRecord {
+	var rec blogRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		var ok bool
+		rec, ok, err = getBlog(tx, name)
+		if !ok {
+			t.Errorf("no record for %s", name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestMigrateFresh(t *testing.T) {
+	db, cleanup := openOldDatabase(t, nil)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		if err := migrateDatabase(db); err != nil {
+			t.Fatalf("migration #%d: %v", i, err)
+		}
+	}
+
+	if v := schemaOf(db); v != "1" {
+		t.Errorf("schema=%q; want 1", v)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blogsBucket, postsBucket, filesBucket, runsBucket} {
+			if tx.Bucket(name) == nil {
+				t.Errorf("bucket %s is missing", name)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMigrateRecords(t *testing.T) {
+	// The version that runs the migration doesn't change its result.
+	oldVersion := cfg.version
+	cfg.version.Major = 9
+	defer func() { cfg.version = oldVersion }()
+
+	checked := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	schedule, _ := json.Marshal(scheduleRecord{NextDue: checked.Add(time.Hour), IdleChecks: 2})
+	resume, _ := json.Marshal(checkpoint{Top: 900, LowWater: 400, Offset: 550})
+
+	db, cleanup := openOldDatabase(t, map[string]map[string]string{
+		"tumblr":      {"demo": "123", "gone": "5", "_VERSION_": "1.4.0"},
+		"checked":     {"demo": checked.Format(time.RFC3339)},
+		"schedules":   {"demo": string(schedule)},
+		"checkpoints": {"demo": string(resume)},
+		"terminated":  {"gone": checked.Format(time.RFC3339)},
+		"conversions": {"demo/tumblr_abc_1280.png": "tumblr_abc_1280.jpg"},
+	})
+	defer cleanup()
+
+	// Posts were already stored per blog, and stay as they are.
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(postsBucket)
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucket([]byte("demo"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("123"), []byte(`{"files":["a.jpg"]}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	demo := blogOf(t, db, "demo")
+	if demo.LastPostID != 123 || !demo.LastChecked.Equal(checked) || demo.Schedule.IdleChecks != 2 {
+		t.Errorf("demo=%+v; want last post 123, checked %s, 2 idle checks", demo, checked)
+	}
+	if demo.Checkpoint == nil || demo.Checkpoint.LowWater != 400 {
+		t.Errorf("demo checkpoint=%+v; want low water 400", demo.Checkpoint)
+	}
+	if demo.ParserVersion != parserVersion {
+		t.Errorf("demo parser version=%d; want %d", demo.ParserVersion, parserVersion)
+	}
+
+	gone := blogOf(t, db, "gone")
+	if !gone.Terminated.Equal(checked) {
+		t.Errorf("gone terminated=%s; want %s", gone.Terminated, checked)
+	}
+	if demo.UUID == "" || demo.UUID == gone.UUID {
+		t.Errorf("UUIDs %q and %q; want two different ones", demo.UUID, gone.UUID)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"tumblr", "checked", "schedules", "checkpoints", "terminated", "conversions"} {
+			if tx.Bucket([]byte(name)) != nil {
+				t.Errorf("old bucket %s is still there", name)
+			}
+		}
+
+		if v := tx.Bucket(metaBucket).Get(versionKey); string(v) != "1.4.0" {
+			t.Errorf("version=%q; want 1.4.0", v)
+		}
+
+		if v := tx.Bucket(postsBucket).Bucket([]byte("demo")).Get([]byte("123")); v == nil {
+			t.Error("post 123 of demo is gone")
+		}
+
+		var rec fileRecord
+		v := tx.Bucket(filesBucket).Bucket([]byte("demo")).Get([]byte("tumblr_abc_1280.png"))
+		if err := json.Unmarshal(v, &rec); err != nil || rec.Converted != "tumblr_abc_1280.jpg" {
+			t.Errorf("converted file=%+v (%v); want converted to tumblr_abc_1280.jpg", rec, err)
+		}
+		return nil
+	})
+}
+
+func TestMigrateOutdatedBlogs(t *testing.T) {
+	db, cleanup := openOldDatabase(t, map[string]map[string]string{
+		"tumblr": {"demo": "123", "_VERSION_": "1.0.0"},
+	})
+	defer cleanup()
+
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blogs last checked by an older version get one full check.
+	u := &User{name: "demo"}
+	db.View(func(tx *bolt.Tx) error {
+		return loadUserTx(tx, u)
+	})
+	if u.lastPostID != 123 || !u.pendingRescan {
+		t.Errorf("demo: last post %d, rescan %t; want 123, true", u.lastPostID, u.pendingRescan)
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	db, cleanup := openOldDatabase(t, map[string]map[string]string{
+		"tumblr": {"demo": "not a number"},
+	})
+	defer cleanup()
+
+	if err := migrateDatabase(db); err == nil {
+		t.Fatal("migrating a broken database succeeded")
+	}
+
+	// Nothing was changed.
+	if v := schemaOf(db); v != "" {
+		t.Errorf("schema=%q after a failed migration; want none", v)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("tumblr")) == nil {
+			t.Error("old bucket removed by a failed migration")
+		}
+		return nil
+	})
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	db, cleanup := openOldDatabase(t, map[string]map[string]string{
+		"meta": {"schema": "99"},
+	})
+	defer cleanup()
+
+	if err := migrateDatabase(db); err == nil {
+		t.Error("migrating a database from a newer version succeeded")
+	}
+}
+
+func TestRecordFile(t *testing.T) {
+	defer setupTestDatabase(t)()
+
+	f := File{User: &User{name: "demo"}, URL: "https://example.com/a.png", Filename: "a.png", PostID: 7}
+	f.record("demo/a.png", []byte("data"))
+	recordConversion("demo", "a.png", "a.jpg")
+
+	var rec fileRecord
+	database.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(filesBucket).Bucket([]byte("demo")).Get([]byte("a.png"))
+		return json.Unmarshal(v, &rec)
+	})
+
+	want := fileRecord{
+		URL:       f.URL,
+		Path:      "demo/a.png",
+		PostID:    7,
+		Hash:      "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+		Size:      4,
+		Status:    fileDownloaded,
+		Converted: "a.jpg",
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Errorf("file record=%+v; want %+v", rec, want)
+	}
+	if !isConverted("demo", "a.png") {
+		t.Error("isConverted=false; want true")
+	}
+
+	// Files recorded at the same time are all kept.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recordLargest("demo", fmt.Sprint(i, ".jpg"), "large.jpg")
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if largest, _ := largestVariant("demo", fmt.Sprint(i, ".jpg")); largest != "large.jpg" {
+			t.Errorf("largest version of %d.jpg=%q; want large.jpg", i, largest)
+		}
+	}
+}
+
+func TestReparseTypes(t *testing.T) {
+	old := parserChanges
+	parserChanges = map[int][]string{2: {"video"}, 3: {"photo", "video"}}
+	defer func() { parserChanges = old }()
+
+	tests := []struct {
+		from, to int
+		types    []string
+		all      bool
+	}{
+		{3, 3, nil, false},
+		{2, 3, []string{"photo", "video"}, false},
+		{1, 3, []string{"video", "photo"}, false},
+		{1, 2, []string{"video"}, false},
+		// Version 1 isn't listed, so it changed everything.
+		{0, 3, nil, true},
+		{3, 4, nil, true},
+	}
+
+	for i, test := range tests {
+		types, all := reparseTypes(test.from, test.to)
+		if !reflect.DeepEqual(types, test.types) || all != test.all {
+			t.Errorf("#%d: reparseTypes(%d, %d)=%v, %t; want %v, %t", i, test.from, test.to, types, all, test.types, test.all)
+		}
+	}
+}
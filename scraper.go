@@ -5,9 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -27,7 +28,6 @@ var (
 	inlineSearch   = regexp.MustCompile(`(http:\/\/\d{2}\.media\.tumblr\.com\/\w{32}\/tumblr_inline_\w+\.\w+)`) // FIXME: Possibly buggy/unoptimized.
 	videoSearch    = regexp.MustCompile(`"hdUrl":".*(tumblr_\w+)"`)                                           // fuck it
 	altVideoSearch = regexp.MustCompile(`source src=".*(tumblr_\w+)(?:\/\d+)?" type`)
-	gfycatSearch   = regexp.MustCompile(`href="https?:\/\/(?:www\.)?gfycat\.com\/(\w+)`)
 )
 
 // PostParseMap maps tumblr post types to functions that search those
@@ -42,34 +42,33 @@ var PostParseMap = map[string]func(Post) []File{
 // TrimJS trims the javascript response received from Tumblr.
 // The response starts with "var tumblr_api_read = " and ends with ";".
 // We need to remove these to parse the response as JSON.
+// Responses that are cut off or aren't javascript are returned as they
+// are, and fail to parse.
 func TrimJS(c []byte) []byte {
-	// The length of "var tumblr_api_read = " is 22.
-	return c[22 : len(c)-2]
+	c = bytes.TrimSpace(c)
+	c = bytes.TrimPrefix(c, []byte("var tumblr_api_read = "))
+	return bytes.TrimSuffix(c, []byte(";"))
 }
 
 func parsePhotoPost(post Post) (files []File) {
 	var id string
 	if !cfg.IgnorePhotos {
 		if len(post.Photos) == 0 {
-			f := newFile(post.PhotoURL)
-			files = append(files, f)
-			id = f.Filename
+			files = append(files, choosePhoto(post, photoSizeStrategy))
+			id = path.Base(post.PhotoURL)
 		} else {
 			for _, photo := range post.Photos {
-				f := newFile(photo.PhotoURL)
-				files = append(files, f)
-				id = f.Filename
+				files = append(files, choosePhoto(photo, photoSizeStrategy))
+				id = path.Base(photo.PhotoURL)
 			}
 		}
 	}
 
-	if !cfg.IgnoreVideos {
-		var slug string
-		if len(id) > 26 {
-			slug = id[:26]
-		}
-		files = append(files, getGfycatFiles(post.PhotoCaption, slug)...)
+	var slug string
+	if len(id) > 26 {
+		slug = id[:26]
 	}
+	files = append(files, findLinks(post.PhotoCaption, slug)...)
 	return
 }
 
@@ -79,6 +78,7 @@ func parseAnswerPost(post Post) (files []File) {
 			files = append(files, newFile(f))
 		}
 	}
+	files = append(files, findLinks(post.Answer, "")...)
 	return
 }
 
@@ -88,6 +88,7 @@ func parseRegularPost(post Post) (files []File) {
 			files = append(files, newFile(f))
 		}
 	}
+	files = append(files, findLinks(post.RegularBody, "")...)
 	return
 }
 
@@ -100,8 +101,10 @@ func parseVideoPost(post Post) (files []File) {
 		}
 
 		// If it's still nil, it means it's another embedded video type, like Youtube, Vine or Pornhub.
-		// In that case, ignore it and move on. Not my problem.
+		// In that case, let the resolvers deal with it.
 		if regextest == nil {
+			files = append(files, findLinks(string(post.Video), "")...)
+			files = append(files, findLinks(post.VideoCaption, "")...)
 			return
 		}
 
@@ -111,6 +114,8 @@ func parseVideoPost(post Post) (files []File) {
 
 		// If there are problems with downloading video, the below part may be the cause.
 		// videoURL = strings.Replace(videoURL, `/480`, ``, -1)
+		// vtt.tumblr.com needs an extension, but the file is saved with
+		// whatever extension matches what gets downloaded.
 		videoURL += ".mp4"
 
 		f := newFile(videoURL)
@@ -120,7 +125,7 @@ func parseVideoPost(post Post) (files []File) {
 		// portion of a tumblr video file.
 		slug := f.Filename[:23]
 
-		files = append(files, getGfycatFiles(post.VideoCaption, slug)...)
+		files = append(files, findLinks(post.VideoCaption, slug)...)
 	}
 	return
 }
@@ -130,10 +135,17 @@ func parseDataForFiles(post Post) (files []File) {
 	if ok {
 		files = fn(post)
 	}
+	nameLinks(files, string(post.ID))
 	return
 }
 
 func makeTumblrURL(u *User, i int) *url.URL {
+	return tumblrURLAt(u, (i-1)*postsPerPage)
+}
+
+// tumblrURLAt returns the URL of the page of posts that starts at the
+// given offset.
+func tumblrURLAt(u *User, offset int) *url.URL {
 
 	base := fmt.Sprintf("https://%s.tumblr.com/api/read/json", u.name)
 
@@ -141,8 +153,8 @@ func makeTumblrURL(u *User, i int) *url.URL {
 	checkFatalError(err, "tumblrURL: ")
 
 	vals := url.Values{}
-	vals.Set("num", "50")
-	vals.Add("start", strconv.Itoa((i-1)*50))
+	vals.Set("num", strconv.Itoa(postsPerPage))
+	vals.Add("start", strconv.Itoa(offset))
 	// vals.Add("type", "photo")
 
 	if u.tag != "" {
@@ -157,11 +169,17 @@ func shouldFinishScraping(lim <-chan time.Time, done <-chan struct{}) bool {
 	select {
 	case <-done:
 		return true
+	case <-stopCtx.Done():
+		return true
 	default:
+		start := time.Now()
 		select {
 		case <-done:
 			return true
+		case <-stopCtx.Done():
+			return true
 		case <-lim:
+			recordLimiterWait(time.Since(start))
 			// We get a value from limiter, and proceed to scrape a page.
 			return false
 		}
@@ -171,13 +189,21 @@ func shouldFinishScraping(lim <-chan time.Time, done <-chan struct{}) bool {
 func scrape(u *User, limiter <-chan time.Time) <-chan File {
 
 	var once sync.Once
-	u.fileChannel = make(chan File, MaxQueueSize)
 
 	go func() {
 
 		done := make(chan struct{})
 		closeDone := func() { close(done) }
-		var i, numPosts int
+		// skips is the number of pages in a row that were skipped.
+		var i, numPosts, skips int
+
+		// A scrape only counts as complete if it walked every page of the
+		// blog without running into bad data. Deleted post detection relies
+		// on this, so we have to be conservative.
+		complete := u.tag == ""
+		// parsed is like complete, but a resumed scrape can still
+		// have parsed the whole blog.
+		parsed := u.tag == ""
 
 		// We need to put all of the following into a function because
 		// Go evaluates params at defer instead of at execution.
@@ -186,51 +212,77 @@ func scrape(u *User, limiter <-chan time.Time) <-chan File {
 			u.finishScraping(i)
 		}()
 
+		// Unfinished scrapes are continued. When the whole blog is
+		// checked, only an unfinished check of the whole blog with the
+		// same parser is.
+		force := cfg.ForceCheck || u.forceCheck
+		var resume *checkpoint
+		if c, ok := loadCheckpoint(u.name); ok && c.Tag == u.tag && (!force || c.Full && c.Parser == parserVersion) {
+			slog.Info("resuming an unfinished scrape", "blog", u.name, "post_id", c.LowWater)
+			resume = &c
+			// Posts the checkpoint covers aren't seen again.
+			complete = false
+		}
+		cursor := newScrapeCursor(resume)
+		cursor.full = force
+		u.Lock()
+		u.cursor = cursor
+		u.Unlock()
+
+		// A full scan finds unfinished posts, and parses every post
+		// again, anyway.
+		if !force && !requeueIncomplete(u, limiter, done) {
+			return
+		}
+		if !force && u.lastPostID != 0 {
+			rec := readBlog(u.name)
+			if rec.ParserVersion < parserVersion && !reparsePosts(u, rec.ParserVersion, limiter, done) {
+				return
+			}
+		}
+
 		for i = 1; ; i++ {
 			if shouldFinishScraping(limiter, done) {
+				if stopping() {
+					u.markInterrupted()
+				}
 				return
 			}
 
-			tumblrURL := makeTumblrURL(u, i)
+			offset := cursor.offset
+			tumblrURL := tumblrURLAt(u, offset)
 
-			showProgress(u.name, "is on page", i, "/", (numPosts/50)+1)
+			showProgress(u.name, "is on page", offset/postsPerPage+1, "/", (numPosts/postsPerPage)+1)
 
-			var resp *http.Response
-			var err error
-			var contents []byte
-
-			for {
-				resp, err = http.Get(tumblrURL.String())
-
-				// XXX: Ugly as shit. This could probably be done better.
-				if err != nil {
-					log.Println("http.Get:", u, err)
-					continue
+			page := fmt.Sprint("page-", offset/postsPerPage+1)
+			blog, skipped, ok := fetchPosts(u, tumblrURL, page)
+			if !ok {
+				return
+			}
+			if skipped {
+				// The rest of the blog is still scraped, and the page
+				// is fetched again in the next session.
+				complete, parsed = false, false
+				u.skipPage()
+				cursor.skip()
+				skips++
+				if skips == maxSkippedPages {
+					slog.Error("too many pages in a row can't be parsed, stopping", "blog", u.name, "pages", skips)
+					u.markInterrupted()
+					return
 				}
-
-				contents, err = ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Println("ReadAll:", u, err,
-						"(", len(contents), "/", resp.ContentLength, ")")
-					continue
+				if numPosts != 0 && cursor.offset >= numPosts {
+					break
 				}
-				err = resp.Body.Close()
-				checkError(err)
-				break
+				continue
 			}
-			atomic.AddUint64(&gStats.bytesOverhead, uint64(len(contents)))
-
-			// This is returned as pure javascript. We need to filter out the variable and the ending semicolon.
-			contents = TrimJS(contents)
-
-			var blog TumbleLog
-			err = json.Unmarshal(contents, &blog)
-			if err != nil {
-				// Goddamnit tumblr, make a consistent API that doesn't
-				// fucking return strings AND booleans in the same field
-
-				ioutil.WriteFile("json_error.txt", contents, 0644)
-				log.Println("Unmarshal:", err)
+			skips = 0
+			u.recordSuccess()
+			if len(blog.bad) != 0 {
+				// The bad posts weren't seen, so they can't tell
+				// which posts were deleted.
+				complete, parsed = false, false
+				quarantinePosts(u, blog.bad, page, offset)
 			}
 
 			numPosts = blog.TotalPosts
@@ -239,29 +291,305 @@ func scrape(u *User, limiter <-chan time.Time) <-chan File {
 
 			defer u.scrapeWg.Done()
 
-			for _, post := range blog.Posts {
+			ids := make([]int64, len(blog.Posts))
+			for j, post := range blog.Posts {
 				id, err := post.ID.Int64()
 				if err != nil {
-					log.Println(err)
+					slog.Warn("bad post ID", "blog", u.name, "post_id", post.ID, "err", err)
 				}
-
+				ids[j] = id
 				u.updateHighestPost(id)
+			}
+			if len(ids) != 0 {
+				u.pastSkipped(ids[0])
+			}
 
-				if !cfg.ForceCheck && id <= u.lastPostID {
-					once.Do(closeDone)
-					return
+			keep, jumped := cursor.next(ids)
+			var queued []Post
+			caughtUp := false
+			for _, j := range keep {
+				if !force && ids[j] <= u.lastPostID {
+					caughtUp = true
+					break
+				}
+				if u.hasSeen(ids[j]) {
+					// Queued again before the scrape started.
+					continue
 				}
 
-				u.Queue(post)
+				u.Queue(blog.Posts[j], offset)
+				queued = append(queued, blog.Posts[j])
 
 			} // Done searching all posts on a page
+			catalogPosts(u.name, queued)
+			if caughtUp {
+				once.Do(closeDone)
+				return
+			}
+
+			if jumped {
+				continue
+			}
 
-			if len(blog.Posts) < 50 {
+			if blog.pageSize() < postsPerPage {
+				u.scrapeComplete = complete
+				u.scrapeParsed = parsed && cursor.parser() == parserVersion
 				break
 			}
 
+			u.saveCheckpoint()
+
 		} // loop that searches blog, page by page
 
 	}() // Function that asynchronously adds all downloadables from a blog to a queue
 	return u.fileChannel
 }
+
+// maxPageAttempts is the number of times a page that can't be parsed is
+// fetched, before it's skipped.
+const maxPageAttempts = 3
+
+// maxSkippedPages is the number of pages in a row that can be skipped
+// before the scrape of the blog is given up on, like it was interrupted.
+const maxSkippedPages = 5
+
+// pageRetryDelay is how long to wait before fetching a page that couldn't
+// be parsed again. It's longer after each attempt.
+var pageRetryDelay = 5 * time.Second
+
+// fetchPosts gets a page of posts and decodes it. Pages that can't be
+// parsed are quarantined under the given name, and fetched again. If
+// they still can't be parsed, skipped is set, so the caller can move on
+// to the next page and leave this one for the next session. It
+// returns false if the scrape should stop.
+func fetchPosts(u *User, tumblrURL *url.URL, name string) (blog TumbleLog, skipped, ok bool) {
+	for attempt := 1; ; attempt++ {
+		contents, ok := fetchPage(u, tumblrURL)
+		if !ok {
+			return TumbleLog{}, false, false
+		}
+
+		// This is returned as pure javascript. We need to filter out the variable and the ending semicolon.
+		err := json.Unmarshal(TrimJS(contents), &blog)
+		if err == nil {
+			return blog, false, true
+		}
+
+		saved := quarantine(u.name, name, contents)
+		slog.Error("can't parse a page of posts", "blog", u.name, "url", tumblrURL, "attempt", attempt, "saved", saved, "err", err)
+		u.recordError(err)
+		if attempt == maxPageAttempts {
+			failures.add(failure{Blog: u.name, Cause: causeParse, URL: tumblrURL.String(), Error: err.Error(), Saved: saved})
+			return TumbleLog{}, true, true
+		}
+
+		reqStats.recordRetry("scrape")
+		select {
+		case <-time.After(time.Duration(attempt) * pageRetryDelay):
+		case <-stopCtx.Done():
+			u.markInterrupted()
+			return TumbleLog{}, false, false
+		}
+	}
+}
+
+// fetchPage gets a page of posts. Requests are retried until they work. Error
+// responses from tumblr are retried maxPageAttempts times, and then the blog is
+// stopped like it was interrupted. It returns false if the downloader is
+// stopping, or the page can't be fetched.
+func fetchPage(u *User, tumblrURL *url.URL) ([]byte, bool) {
+	var resp *http.Response
+	var contents []byte
+	statusErrors := 0
+
+	req, err := http.NewRequestWithContext(stopCtx, "GET", tumblrURL.String(), nil)
+	if err != nil {
+		slog.Error("bad scrape request", "blog", u.name, "url", tumblrURL, "err", err)
+		u.recordError(err)
+		recordFailure(u.name, causeScrape, tumblrURL.String(), err)
+		return nil, false
+	}
+
+	for attempt := 1; ; attempt++ {
+		if stopping() {
+			u.markInterrupted()
+			return nil, false
+		}
+		resp, err = http.DefaultClient.Do(req)
+
+		// XXX: Ugly as shit. This could probably be done better.
+		if err != nil {
+			slog.Warn("scrape request failed", "blog", u.name, "url", tumblrURL, "attempt", attempt, "err", err)
+			u.recordError(err)
+			reqStats.recordRetry("scrape")
+			continue
+		}
+		reqStats.recordStatus("scrape", resp.StatusCode)
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			// An error page isn't a page of posts.
+			resp.Body.Close()
+			statusErrors++
+			err = fmt.Errorf("HTTP status %s", resp.Status)
+			slog.Warn("scrape request failed", "blog", u.name, "url", tumblrURL, "attempt", statusErrors, "err", err)
+			u.recordError(err)
+			if statusErrors == maxPageAttempts {
+				recordFailure(u.name, causeScrape, tumblrURL.String(), err)
+				u.markInterrupted()
+				return nil, false
+			}
+
+			reqStats.recordRetry("scrape")
+			select {
+			case <-time.After(time.Duration(statusErrors) * pageRetryDelay):
+			case <-stopCtx.Done():
+				u.markInterrupted()
+				return nil, false
+			}
+			continue
+		}
+
+		contents, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			slog.Warn("scrape response cut off", "blog", u.name, "url", tumblrURL, "attempt", attempt,
+				"bytes", len(contents), "expected", resp.ContentLength, "err", err)
+			u.recordError(err)
+			reqStats.recordRetry("scrape")
+			continue
+		}
+		err = resp.Body.Close()
+		checkError(err)
+		break
+	}
+	atomic.AddUint64(&gStats.bytesOverhead, uint64(len(contents)))
+	return contents, true
+}
+
+// reparsePosts walks the posts of the types whose parsing changed after
+// parser version from, and queues the ones that weren't seen yet. Files
+// that are on disk already are skipped as usual. It returns false if
+// the scrape should stop.
+func reparsePosts(u *User, from int, limiter <-chan time.Time, done <-chan struct{}) bool {
+	types, all := reparseTypes(from, parserVersion)
+	if all {
+		// The blog is checked in full instead.
+		return true
+	}
+	slog.Info("parsing posts again", "blog", u.name, "types", types)
+
+	// Like a full scrape, only a walk of the whole blog counts.
+	parsed := u.tag == ""
+	for _, typ := range types {
+		for offset := 0; ; offset += postsPerPage {
+			if shouldFinishScraping(limiter, done) {
+				if stopping() {
+					u.markInterrupted()
+				}
+				return false
+			}
+
+			tumblrURL := tumblrURLAt(u, offset)
+			vals := tumblrURL.Query()
+			vals.Set("type", typ)
+			tumblrURL.RawQuery = vals.Encode()
+
+			page := fmt.Sprint(typ, "-page-", offset/postsPerPage+1)
+			blog, skipped, ok := fetchPosts(u, tumblrURL, page)
+			if !ok {
+				return false
+			}
+			if skipped {
+				// The rest of the type is left for the next session.
+				parsed = false
+				break
+			}
+			if len(blog.bad) != 0 {
+				parsed = false
+				quarantinePosts(u, blog.bad, page, -1)
+			}
+
+			var queued []Post
+			for _, post := range blog.Posts {
+				if id, _ := post.ID.Int64(); u.hasSeen(id) {
+					continue
+				}
+				u.Queue(post, -1)
+				queued = append(queued, post)
+			}
+			catalogPosts(u.name, queued)
+
+			if blog.pageSize() < postsPerPage {
+				break
+			}
+		}
+	}
+
+	u.Lock()
+	u.reparsed = parsed
+	u.Unlock()
+	return true
+}
+
+// tumblrPostURL returns the URL of a single post.
+func tumblrPostURL(u *User, id int64) *url.URL {
+	tumblrURL := tumblrURLAt(u, 0)
+	vals := url.Values{}
+	vals.Set("id", strconv.FormatInt(id, 10))
+	tumblrURL.RawQuery = vals.Encode()
+	return tumblrURL
+}
+
+// requeueIncomplete queues the posts that weren't fully downloaded in
+// earlier sessions again, one request each. Posts that are gone are
+// marked complete, since there's nothing left to download. It returns
+// false if the scrape should stop.
+func requeueIncomplete(u *User, limiter <-chan time.Time, done <-chan struct{}) bool {
+	ids := incompletePosts(u.name)
+	if len(ids) == 0 {
+		return true
+	}
+	slog.Info("queueing unfinished posts again", "blog", u.name, "posts", len(ids))
+
+	for _, id := range ids {
+		if shouldFinishScraping(limiter, done) {
+			if stopping() {
+				u.markInterrupted()
+			}
+			return false
+		}
+
+		contents, ok := fetchPage(u, tumblrPostURL(u, id))
+		if !ok {
+			return false
+		}
+
+		name := fmt.Sprint("post-", id)
+		var blog TumbleLog
+		if err := json.Unmarshal(TrimJS(contents), &blog); err != nil {
+			saved := quarantine(u.name, name, contents)
+			slog.Error("can't parse a post", "blog", u.name, "post_id", id, "saved", saved, "err", err)
+			u.recordError(err)
+			failures.add(failure{Blog: u.name, Cause: causeParse, URL: tumblrPostURL(u, id).String(), Error: err.Error(), Saved: saved})
+			u.progress.add(id, -1, 0)
+			u.progress.fail(id)
+			continue
+		}
+		quarantinePosts(u, blog.bad, "", -1)
+
+		found := false
+		for _, post := range blog.Posts {
+			if postID, _ := post.ID.Int64(); postID == id {
+				u.Queue(post, -1)
+				catalogPosts(u.name, []Post{post})
+				found = true
+			}
+		}
+		for _, b := range blog.bad {
+			found = found || b.ID == id
+		}
+		if !found {
+			u.progress.add(id, -1, 0)
+		}
+	}
+	return true
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
 	"testing"
 	"time"
 )
@@ -148,3 +155,163 @@ func TestMakeTumblrURL(t *testing.T) {
 		}
 	}
 }
+
+func TestTrimJS(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"var tumblr_api_read = {\"posts\":[]};\n", `{"posts":[]}`},
+		{"var tumblr_api_read = {};", "{}"},
+		{"", ""},
+		{"<html>", "<html>"},
+	}
+
+	for i, test := range tests {
+		if out := string(TrimJS([]byte(test.in))); out != test.out {
+			t.Errorf("#%d: TrimJS(%q)=%q; want %q", i, test.in, out, test.out)
+		}
+	}
+}
+
+func TestTumbleLogUnmarshal(t *testing.T) {
+	page := `{"posts-total": "120", "posts": [
+		{"id": 3, "type": "photo", "photo-caption": false, "photo-url-1280": "https://x/3.jpg", "unix-timestamp": "1500000000"},
+		{"id": "2", "type": "regular", "regular-body": 42, "tags": ["a"], "unix-timestamp": 1400000000},
+		{"id": "1", "type": "photo", "photos": "none"},
+		{"id": false, "type": "answer"}
+	]}`
+
+	var blog TumbleLog
+	if err := json.Unmarshal([]byte(page), &blog); err != nil {
+		t.Fatal(err)
+	}
+	if blog.TotalPosts != 120 || blog.pageSize() != 4 {
+		t.Errorf("total=%d, page size=%d; want 120, 4", blog.TotalPosts, blog.pageSize())
+	}
+
+	want := []Post{
+		{ID: "3", Type: "photo", PhotoURL: "https://x/3.jpg", UnixTimestamp: 1500000000},
+		{ID: "2", Type: "regular", RegularBody: "42", Tags: []string{"a"}, UnixTimestamp: 1400000000},
+	}
+	if len(blog.Posts) != len(want) {
+		t.Fatalf("decoded %d posts; want %d", len(blog.Posts), len(want))
+	}
+	for i, p := range blog.Posts {
+		w := want[i]
+		if p.ID != w.ID || p.Type != w.Type || p.PhotoURL != w.PhotoURL || p.PhotoCaption != w.PhotoCaption ||
+			p.RegularBody != w.RegularBody || p.UnixTimestamp != w.UnixTimestamp || len(p.Tags) != len(w.Tags) {
+			t.Errorf("#%d: decoded %+v; want %+v", i, p, w)
+		}
+	}
+
+	if len(blog.bad) != 2 || blog.bad[0].ID != 1 || blog.bad[1].ID != 0 || blog.bad[0].Err == nil {
+		t.Errorf("bad posts=%+v; want post 1 and one without an ID", blog.bad)
+	}
+
+	if err := json.Unmarshal([]byte(`{"posts": {}}`), &blog); err == nil {
+		t.Error("a page without a list of posts was decoded")
+	}
+}
+
+func TestFetchPosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, oldDelay := cfg.DownloadDirectory, pageRetryDelay
+	cfg.DownloadDirectory, pageRetryDelay = dir, time.Millisecond
+	defer func() { cfg.DownloadDirectory, pageRetryDelay = oldDir, oldDelay }()
+
+	tests := []struct {
+		name      string
+		responses []string
+		skipped   bool
+	}{
+		{"works", []string{`var tumblr_api_read = {"posts": [{"id": 1}]};`}, false},
+		{"retried", []string{"var tumblr_api_read = {\"po", `var tumblr_api_read = {"posts": [{"id": 1}]};`}, false},
+		{"broken", []string{"<html>", "<html>", "<html>"}, true},
+	}
+
+	for i, test := range tests {
+		n := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(test.responses[n]))
+			n++
+		}))
+		tumblrURL, _ := url.Parse(ts.URL)
+
+		u := &User{name: test.name}
+		blog, skipped, ok := fetchPosts(u, tumblrURL, "page-1")
+		ts.Close()
+
+		if !ok || skipped != test.skipped || n != len(test.responses) {
+			t.Errorf("#%d: %s: ok=%t skipped=%t after %d requests; want skipped=%t after %d", i, test.name, ok, skipped, n, test.skipped, len(test.responses))
+		}
+		if !skipped && len(blog.Posts) != 1 {
+			t.Errorf("#%d: %s: got %d posts; want 1", i, test.name, len(blog.Posts))
+		}
+		if u.interrupted {
+			t.Errorf("#%d: %s: the blog is stopped", i, test.name)
+		}
+
+		_, err := os.Stat(path.Join(dir, quarantineDirName, test.name, "page-1.json"))
+		if quarantined := err == nil; quarantined != (len(test.responses) > 1) {
+			t.Errorf("#%d: %s: quarantined=%t", i, test.name, quarantined)
+		}
+	}
+
+	var found bool
+	for _, f := range failures.endSession(nil) {
+		found = found || f.Blog == "broken" && f.Cause == causeParse && f.Saved != ""
+	}
+	if !found {
+		t.Error("the page that couldn't be parsed isn't in the error report")
+	}
+
+	dryRun = true
+	defer func() { dryRun = false }()
+	if saved := quarantine("dry", "page-1", []byte("<html>")); saved != "" {
+		t.Errorf("quarantined %s in a dry run", saved)
+	}
+	if _, err := os.Stat(path.Join(dir, quarantineDirName, "dry")); err == nil {
+		t.Error("a dry run made a quarantine folder")
+	}
+}
+
+func TestFetchPageStatus(t *testing.T) {
+	oldDelay := pageRetryDelay
+	pageRetryDelay = time.Millisecond
+	defer func() { pageRetryDelay = oldDelay }()
+
+	tests := []struct {
+		statuses []int
+		ok       bool
+	}{
+		{[]int{http.StatusOK}, true},
+		{[]int{http.StatusServiceUnavailable, http.StatusOK}, true},
+		{[]int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}, false},
+	}
+
+	for i, test := range tests {
+		n := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.statuses[n])
+			w.Write([]byte("<html>"))
+			n++
+		}))
+		tumblrURL, _ := url.Parse(ts.URL)
+
+		u := &User{name: "demo"}
+		_, ok := fetchPage(u, tumblrURL)
+		ts.Close()
+
+		if ok != test.ok || n != len(test.statuses) {
+			t.Errorf("#%d: ok=%t after %d requests; want %t after %d", i, ok, n, test.ok, len(test.statuses))
+		}
+		if u.interrupted == test.ok {
+			t.Errorf("#%d: interrupted=%t; want %t", i, u.interrupted, !test.ok)
+		}
+	}
+	failures.endSession(nil)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const searchUsage = `Usage: tumblr-downloader search [flags] <query>
+
+Finds scraped posts in the catalog, with the files downloaded from them.
+The catalog has to be enabled in the config.
+
+A query is made of words, which all have to be in a post's caption, text,
+answer or tags. "Quoted words" have to be next to each other, and OR
+between two words finds posts with either. These narrow a search down:
+
+  blog:<name>     posts from a blog
+  tag:<tag>       posts with a tag
+  type:<type>     posts of a type, like photo, video or answer
+  after:<date>    posts from this date on, like 2018, 2018-06 or 2018-06-30
+  before:<date>   posts from before this date
+
+For example: blog:foo tag:landscape sunset after:2018
+
+Flags:
+`
+
+// A postSearch is a parsed search query.
+type postSearch struct {
+	Blogs, Tags, Types []string
+	After, Before      time.Time
+	// Match is the full-text part of the query, in FTS5 syntax.
+	Match string
+}
+
+// A searchResult is a post found by a search, with the paths of the
+// files downloaded from it.
+type searchResult struct {
+	Blog   string    `json:"blog"`
+	PostID int64     `json:"post_id"`
+	Type   string    `json:"type"`
+	Tags   []string  `json:"tags"`
+	Text   string    `json:"text"`
+	Posted time.Time `json:"posted"`
+	Paths  []string  `json:"paths"`
+}
+
+// searchTerms splits a query into terms at spaces outside of quotes.
+// quoted tells which terms started with a quote.
+func searchTerms(query string) (terms []string, quoted []bool) {
+	var term []rune
+	inQuote, started := false, false
+	end := func() {
+		if len(term) > 0 || started {
+			terms = append(terms, string(term))
+			quoted = append(quoted, started)
+		}
+		term, started = nil, false
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			if len(term) == 0 && !inQuote {
+				started = true
+			}
+			inQuote = !inQuote
+		case unicode.IsSpace(r) && !inQuote:
+			end()
+		default:
+			term = append(term, r)
+		}
+	}
+	end()
+	return
+}
+
+// parseSearch parses a search query.
+func parseSearch(query string) (postSearch, error) {
+	var s postSearch
+	var match []string
+
+	terms, quoted := searchTerms(query)
+	for i, term := range terms {
+		if quoted[i] {
+			match = append(match, ftsPhrase(term))
+			continue
+		}
+		if term == "OR" {
+			if len(match) > 0 && match[len(match)-1] != "OR" {
+				match = append(match, term)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(term, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			match = append(match, ftsPhrase(term))
+			continue
+		}
+		key, value := strings.ToLower(parts[0]), parts[1]
+
+		var err error
+		switch key {
+		case "blog":
+			s.Blogs = append(s.Blogs, value)
+		case "tag":
+			s.Tags = append(s.Tags, value)
+		case "type":
+			s.Types = append(s.Types, value)
+		case "after":
+			s.After, err = parseDate(value)
+		case "before":
+			s.Before, err = parseDate(value)
+		default:
+			match = append(match, ftsPhrase(term))
+		}
+		if err != nil {
+			return s, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	if len(match) > 0 && match[len(match)-1] == "OR" {
+		match = match[:len(match)-1]
+	}
+	s.Match = strings.Join(match, " ")
+	return s, nil
+}
+
+// ftsPhrase quotes a word or phrase for FTS5, so nothing in it is taken
+// as query syntax.
+func ftsPhrase(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// inList returns an SQL condition matching a column against any of
+// values.
+func inList(column string, values []string) (string, []interface{}) {
+	marks := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		marks[i] = "?"
+		args[i] = v
+	}
+	return column + " IN (" + strings.Join(marks, ", ") + ")", args
+}
+
+// searchPosts finds the posts matching s. Full-text searches return the
+// best matches first, the others the newest posts first.
+func searchPosts(db *sql.DB, s postSearch, limit int) ([]searchResult, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+
+	from := "posts"
+	order := "posts.posted DESC, posts.post_id DESC"
+	if s.Match != "" {
+		from = "posts_text JOIN posts ON posts.id = posts_text.rowid"
+		conds = append(conds, "posts_text MATCH ?")
+		args = append(args, s.Match)
+		order = "bm25(posts_text), " + order
+	}
+
+	if len(s.Blogs) > 0 {
+		cond, a := inList("posts.blog", s.Blogs)
+		conds, args = append(conds, cond), append(args, a...)
+	}
+	if len(s.Types) > 0 {
+		cond, a := inList("posts.type", s.Types)
+		conds, args = append(conds, cond), append(args, a...)
+	}
+	// Every tag has to be on the post.
+	for _, tag := range s.Tags {
+		conds = append(conds, "posts.id IN (SELECT post_id FROM post_tags WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	if !s.After.IsZero() {
+		conds = append(conds, "posts.posted >= ?")
+		args = append(args, s.After.Unix())
+	}
+	if !s.Before.IsZero() {
+		conds = append(conds, "posts.posted < ?")
+		args = append(args, s.Before.Unix())
+	}
+
+	query := `SELECT posts.blog, posts.post_id, posts.type, posts.tags,
+		posts.caption, posts.body, posts.answer, posts.posted
+		FROM ` + from + ` WHERE ` + strings.Join(conds, " AND ") + ` ORDER BY ` + order
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	results, err := scanSearchResults(db, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// The catalog has a single connection, so the paths are looked up
+	// once the posts have been read.
+	for i := range results {
+		r := &results[i]
+		r.Paths, err = postPaths(db, r.Blog, r.PostID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func scanSearchResults(db *sql.DB, query string, args []interface{}) ([]searchResult, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []searchResult
+	for rows.Next() {
+		var r searchResult
+		var posted int64
+		var tags, caption, body, answer string
+		err = rows.Scan(&r.Blog, &r.PostID, &r.Type, &tags, &caption, &body, &answer, &posted)
+		if err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			r.Tags = strings.Split(tags, ", ")
+		}
+		var text []string
+		for _, t := range []string{caption, body, answer} {
+			if t != "" {
+				text = append(text, t)
+			}
+		}
+		r.Text = strings.Join(text, " ")
+		r.Posted = time.Unix(posted, 0).UTC()
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// postPaths returns where the files of a post were downloaded to.
+func postPaths(db *sql.DB, blog string, id int64) ([]string, error) {
+	rows, err := db.Query(`SELECT path FROM files WHERE blog = ? AND post_id = ? ORDER BY name`, blog, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := []string{}
+	for rows.Next() {
+		var p string
+		if err = rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// runSearchCommand runs the search subcommand, and returns the exit code.
+func runSearchCommand(args []string) int {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, searchUsage)
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "text", "Output format: text or json.")
+	limit := flags.Int("limit", 50, "The most posts to show. 0 shows all of them.")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	s, err := parseSearch(strings.Join(flags.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "search:", err)
+		return 2
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "search: unknown format %q\n", *format)
+		return 2
+	}
+
+	if !cfg.Catalog.Enabled && !fileExists(catalogPath()) {
+		fmt.Fprintln(os.Stderr, "search: the catalog isn't enabled in", configFile)
+		return 1
+	}
+	db, err := openCatalog(catalogPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "search:", err)
+		return 1
+	}
+	defer db.Close()
+
+	results, err := searchPosts(db, s, *limit)
+	if err == nil {
+		if *format == "json" {
+			err = writeSearchJSON(os.Stdout, results)
+		} else {
+			writeSearchText(os.Stdout, results)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "search:", err)
+		return 1
+	}
+	return 0
+}
+
+// snippetLength is how much of a post's text is shown in results.
+const snippetLength = 100
+
+func writeSearchText(w io.Writer, results []searchResult) {
+	for i, r := range results {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s %d  %s  %s", r.Blog, r.PostID, r.Posted.Local().Format("2006-01-02"), r.Type)
+		if len(r.Tags) > 0 {
+			fmt.Fprintf(w, "  #%s", strings.Join(r.Tags, " #"))
+		}
+		fmt.Fprintln(w)
+
+		if text := []rune(r.Text); len(text) > snippetLength {
+			fmt.Fprintf(w, "  %s...\n", string(text[:snippetLength]))
+		} else if len(text) > 0 {
+			fmt.Fprintf(w, "  %s\n", r.Text)
+		}
+		for _, p := range r.Paths {
+			fmt.Fprintf(w, "    %s\n", p)
+		}
+	}
+	fmt.Fprintf(w, "\n%d posts found.\n", len(results))
+}
+
+func writeSearchJSON(w io.Writer, results []searchResult) error {
+	if results == nil {
+		results = []searchResult{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
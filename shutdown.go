@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// stopCtx is cancelled when the downloader is asked to stop.
+	// Scrapers stop, and no new downloads are started.
+	stopCtx, stop = context.WithCancel(context.Background())
+
+	// abortCtx is cancelled when downloads that are still running are
+	// given up on, shutdown_timeout after stopCtx.
+	abortCtx, abort = context.WithCancel(context.Background())
+
+	stopSignal   os.Signal
+	stopSignalMu sync.Mutex
+)
+
+// setupSignalInfo handles signals. SIGQUIT prints the current status,
+// and SIGHUP reloads the config and the blog list. SIGINT and SIGTERM
+// stop the downloader gracefully, and a second one exits right away.
+func setupSignalInfo() {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	go func() {
+		for s := range sigChan {
+			switch s {
+			case syscall.SIGQUIT:
+				gStats.PrintStatus()
+				continue
+			case syscall.SIGHUP:
+				// Outside of server mode, there's nothing to reload,
+				// so SIGHUP stops the downloader like it usually does.
+				if config().ServerMode {
+					slog.Info("reloading the config and the blog list", "signal", s.String())
+					requestReload()
+					continue
+				}
+			}
+
+			if stopCtx.Err() != nil {
+				slog.Warn("stopping again, exiting now", "signal", s.String())
+				os.Exit(signalExitCode(s))
+			}
+
+			slog.Warn("stopping, finishing downloads that already started. Press Ctrl+C again to exit now", "signal", s.String())
+			shutdown(s)
+		}
+	}()
+}
+
+// shutdown stops the downloader because of the given signal. Running
+// downloads get shutdown_timeout to finish before they're cancelled.
+func shutdown(s os.Signal) {
+	stopSignalMu.Lock()
+	stopSignal = s
+	stopSignalMu.Unlock()
+
+	stop()
+	time.AfterFunc(config().ShutdownTimeout.Duration, func() {
+		slog.Warn("shutdown timeout reached, cancelling downloads")
+		abort()
+	})
+}
+
+// stopping reports if the downloader is shutting down.
+func stopping() bool {
+	return stopCtx.Err() != nil
+}
+
+// exitCode returns the code the downloader should exit with. It's the
+// code of the last session, unless the downloader was stopped by a
+// signal.
+func exitCode() int {
+	stopSignalMu.Lock()
+	defer stopSignalMu.Unlock()
+	if stopSignal == nil {
+		return failures.lastCode()
+	}
+	return signalExitCode(stopSignal)
+}
+
+// signalExitCode follows the shell convention of 128 plus the number
+// of the signal.
+func signalExitCode(s os.Signal) int {
+	if n, ok := s.(syscall.Signal); ok {
+		return 128 + int(n)
+	}
+	return 1
+}
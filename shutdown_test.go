@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalExitCode(t *testing.T) {
+	tests := []struct {
+		sig  os.Signal
+		code int
+	}{
+		{syscall.SIGINT, 130},
+		{syscall.SIGTERM, 143},
+	}
+
+	for i, test := range tests {
+		if code := signalExitCode(test.sig); code != test.code {
+			t.Errorf("#%d: signalExitCode(%s)=%d; want %d", i, test.sig, code, test.code)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "tumblr_abc_1280.jpg")
+	if err := writeFile(p, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil || string(data) != "data" {
+		t.Errorf("writeFile wrote %q, %v; want %q", data, err, "data")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("writeFile left %d files behind; want 1", len(files))
+	}
+}
+
+func TestDiscardFile(t *testing.T) {
+	u := &User{name: "demo"}
+	f := File{User: u, Filename: "tumblr_discard_1280.jpg"}
+	if FileTracker.Add(f.Filename, f.path()) {
+		t.Fatal("file already tracked")
+	}
+
+	waited := make(chan bool)
+	go func() { waited <- FileTracker.WaitForDownload(f.Filename) }()
+
+	u.downloadWg.Add(1)
+	f.discard()
+	u.downloadWg.Wait()
+
+	select {
+	case ok := <-waited:
+		if ok {
+			t.Error("WaitForDownload returned true for a discarded file")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForDownload didn't return after the file was discarded")
+	}
+
+	if !u.interrupted {
+		t.Error("user not marked as interrupted")
+	}
+	if FileTracker.Add(f.Filename, f.path()) {
+		t.Error("discarded file is still tracked")
+	}
+	FileTracker.Discard(f.Filename, f.path())
+}
+
+func TestDiscardOtherBlogsFile(t *testing.T) {
+	u, other := &User{name: "demo"}, &User{name: "other"}
+	f := File{User: u, Filename: "tumblr_shared_1280.jpg"}
+	g := File{User: other, Filename: f.Filename}
+	if FileTracker.Add(g.Filename, g.path()) {
+		t.Fatal("file already tracked")
+	}
+	defer FileTracker.Discard(g.Filename, g.path())
+
+	// demo gives up on the file before it registered it.
+	u.downloadWg.Add(1)
+	f.discard()
+	u.downloadWg.Wait()
+
+	if p := FileTracker.Path(f.Filename); p != g.path() {
+		t.Errorf("file tracked at %q after another blog discarded it; want %q", p, g.path())
+	}
+}
+
+func TestLinkMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The file is tracked, but gone from disk.
+	name := "tumblr_gone_1280.jpg"
+	FileTracker.Signal(name, path.Join(dir, "demo", name))
+	defer func() {
+		FileTracker.Lock()
+		delete(FileTracker.m, fileStem(name))
+		FileTracker.Unlock()
+	}()
+
+	if _, err := FileTracker.Link(name, path.Join(dir, "other", name)); err == nil {
+		t.Error("Link of a missing file succeeded")
+	}
+	// The tracker isn't left locked.
+	if p := FileTracker.Path(name); p != path.Join(dir, "demo", name) {
+		t.Errorf("file tracked at %q", p)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// mediaExtensions maps the content types we know how to name to the
+// extension files of that type get.
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"image/bmp":  ".bmp",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"audio/mpeg": ".mp3",
+	"audio/mp4":  ".m4a",
+	"audio/ogg":  ".ogg",
+	"audio/wave": ".wav",
+}
+
+// sniffContentType figures out the type of a downloaded file. The magic
+// bytes at the start of the file win over the Content-Type header,
+// since tumblr doesn't always tell the truth.
+func sniffContentType(header string, data []byte) string {
+	// http.DetectContentType doesn't know about AVIF yet.
+	if len(data) >= 12 && bytes.Equal(data[4:12], []byte("ftypavif")) {
+		return "image/avif"
+	}
+
+	sniffed := http.DetectContentType(data)
+	if i := strings.Index(sniffed, ";"); i != -1 {
+		sniffed = sniffed[:i]
+	}
+	if _, ok := mediaExtensions[sniffed]; ok {
+		return sniffed
+	}
+
+	t, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		if _, ok := mediaExtensions[t]; ok {
+			return t
+		}
+	}
+	return ""
+}
+
+// fixExtension gives name the extension that matches contentType.
+// Wrong media extensions are replaced, and missing ones are appended.
+// Unknown types leave the name alone.
+func fixExtension(name, contentType string) string {
+	want, ok := mediaExtensions[contentType]
+	if !ok {
+		return name
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	if ext == want || (ext == ".jpeg" && want == ".jpg") {
+		return name
+	}
+
+	if ext == ".gifv" || isMediaExtension(ext) {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	return name + want
+}
+
+func isMediaExtension(ext string) bool {
+	if ext == ".jpeg" {
+		return true
+	}
+	for _, e := range mediaExtensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// fileStem returns a filename without its extension. Files with the
+// same stem are considered to be the same file, so a file saved with
+// a corrected extension is still recognized on the next run.
+func fileStem(name string) string {
+	ext := path.Ext(name)
+	if ext == ".gifv" || isMediaExtension(strings.ToLower(ext)) {
+		return strings.TrimSuffix(name, ext)
+	}
+	return name
+}
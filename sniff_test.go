@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestSniffContentType(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		header string
+		data   string
+		result string
+	}{
+		{"image/jpeg", "\xFF\xD8\xFFrest of a jpeg", "image/jpeg"},
+		{"image/jpeg", "RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"image/png", "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00", "image/avif"},
+		{"", "GIF89a", "image/gif"},
+		{"video/mp4", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom", "video/mp4"},
+		{"image/webp; charset=binary", "not recognizable", "image/webp"},
+		{"text/html", "<html></html>", ""},
+	}
+
+	for i, test := range tests {
+		result := sniffContentType(test.header, []byte(test.data))
+		if result != test.result {
+			t.Errorf("#%d: sniffContentType(%q)=%q; want %q", i, test.header, result, test.result)
+		}
+	}
+}
+
+func TestFixExtension(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name, contentType, result string
+	}{
+		{"tumblr_abc_1280.jpg", "image/jpeg", "tumblr_abc_1280.jpg"},
+		{"tumblr_abc_1280.jpeg", "image/jpeg", "tumblr_abc_1280.jpeg"},
+		{"tumblr_abc_1280.jpg", "image/webp", "tumblr_abc_1280.webp"},
+		{"tumblr_abc_1280.PNG", "image/avif", "tumblr_abc_1280.avif"},
+		{"tumblr_abc.gifv", "video/mp4", "tumblr_abc.mp4"},
+		{"tumblr_abc", "video/mp4", "tumblr_abc.mp4"},
+		{"some.name", "image/png", "some.name.png"},
+		{"tumblr_abc_1280.jpg", "", "tumblr_abc_1280.jpg"},
+	}
+
+	for i, test := range tests {
+		result := fixExtension(test.name, test.contentType)
+		if result != test.result {
+			t.Errorf("#%d: fixExtension(%s, %s)=%s; want %s", i, test.name, test.contentType, result, test.result)
+		}
+	}
+}
+
+func TestFileStem(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name, result string
+	}{
+		{"tumblr_abc_1280.jpg", "tumblr_abc_1280"},
+		{"tumblr_abc_1280.webp", "tumblr_abc_1280"},
+		{"tumblr_abc.gifv", "tumblr_abc"},
+		{"tumblr_abc", "tumblr_abc"},
+		{"some.name", "some.name"},
+	}
+
+	for i, test := range tests {
+		result := fileStem(test.name)
+		if result != test.result {
+			t.Errorf("#%d: fileStem(%s)=%s; want %s", i, test.name, result, test.result)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
@@ -14,6 +15,14 @@ type GlobalStats struct {
 	filesFound      uint64
 	alreadyExists   uint64
 	hardlinked      uint64
+	// resolverMisses counts linked media that couldn't be found.
+	resolverMisses uint64
+	// upgraded counts photos replaced by a larger version.
+	upgraded uint64
+	// converted counts images converted into another format.
+	converted uint64
+	// hookFailures counts hook commands that failed or timed out.
+	hookFailures uint64
 
 	// bytesDownloaded only counts bytes from files.
 	bytesDownloaded uint64
@@ -33,6 +42,42 @@ type Tracker struct {
 	Blog map[*User]bool
 }
 
+// StatsSnapshot is a copy of the global stats at one point in time.
+// It's what gets sent to anything outside of the downloader that
+// wants to know how things are going.
+type StatsSnapshot struct {
+	FilesDownloaded uint64 `json:"files_downloaded"`
+	FilesFound      uint64 `json:"files_found"`
+	AlreadyExists   uint64 `json:"already_exists"`
+	Hardlinked      uint64 `json:"hardlinked"`
+	ResolverMisses  uint64 `json:"resolver_misses"`
+	Upgraded        uint64 `json:"upgraded"`
+	Converted       uint64 `json:"converted"`
+	HookFailures    uint64 `json:"hook_failures"`
+
+	BytesDownloaded uint64 `json:"bytes_downloaded"`
+	BytesOverhead   uint64 `json:"bytes_overhead"`
+	BytesSaved      uint64 `json:"bytes_saved"`
+
+	Blogs []BlogSnapshot `json:"blogs"`
+}
+
+// BlogSnapshot is a copy of the stats of a single user.
+type BlogSnapshot struct {
+	Name            string `json:"name"`
+	Status          string `json:"status"`
+	Active          bool   `json:"active"`
+	FilesFound      uint64 `json:"files_found"`
+	FilesProcessed  uint64 `json:"files_processed"`
+	FilesDownloaded uint64 `json:"files_downloaded"`
+	Errors          uint64 `json:"errors"`
+	LastError       string `json:"last_error,omitempty"`
+	LastPostID      int64  `json:"last_post_id"`
+	// Interrupted is set if the blog was stopped before it was done,
+	// and will be continued next session.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
 // NewGlobalStats does the initialization for a new set of global stats.
 func NewGlobalStats() *GlobalStats {
 	return &GlobalStats{
@@ -42,39 +87,94 @@ func NewGlobalStats() *GlobalStats {
 	}
 }
 
+// setActive marks a user as scraping/downloading or done. Users that
+// were removed while they were active aren't shown again once they're
+// done.
+func (g *GlobalStats) setActive(u *User, active bool) {
+	removed := !active && blogs.Get(u.name) != u
+
+	g.nowScraping.Lock()
+	if removed {
+		delete(g.nowScraping.Blog, u)
+	} else {
+		g.nowScraping.Blog[u] = active
+	}
+	g.nowScraping.Unlock()
+}
+
+// forget stops showing a user that was removed.
+func (g *GlobalStats) forget(u *User) {
+	g.nowScraping.Lock()
+	delete(g.nowScraping.Blog, u)
+	g.nowScraping.Unlock()
+}
+
+// Snapshot returns a copy of the current stats, including every user
+// that has been active during this session, sorted by name.
+func (g *GlobalStats) Snapshot() StatsSnapshot {
+	s := StatsSnapshot{
+		FilesDownloaded: atomic.LoadUint64(&g.filesDownloaded),
+		FilesFound:      atomic.LoadUint64(&g.filesFound),
+		AlreadyExists:   atomic.LoadUint64(&g.alreadyExists),
+		Hardlinked:      atomic.LoadUint64(&g.hardlinked),
+		ResolverMisses:  atomic.LoadUint64(&g.resolverMisses),
+		Upgraded:        atomic.LoadUint64(&g.upgraded),
+		Converted:       atomic.LoadUint64(&g.converted),
+		HookFailures:    atomic.LoadUint64(&g.hookFailures),
+		BytesDownloaded: atomic.LoadUint64(&g.bytesDownloaded),
+		BytesOverhead:   atomic.LoadUint64(&g.bytesOverhead),
+		BytesSaved:      atomic.LoadUint64(&g.bytesSaved),
+	}
+
+	g.nowScraping.RLock()
+	for u, active := range g.nowScraping.Blog {
+		b := u.Snapshot()
+		b.Active = active
+		s.Blogs = append(s.Blogs, b)
+	}
+	g.nowScraping.RUnlock()
+
+	sort.Slice(s.Blogs, func(i, j int) bool { return s.Blogs[i].Name < s.Blogs[j].Name })
+	return s
+}
+
 // PrintStatus prints the current status of each active user.
 //
 // It currently prints active (scraping and downloading) blogs.
 // Not sure if it should be changed to also include finished blogs.
 func (g *GlobalStats) PrintStatus() {
-	g.nowScraping.RLock()
-	defer g.nowScraping.RUnlock()
+	s := g.Snapshot()
 
-	fmt.Println()
-	// XXX: Optimize this if necessary.
-	for k, v := range g.nowScraping.Blog {
-		if v {
-			fmt.Println(k.GetStatus())
+	w := statusOutput
+
+	fmt.Fprintln(w)
+	for _, b := range s.Blogs {
+		if b.Active {
+			fmt.Fprintln(w, b.String())
 		}
 	}
-	fmt.Println()
-
-	filesFound := atomic.LoadUint64(&g.filesFound)
-	alreadyExists := atomic.LoadUint64(&g.alreadyExists)
-	filesDownloaded := atomic.LoadUint64(&g.filesDownloaded)
-	hardlinked := atomic.LoadUint64(&g.hardlinked)
-	bytesDownloaded := atomic.LoadUint64(&g.bytesDownloaded)
-	bytesOverhead := atomic.LoadUint64(&g.bytesOverhead)
-	bytesSaved := atomic.LoadUint64(&g.bytesSaved)
-
-	fmt.Println(filesDownloaded, "/", filesFound-alreadyExists, "files downloaded.")
-	if alreadyExists != 0 {
-		fmt.Println(alreadyExists, "previously downloaded.")
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, s.FilesDownloaded, "/", s.FilesFound-s.AlreadyExists, "files downloaded.")
+	if s.AlreadyExists != 0 {
+		fmt.Fprintln(w, s.AlreadyExists, "previously downloaded.")
+	}
+	if s.Hardlinked != 0 {
+		fmt.Fprintln(w, s.Hardlinked, "new hardlinks.")
+	}
+	if s.Upgraded != 0 {
+		fmt.Fprintln(w, s.Upgraded, "photos replaced by larger versions.")
+	}
+	if s.Converted != 0 {
+		fmt.Fprintln(w, s.Converted, "images converted.")
+	}
+	if s.HookFailures != 0 {
+		fmt.Fprintln(w, s.HookFailures, "hooks failed.")
 	}
-	if hardlinked != 0 {
-		fmt.Println(hardlinked, "new hardlinks.")
+	if s.ResolverMisses != 0 {
+		fmt.Fprintln(w, s.ResolverMisses, "linked files couldn't be found.")
 	}
-	fmt.Println(byteSize(bytesDownloaded), "of files downloaded during this session.")
-	fmt.Println(byteSize(bytesOverhead), "of data downloaded as JSON overhead.")
-	fmt.Println(byteSize(bytesSaved), "of bandwidth saved due to hardlinking.")
+	fmt.Fprintln(w, byteSize(s.BytesDownloaded), "of files downloaded during this session.")
+	fmt.Fprintln(w, byteSize(s.BytesOverhead), "of data downloaded as JSON overhead.")
+	fmt.Fprintln(w, byteSize(s.BytesSaved), "of bandwidth saved due to hardlinking.")
 }
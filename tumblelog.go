@@ -1,6 +1,12 @@
 package main
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // A Post is reflective of the JSON used in the tumblr API.
 // It contains a PhotoURL, and, optionally, an array of photos.
@@ -14,10 +20,16 @@ type Post struct {
 	// bug on tumblr's end?
 	ID            json.Number `json:",Number"`
 	Type          string
-	PhotoURL      string `json:"photo-url-1280"`
-	Photos        []Post `json:"photos,omitempty"`
-	UnixTimestamp int64  `json:"unix-timestamp"`
-	PhotoCaption  string `json:"photo-caption"`
+	PhotoURL      string   `json:"photo-url-1280"`
+	PhotoURL500   string   `json:"photo-url-500"`
+	PhotoURL400   string   `json:"photo-url-400"`
+	PhotoURL250   string   `json:"photo-url-250"`
+	PhotoURL100   string   `json:"photo-url-100"`
+	PhotoURL75    string   `json:"photo-url-75"`
+	Photos        []Post   `json:"photos,omitempty"`
+	UnixTimestamp int64    `json:"unix-timestamp"`
+	PhotoCaption  string   `json:"photo-caption"`
+	Tags          []string `json:"tags"`
 
 	// for regular posts
 	RegularBody string `json:"regular-body"`
@@ -30,9 +42,163 @@ type Post struct {
 	VideoCaption string          `json:"video-caption"` // For links to outside sites.
 }
 
+// UnmarshalJSON decodes a post. Tumblr sends some fields as strings,
+// numbers or false depending on the post, so those are decoded into
+// whatever they're used as.
+func (p *Post) UnmarshalJSON(data []byte) error {
+	type post Post
+	var v struct {
+		post
+		Type          flexString
+		PhotoURL      flexString `json:"photo-url-1280"`
+		PhotoURL500   flexString `json:"photo-url-500"`
+		PhotoURL400   flexString `json:"photo-url-400"`
+		PhotoURL250   flexString `json:"photo-url-250"`
+		PhotoURL100   flexString `json:"photo-url-100"`
+		PhotoURL75    flexString `json:"photo-url-75"`
+		UnixTimestamp flexInt    `json:"unix-timestamp"`
+		PhotoCaption  flexString `json:"photo-caption"`
+		RegularBody   flexString `json:"regular-body"`
+		Answer        flexString
+		VideoCaption  flexString `json:"video-caption"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*p = Post(v.post)
+	p.Type = string(v.Type)
+	p.PhotoURL = string(v.PhotoURL)
+	p.PhotoURL500 = string(v.PhotoURL500)
+	p.PhotoURL400 = string(v.PhotoURL400)
+	p.PhotoURL250 = string(v.PhotoURL250)
+	p.PhotoURL100 = string(v.PhotoURL100)
+	p.PhotoURL75 = string(v.PhotoURL75)
+	p.UnixTimestamp = int64(v.UnixTimestamp)
+	p.PhotoCaption = string(v.PhotoCaption)
+	p.RegularBody = string(v.RegularBody)
+	p.Answer = string(v.Answer)
+	p.VideoCaption = string(v.VideoCaption)
+	return nil
+}
+
 // A TumbleLog is the outer container for Posts. It is necessary for easier JSON deserialization,
 // even though it's useless in and of itself.
 type TumbleLog struct {
 	Posts      []Post `json:"posts"`
 	TotalPosts int    `json:"posts-total"`
+
+	// bad are the posts that couldn't be decoded. They're left out of
+	// Posts, so the rest of the page can still be used.
+	bad []badPost
+}
+
+// A badPost is a post that couldn't be decoded.
+type badPost struct {
+	// ID is 0 if it couldn't be found either.
+	ID  int64
+	Raw json.RawMessage
+	Err error
+}
+
+// UnmarshalJSON decodes a page of posts. Each post is decoded on its
+// own, so one bad post doesn't lose the whole page.
+func (t *TumbleLog) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Posts      []json.RawMessage `json:"posts"`
+		TotalPosts flexInt           `json:"posts-total"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*t = TumbleLog{TotalPosts: int(v.TotalPosts)}
+	for _, raw := range v.Posts {
+		var p Post
+		if err := json.Unmarshal(raw, &p); err != nil {
+			t.bad = append(t.bad, badPost{ID: rawPostID(raw), Raw: raw, Err: err})
+			continue
+		}
+		t.Posts = append(t.Posts, p)
+	}
+	return nil
+}
+
+// pageSize returns the number of posts on the page, including the ones
+// that couldn't be decoded.
+func (t TumbleLog) pageSize() int {
+	return len(t.Posts) + len(t.bad)
+}
+
+// rawPostID looks for the ID of a post that couldn't be decoded. It
+// returns 0 if there isn't one.
+func rawPostID(raw json.RawMessage) int64 {
+	var v struct {
+		ID flexInt
+	}
+	json.Unmarshal(raw, &v)
+	return int64(v.ID)
+}
+
+// A flexString is a string that tumblr may send as a number, or as a
+// boolean when it's empty.
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	v, err := decodeFlex(data)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*s = flexString(v)
+	case json.Number:
+		*s = flexString(v)
+	case bool, nil:
+		*s = ""
+	default:
+		return fmt.Errorf("can't use %s as a string", data)
+	}
+	return nil
+}
+
+// A flexInt is an integer that tumblr may send as a string, or as a
+// boolean when it's missing.
+type flexInt int64
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	v, err := decodeFlex(data)
+	if err != nil {
+		return err
+	}
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = strings.TrimSpace(v)
+	case json.Number:
+		s = string(v)
+	case bool, nil:
+	default:
+		return fmt.Errorf("can't use %s as a number", data)
+	}
+	if s == "" {
+		*n = 0
+		return nil
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("can't use %s as a number", data)
+	}
+	*n = flexInt(i)
+	return nil
+}
+
+// decodeFlex decodes a JSON value, keeping numbers as they're written.
+func decodeFlex(data []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&v)
+	return v, err
 }
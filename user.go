@@ -5,16 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"regexp"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var userVerificationRegex = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
 
+// errUserNotFound is returned by newUser when tumblr says the blog
+// doesn't exist. This usually means it was deleted or terminated.
+var errUserNotFound = errors.New("User not found")
+
+// errInvalidName is returned by newUser for names that can't be blogs.
+var errInvalidName = errors.New("Invalid username format")
+
+// usersDoneWg waits for every user to finish up after downloading.
+var usersDoneWg sync.WaitGroup
+
 // UserAction represents what the user is currently doing.
 type UserAction int
 
@@ -38,12 +50,65 @@ type User struct {
 	status        UserAction
 
 	sync.RWMutex
-	filesFound     uint64
-	filesProcessed uint64
+	filesFound      uint64
+	filesProcessed  uint64
+	filesDownloaded uint64
+
+	errors            uint64
+	consecutiveErrors int
+	lastError         string
 
 	done        chan struct{}
 	fileChannel chan File
 
+	// seenPosts maps every post ID found during this scrape to the
+	// names of the files found in that post.
+	seenPosts map[int64][]string
+	// scrapeComplete is set if the scraper walked the whole blog
+	// without errors, which means seenPosts is the full set of posts.
+	scrapeComplete bool
+	// scrapeParsed is set if every post of the blog was parsed by the
+	// current parser, in this session or the unfinished scrape it
+	// continued.
+	scrapeParsed bool
+	// reparsed is set if the posts the current parser parses
+	// differently were parsed again by it during this session.
+	reparsed bool
+	// skippedPage is set if a page of posts couldn't be parsed, and
+	// skipFloor is the newest post found after the last such page. The
+	// last post ID is kept at it, so the next session gets to the
+	// skipped posts again.
+	skippedPage bool
+	skipFloor   int64
+
+	// lastChecked is when the blog was last fully processed.
+	lastChecked time.Time
+
+	// schedule is parsed by parseSchedule. It's empty for blogs that
+	// use the default schedule.
+	schedule   string
+	nextDue    time.Time
+	idleChecks int
+
+	// progress tracks which posts of the current scrape are fully
+	// downloaded, and cursor is where the scrape is. They're saved as
+	// a checkpoint as the scrape goes on. cursor is nil until the
+	// scrape starts.
+	progress *postProgress
+	cursor   *scrapeCursor
+
+	// interrupted is set if the downloader was stopped before the
+	// user was fully scraped and downloaded.
+	interrupted bool
+
+	// forceCheck makes the scraper check the whole blog during this
+	// session, like -force does for every blog.
+	forceCheck bool
+	// Changes requested while a session is running. They're applied
+	// by reset, at the start of the next session.
+	pendingTag    *string
+	pendingRescan bool
+
 	idProcessChan   chan int64
 	fileProcessChan chan int
 
@@ -53,7 +118,7 @@ type User struct {
 func newUser(name string) (*User, error) {
 	// fmt.Println(name, "- Verifying...")
 	if !userVerificationRegex.MatchString(name) {
-		return nil, errors.New("newUser: Invalid username format: " + name)
+		return nil, fmt.Errorf("newUser: %w: %s", errInvalidName, name)
 	}
 
 	query := fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/avatar/16", name)
@@ -70,7 +135,7 @@ func newUser(name string) (*User, error) {
 	// If there is no error while unmarshaling this, then we have valid json.
 	// Which means that this is an invalid user.
 	if json.Unmarshal(contents, &js) == nil {
-		return nil, errors.New("newUser: User not found: " + name)
+		return nil, fmt.Errorf("newUser: %w: %s", errUserNotFound, name)
 	}
 
 	// We have a valid user.
@@ -83,15 +148,124 @@ func newUser(name string) (*User, error) {
 
 		done: make(chan struct{}),
 
+		seenPosts: make(map[int64][]string),
+
 		idProcessChan:   make(chan int64, 10),
 		fileProcessChan: make(chan int, 10),
 	}
 
 	// u.StartHelper()
-	gStats.nowScraping.Blog[u] = true
+	gStats.setActive(u, true)
 	return u, nil
 }
 
+// reset prepares a user for a new download session. Users are kept
+// between sessions in server mode.
+func (u *User) reset() {
+	u.Lock()
+	defer u.Unlock()
+
+	u.status = Scraping
+	u.done = make(chan struct{})
+	u.fileChannel = make(chan File, MaxQueueSize)
+	u.seenPosts = make(map[int64][]string)
+	u.scrapeComplete = false
+	u.scrapeParsed = false
+	u.reparsed = false
+	u.skippedPage = false
+	u.skipFloor = 0
+	u.interrupted = false
+	u.progress = newPostProgress()
+	u.cursor = nil
+	u.consecutiveErrors = 0
+
+	if u.pendingTag != nil {
+		u.tag = *u.pendingTag
+		u.pendingTag = nil
+	}
+	u.forceCheck = u.pendingRescan
+	u.pendingRescan = false
+
+	atomic.StoreUint64(&u.filesFound, 0)
+	atomic.StoreUint64(&u.filesProcessed, 0)
+	atomic.StoreUint64(&u.filesDownloaded, 0)
+	atomic.StoreUint64(&u.errors, 0)
+
+	gStats.setActive(u, true)
+}
+
+// saveCheckpoint stores how far the current scrape got.
+func (u *User) saveCheckpoint() {
+	if dryRun {
+		return
+	}
+	u.RLock()
+	cursor, progress, tag := u.cursor, u.progress, u.tag
+	u.RUnlock()
+
+	if cursor == nil {
+		return
+	}
+	if c, ok := cursor.checkpoint(tag, progress); ok {
+		saveCheckpoint(u.name, c)
+	}
+}
+
+// markInterrupted records that the user wasn't fully scraped or
+// downloaded because the downloader is shutting down.
+func (u *User) markInterrupted() {
+	u.Lock()
+	u.interrupted = true
+	u.Unlock()
+}
+
+// skipPage records that a page of posts was skipped because it couldn't
+// be parsed.
+func (u *User) skipPage() {
+	u.Lock()
+	u.skippedPage = true
+	u.skipFloor = 0
+	u.Unlock()
+	u.progress.hold()
+}
+
+// pastSkipped records the newest post of a page that was parsed, which
+// is below any page skipped before it.
+func (u *User) pastSkipped(id int64) {
+	u.Lock()
+	defer u.Unlock()
+	if u.skippedPage && u.skipFloor == 0 {
+		u.skipFloor = id
+	}
+}
+
+// requestRescan makes the next session check the whole blog.
+func (u *User) requestRescan() {
+	u.Lock()
+	u.pendingRescan = true
+	u.Unlock()
+}
+
+// settings returns the tag and schedule of a user, including changes
+// that haven't been applied yet.
+func (u *User) settings() (tag, schedule string) {
+	u.RLock()
+	defer u.RUnlock()
+
+	tag = u.tag
+	if u.pendingTag != nil {
+		tag = *u.pendingTag
+	}
+	return tag, u.schedule
+}
+
+// setTag changes the tag that's downloaded from the next session on.
+func (u *User) setTag(tag string) {
+	u.Lock()
+	u.pendingTag = &tag
+	u.Unlock()
+}
+
 // StartHelper starts a helper goroutine that keeps track of things
 // such as a user's highest post ID.
 func (u *User) StartHelper() {
@@ -113,8 +287,15 @@ func (u *User) StartHelper() {
 }
 
 // Queue does stuff.
-func (u *User) Queue(p Post) {
+//
+// offset is the offset of the page the post was found on, or -1 for
+// posts that are queued again because they weren't finished before.
+func (u *User) Queue(p Post, offset int) {
 	files := parseDataForFiles(p)
+	u.markSeen(p, files)
+
+	id, _ := p.ID.Int64()
+	u.progress.add(id, offset, len(files))
 
 	counter := len(files)
 	if counter == 0 {
@@ -123,12 +304,42 @@ func (u *User) Queue(p Post) {
 	u.incrementFilesFound(counter)
 
 	timestamp := p.UnixTimestamp
+	meta := newPostMeta(p)
 
 	for _, f := range files {
+		f.PostID = id
+		f.meta = meta
 		u.ProcessFile(f, timestamp)
 	} // Done adding URLs from a single post
 }
 
+// markSeen records that a post and its files were found during this scrape.
+func (u *User) markSeen(p Post, files []File) {
+	id, err := p.ID.Int64()
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.Filename != "" {
+			names = append(names, f.Filename)
+		}
+	}
+
+	u.Lock()
+	u.seenPosts[id] = names
+	u.Unlock()
+}
+
+// hasSeen reports if a post was already found during this scrape.
+func (u *User) hasSeen(id int64) bool {
+	u.RLock()
+	defer u.RUnlock()
+	_, ok := u.seenPosts[id]
+	return ok
+}
+
 // updateHighestPost sends an integer representing a post ID to the
 // user's helper goroutine. It will replace the highest post ID if
 // the value sent is higher than the current highest post. Otherwise,
@@ -155,6 +366,8 @@ func (u *User) updateHighestPost(i int64) {
 	u.RUnlock()
 }
 
+// incrementFilesFound adds i to the number of files found. i may be
+// negative, which is used when a link turns out to lead to nothing.
 func (u *User) incrementFilesFound(i int) {
 	u.downloadWg.Add(i)
 	// u.fileProcessChan <- i
@@ -168,21 +381,63 @@ func (u *User) incrementFilesFound(i int) {
 // finishScraping will wait until all of the scraping goroutines have
 // sent their files to the download queue before closing that queue.
 func (u *User) finishScraping(i int) {
-	fmt.Println("Done scraping for", u.name, "(", i, "pages )")
+	slog.Info("done scraping", "blog", u.name, "pages", i)
 	u.scrapeWg.Wait()
 	u.status = Downloading
 
 	close(u.fileChannel)
+	usersDoneWg.Add(1)
 	go u.Done()
 }
 
 // Done indicates that the user is done everything it's supposed to do.
 func (u *User) Done() {
+	defer usersDoneWg.Done()
 	u.downloadWg.Wait()
-	fmt.Println("Done downloading for", u.name)
+	slog.Info("done downloading", "blog", u.name)
 	close(u.done) // Stop the helper function
-	gStats.nowScraping.Blog[u] = false
-	updateDatabase(u.name, u.highestPostID)
+	gStats.setActive(u, false)
+
+	// A dry run leaves the database, hooks and notifications alone.
+	if dryRun {
+		return
+	}
+
+	// Posts between the last post ID and the highest one may not have
+	// been downloaded if the user was interrupted. The last post ID
+	// stays, and the checkpoint lets the next session continue from
+	// where this one stopped. Skipped pages keep the last post ID
+	// below them, or at 0 if no post was found after them.
+	u.Lock()
+	interrupted := u.interrupted
+	newPosts := u.highestPostID > u.lastPostID
+	if !interrupted {
+		u.lastPostID = u.highestPostID
+		if u.skippedPage {
+			u.lastPostID = u.skipFloor
+		}
+		u.lastChecked = time.Now()
+	}
+	lastPostID := u.lastPostID
+	u.Unlock()
+
+	updateDatabase(u.name, lastPostID)
+	if interrupted {
+		u.saveCheckpoint()
+		slog.Info("stopped early, the blog will be continued next time", "blog", u.name)
+	} else {
+		deleteCheckpoint(u.name)
+		markBlogChecked(u.name, u.lastChecked)
+		if u.scrapeParsed || u.reparsed {
+			markBlogParsed(u.name)
+		}
+		u.scheduleNext(newPosts)
+	}
+	checkDeletedPosts(u)
+	runBlogHook(u)
+	if atomic.LoadUint64(&u.filesDownloaded) != 0 {
+		notifyBlog(u)
+	}
 }
 
 // String implements the Stringer interface.
@@ -194,60 +449,191 @@ func (u *User) String() string {
 //
 // Used mostly with GlobalStats to show per-user download/scrape status.
 func (u *User) GetStatus() string {
+	return u.Snapshot().String()
+}
+
+// Snapshot returns a copy of the user's current stats.
+func (u *User) Snapshot() BlogSnapshot {
+	u.RLock()
+	lastError, lastPostID, interrupted := u.lastError, u.lastPostID, u.interrupted
+	u.RUnlock()
+
+	return BlogSnapshot{
+		Name:            u.name,
+		Status:          u.status.String(),
+		FilesFound:      atomic.LoadUint64(&u.filesFound),
+		FilesProcessed:  atomic.LoadUint64(&u.filesProcessed),
+		FilesDownloaded: atomic.LoadUint64(&u.filesDownloaded),
+		Errors:          atomic.LoadUint64(&u.errors),
+		LastError:       lastError,
+		LastPostID:      lastPostID,
+		Interrupted:     interrupted,
+	}
+}
+
+// String implements the Stringer interface.
+func (b BlogSnapshot) String() string {
 	isLimited := ""
-	filesFound := atomic.LoadUint64(&u.filesFound)
-	filesProcessed := atomic.LoadUint64(&u.filesProcessed)
-	if filesFound-filesProcessed > MaxQueueSize {
+	if b.FilesFound-b.FilesProcessed > MaxQueueSize {
 		isLimited = " [ LIMITED ]"
 	}
 
-	return fmt.Sprint(u.name, " - ", u.status,
-		" ( ", filesProcessed, "/", filesFound, " )", isLimited)
+	return fmt.Sprint(b.Name, " - ", b.Status,
+		" ( ", b.FilesProcessed, "/", b.FilesFound, " )", isLimited)
+}
+
+// recordError keeps track of an error that happened while scraping or
+// downloading. Once the same user fails too often in a row, a failure
+// notification is sent.
+func (u *User) recordError(err error) {
+	atomic.AddUint64(&u.errors, 1)
+
+	recentErrors.Add(u.name, err)
+
+	u.Lock()
+	u.lastError = err.Error()
+	u.consecutiveErrors++
+	n := u.consecutiveErrors
+	u.Unlock()
+
+	// A dry run leaves notifications alone.
+	if n == cfg.Notify.FailureThreshold && !dryRun {
+		notifyFailure(u, err)
+	}
+}
+
+// recordSuccess resets the count of errors in a row.
+func (u *User) recordSuccess() {
+	u.Lock()
+	u.consecutiveErrors = 0
+	u.Unlock()
 }
 
 // ProcessFile processes a given file
 func (u *User) ProcessFile(f File, timestamp int64) {
+	f.User = u
+	f.UnixTimestamp = timestamp
+
+	switch {
+	case f.resolver != nil:
+		// Links still have to be resolved before we know what they
+		// point to, unless they were resolved before.
+		if f.Filename != "" && u.isLinkDownloaded(f) {
+			u.skipFile(f, "link already downloaded")
+			return
+		}
+	case len(f.variants) != 0:
+		// The downloaders check if larger versions of a photo exist,
+		// unless one was already downloaded.
+		if hasPhotoVariant(f) {
+			u.skipFile(f, "larger version already downloaded")
+			return
+		}
+	default:
+		if u.checkFile(f) {
+			return
+		}
+	}
+
+	atomic.AddInt64(&pBar.Total, 1)
+
+	showProgress()
+
+	u.fileChannel <- f
+
+}
+
+// skipFile marks a file as previously downloaded. reason says how it
+// was found, for dry runs.
+func (u *User) skipFile(f File, reason string) {
+	planFile(f, planSkip, reason, -1)
+	u.progress.complete(f.PostID)
+	atomic.AddUint64(&gStats.alreadyExists, 1)
+	atomic.AddUint64(&u.filesProcessed, 1)
+	u.downloadWg.Done()
+}
+
+// findDownloaded checks if a file of the user was already downloaded,
+// and says how it was found. p is where the file is, unless it was
+// converted.
+func (u *User) findDownloaded(name string) (p, reason string, ok bool) {
+	pathname := path.Join(cfg.DownloadDirectory, u.name, name)
+	if _, err := os.Stat(pathname); err == nil {
+		return pathname, "already downloaded", true
+	}
+
+	// The file may have been saved with a different extension, or
+	// converted into another format.
+	if p, ok := FileTracker.Downloaded(name); ok && path.Dir(p) == path.Dir(pathname) {
+		return p, "already downloaded as " + path.Base(p), true
+	}
+	if len(cfg.Convert.Formats) != 0 && isConverted(u.name, name) {
+		return "", "already downloaded and converted", true
+	}
+	return "", "", false
+}
+
+// checkFile checks if a file needs to be downloaded. It returns true if
+// the file already exists, or if it will be hardlinked from another blog
+// once that blog downloads it. Otherwise, the file is registered with the
+// FileTracker, and the caller is expected to download it.
+func (u *User) checkFile(f File) bool {
 	pathname := path.Join(cfg.DownloadDirectory, u.name, f.Filename)
 
 	// If there is a file that exists, we skip adding it and move on to the next one.
 	// Or, if update mode is enabled, then we can simply stop searching.
-	_, err := os.Stat(pathname)
-	if err == nil {
-		atomic.AddUint64(&gStats.alreadyExists, 1)
-		atomic.AddUint64(&u.filesProcessed, 1)
-		u.downloadWg.Done()
-		return
+	if p, reason, ok := u.findDownloaded(f.Filename); ok {
+		// Files downloaded before they were recorded are recorded
+		// now, so they're in the catalog too.
+		if p != "" && !dryRun && !isRecorded(u.name, f.Filename) {
+			f.recordFile(p)
+		}
+		u.skipFile(f, reason)
+		return true
 	}
 	if FileTracker.Add(f.Filename, pathname) {
+		if dryRun {
+			f.planned(planHardlink, "same file as "+FileTracker.Path(f.Filename), -1)
+			return true
+		}
 		go func(oldfile, newfile string) {
 			// Wait until the file is downloaded.
 
 			// fmt.Println(f.User, "Waiting for hardlink")
-			FileTracker.WaitForDownload(oldfile)
+			if !FileTracker.WaitForDownload(oldfile) {
+				// The download was discarded or failed.
+				if stopping() {
+					u.markInterrupted()
+				} else {
+					u.progress.fail(f.PostID)
+					u.progress.complete(f.PostID)
+				}
+				u.downloadWg.Done()
+				return
+			}
 			// fmt.Println(f.User, "Hardlinking")
 
-			FileTracker.Link(oldfile, newfile)
+			linked, err := FileTracker.Link(oldfile, newfile)
+			if err != nil {
+				// The post is tried again next session.
+				slog.Error("can't hardlink a file", f.logFields("from", oldfile, "to", newfile, "err", err)...)
+				u.recordError(err)
+				recordFailure(u.name, causeDownload, f.URL, err)
+				u.progress.fail(f.PostID)
+				u.progress.complete(f.PostID)
+				u.downloadWg.Done()
+				return
+			}
+			f.recordFile(linked)
+			u.progress.complete(f.PostID)
 			u.downloadWg.Done()
 
 			atomic.AddUint64(&u.filesProcessed, 1)
 			atomic.AddUint64(&gStats.hardlinked, 1)
-			var v uint64
-			FileTracker.Lock()
-			v = uint64(FileTracker.m[oldfile].FileInfo().Size())
-			FileTracker.Unlock()
-
-			atomic.AddUint64(&gStats.bytesSaved, v)
+			atomic.AddUint64(&gStats.bytesSaved, uint64(FileTracker.Size(oldfile)))
 		}(f.Filename, pathname)
-		return
+		return true
 	}
 
-	f.User = u
-	f.UnixTimestamp = timestamp
-
-	atomic.AddInt64(&pBar.Total, 1)
-
-	showProgress()
-
-	u.fileChannel <- f
-
+	return false
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"runtime/debug"
+	"strings"
 	"sync"
 )
 
@@ -26,6 +27,9 @@ func (f FileStatus) FileInfo() os.FileInfo {
 	return file
 }
 
+// tracker keeps track of every file that is downloaded or about to be.
+// Files are keyed by their stem, so that the same file is recognized
+// even if it was saved with a different extension than its URL has.
 type tracker struct {
 	sync.Mutex
 	m map[string]FileStatus
@@ -46,13 +50,13 @@ var FileTracker = tracker{m: make(map[string]FileStatus)}
 func (t *tracker) Add(name, path string) bool {
 	t.Lock()
 	defer t.Unlock()
-	if _, ok := t.m[name]; ok {
+	if _, ok := t.m[fileStem(name)]; ok {
 		// Entry exists.
 		return true
 	}
 
 	// Entry does not exist.
-	t.m[name] = FileStatus{
+	t.m[fileStem(name)] = FileStatus{
 		Name:     name,
 		Path:     path,
 		Priority: 0, // TODO(Liru): Add priority to file list when it is implemented
@@ -61,41 +65,133 @@ func (t *tracker) Add(name, path string) bool {
 	return false
 }
 
-func (t *tracker) Link(oldfilename, newpath string) {
+// Link hardlinks a downloaded file to newpath, and returns the path of
+// the link, which has the extension the file was saved with.
+func (t *tracker) Link(oldfilename, newpath string) (string, error) {
 	t.Lock()
 	defer t.Unlock()
-	info := t.m[oldfilename]
-	newInfo := FileInfo(newpath)
-	if !os.SameFile(info.FileInfo(), newInfo) {
+	info := t.m[fileStem(oldfilename)]
+
+	// The file may have been saved with a different extension.
+	newpath = path.Join(path.Dir(newpath), path.Base(info.Path))
+	oldInfo, err := os.Stat(info.Path)
+	if err != nil {
+		return "", err
+	}
+	if !os.SameFile(oldInfo, FileInfo(newpath)) {
 
 		err := os.MkdirAll(path.Dir(newpath), 0755)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
 		os.Remove(newpath)
 		err = os.Link(info.Path, newpath)
 		if err != nil {
-			log.Println(info.Path, " - ", newpath)
-			log.Fatal("t.Link", err)
+			return "", err
 		}
 	}
+	return newpath, nil
 }
 
-func (t *tracker) WaitForDownload(name string) {
+// WaitForDownload waits until a file is downloaded. It returns false if
+// the download was discarded instead.
+func (t *tracker) WaitForDownload(name string) bool {
 	t.Lock()
-	ch := t.m[name].Exists
+	fs, ok := t.m[fileStem(name)]
 	t.Unlock()
-	<-ch
+	if !ok {
+		return false
+	}
+	<-fs.Exists
+
+	t.Lock()
+	defer t.Unlock()
+	_, ok = t.m[fileStem(name)]
+	return ok
+}
+
+// Discard forgets a file that was going to be downloaded to path, but
+// won't be. Anything waiting for it to be downloaded is told so. A file
+// with the same name that's downloaded somewhere else is left alone.
+func (t *tracker) Discard(name, path string) {
+	t.Lock()
+	defer t.Unlock()
+
+	fs, ok := t.m[fileStem(name)]
+	if !ok || fs.Path != path {
+		return
+	}
+
+	select {
+	case <-fs.Exists:
+		// It's already on disk.
+		return
+	default:
+	}
+
+	delete(t.m, fileStem(name))
+	close(fs.Exists)
+}
+
+// Downloaded returns the path of a file with the same stem as name,
+// if one is already on disk.
+func (t *tracker) Downloaded(name string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	fs, ok := t.m[fileStem(name)]
+	if !ok {
+		return "", false
+	}
+
+	select {
+	case <-fs.Exists:
+		return fs.Path, true
+	default:
+		return "", false
+	}
+}
+
+// Path returns where a tracked file is, or is going to be downloaded to.
+func (t *tracker) Path(name string) string {
+	t.Lock()
+	defer t.Unlock()
+	return t.m[fileStem(name)].Path
+}
+
+// Size returns the size of a tracked file.
+func (t *tracker) Size(name string) int64 {
+	t.Lock()
+	defer t.Unlock()
+	info, err := os.Stat(t.m[fileStem(name)].Path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 // Signal informs the goroutines waiting for a file to finish downloading that
-// the file specified is now present on disk. This allows them to hardlink to
-// it.
-func (t *tracker) Signal(file string) {
+// the file specified is now present on disk at filepath. This allows them to
+// hardlink to it.
+func (t *tracker) Signal(file, filepath string) {
 	t.Lock()
 	defer t.Unlock()
-	close(t.m[file].Exists)
+
+	// Files that replace an existing copy, like larger versions of
+	// photos, may already be registered and signalled.
+	fs, ok := t.m[fileStem(file)]
+	if !ok {
+		fs = FileStatus{Name: file, Exists: make(chan struct{})}
+	}
+	fs.Path = filepath
+	t.m[fileStem(file)] = fs
+
+	select {
+	case <-fs.Exists:
+	default:
+		close(fs.Exists)
+	}
 }
 
 // DirectoryScanner implements filepath.WalkFunc, necessary to walk and
@@ -113,7 +209,7 @@ func DirectoryScanner(path string, f os.FileInfo, err error) error {
 		return err
 	}
 
-	if info, ok := FileTracker.m[f.Name()]; ok {
+	if info, ok := FileTracker.m[fileStem(f.Name())]; ok {
 		// File exists.
 		if !os.SameFile(info.FileInfo(), f) {
 			os.Remove(path)
@@ -127,7 +223,7 @@ func DirectoryScanner(path string, f os.FileInfo, err error) error {
 		closedChannel := make(chan struct{})
 		close(closedChannel)
 
-		FileTracker.m[f.Name()] = FileStatus{
+		FileTracker.m[fileStem(f.Name())] = FileStatus{
 			Name:     f.Name(),
 			Path:     path,
 			Priority: 0, // TODO(Liru): Add priority to file list when it is implemented
@@ -140,47 +236,66 @@ func DirectoryScanner(path string, f os.FileInfo, err error) error {
 
 // GetAllCurrentFiles scans the download directory and parses the files inside
 // for possible future linking, if a duplicate is found.
-func GetAllCurrentFiles() {
+func GetAllCurrentFiles() error {
+	FileTracker.Lock()
+	defer FileTracker.Unlock()
+
 	os.MkdirAll(cfg.DownloadDirectory, 0755)
 	dirs, err := ioutil.ReadDir(cfg.DownloadDirectory)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// TODO: Make GetAllCurrentFiles a LOT more stable. A lot could go wrong, but meh.
 
 	for _, d := range dirs {
-		if !d.IsDir() {
+		if !d.IsDir() || d.Name() == deletedDirName || d.Name() == quarantineDirName {
 			continue
 		}
 
 		dir, err := os.Open(cfg.DownloadDirectory + string(os.PathSeparator) + d.Name())
 
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		// fmt.Println(dir.Name())
 		files, err := dir.Readdirnames(0)
+		dir.Close()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		for _, f := range files {
-			if info, ok := FileTracker.m[f]; ok {
+			if strings.HasSuffix(f, partSuffix) {
+				// Left behind by a download that was killed.
+				os.Remove(dir.Name() + string(os.PathSeparator) + f)
+				continue
+			}
+
+			if info, ok := FileTracker.m[fileStem(f)]; ok {
 				// File exists.
 
+				// Same stem, but saved with another type. Leave it be.
+				if info.Name != f {
+					continue
+				}
+
 				p := dir.Name() + string(os.PathSeparator) + f
 
 				checkFile, err := os.Stat(p)
 				if err != nil {
-					log.Fatal(err)
+					return err
+				}
+				oldFile, err := os.Stat(info.Path)
+				if err != nil {
+					return err
 				}
 
-				if !os.SameFile(info.FileInfo(), checkFile) {
+				if !os.SameFile(oldFile, checkFile) {
 					os.Remove(p)
 					err := os.Link(info.Path, p)
 					if err != nil {
-						log.Fatal(err)
+						return err
 					}
 				}
 			} else {
@@ -188,7 +303,7 @@ func GetAllCurrentFiles() {
 				closedChannel := make(chan struct{})
 				close(closedChannel)
 
-				FileTracker.m[f] = FileStatus{
+				FileTracker.m[fileStem(f)] = FileStatus{
 					Name:     f,
 					Path:     dir.Name() + string(os.PathSeparator) + f,
 					Priority: 0, // TODO(Liru): Add priority to file list when it is implemented
@@ -199,6 +314,7 @@ func GetAllCurrentFiles() {
 		}
 
 	}
+	return nil
 }
 
 func FileInfo(s string) os.FileInfo {
@@ -0,0 +1,167 @@
+"use strict";
+
+// The dashboard polls the API, and redraws everything every time.
+const refreshInterval = 2000;
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+async function api(method, url, body) {
+	const opts = { method: method };
+	if (body !== undefined) {
+		opts.headers = { "Content-Type": "application/json" };
+		opts.body = JSON.stringify(body);
+	}
+
+	const resp = await fetch(url, opts);
+	const data = await resp.json();
+	if (!resp.ok) {
+		throw new Error(data.error || resp.statusText);
+	}
+	return data;
+}
+
+// act runs an API call for a button, shows any error, and refreshes.
+async function act(method, url, body) {
+	try {
+		await api(method, url, body);
+		$("message").textContent = "";
+	} catch (err) {
+		$("message").textContent = err.message;
+	}
+	refresh();
+}
+
+function byteSize(n) {
+	const units = ["B", "KB", "MB", "GB", "TB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return n.toFixed(i === 0 ? 0 : 2) + " " + units[i];
+}
+
+function formatTime(s, zero) {
+	const t = new Date(s);
+	if (t.getFullYear() <= 1) {
+		return zero;
+	}
+	return t.toLocaleString();
+}
+
+function cell(row, text, className) {
+	const td = row.insertCell();
+	td.textContent = text;
+	if (className) {
+		td.className = className;
+	}
+	return td;
+}
+
+function button(td, label, onclick) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = onclick;
+	td.appendChild(b);
+}
+
+function blogRow(tbody, b) {
+	const row = tbody.insertRow();
+	if (b.active) {
+		row.className = "active";
+	}
+
+	cell(row, b.name);
+	cell(row, b.tag || "");
+	cell(row, b.active ? b.status : "idle");
+	cell(row, formatTime(b.last_checked, "never"));
+	cell(row, (b.schedule || "default") + ", next " + formatTime(b.next_due, "now"));
+	cell(row, b.last_post_id || "", "number");
+
+	const files = cell(row, b.files_downloaded + " new, " +
+		b.files_processed + " / " + b.files_found + " ", "number");
+	if (b.active && b.files_found > 0) {
+		const p = document.createElement("progress");
+		p.max = b.files_found;
+		p.value = b.files_processed;
+		files.appendChild(p);
+	}
+
+	const errors = cell(row, b.errors || "", "number error");
+	errors.title = b.last_error || "";
+
+	const actions = row.insertCell();
+	const blogURL = "/api/blogs/" + encodeURIComponent(b.name);
+	button(actions, b.rescan_pending ? "Rescan pending" : "Rescan", () =>
+		act("POST", blogURL + "/rescan"));
+	button(actions, "Tag", () => {
+		const tag = prompt("Tag to download for " + b.name + " (empty for everything):", b.tag || "");
+		if (tag !== null) {
+			act("PATCH", blogURL, { tag: tag });
+		}
+	});
+	button(actions, "Schedule", () => {
+		const schedule = prompt("Schedule for " + b.name +
+			", like 6h, @daily or @cron 0 3 * * 1 (empty for the default):", b.schedule || "");
+		if (schedule !== null) {
+			act("PATCH", blogURL, { schedule: schedule });
+		}
+	});
+	button(actions, "Remove", () => {
+		if (confirm("Stop downloading " + b.name + "? Downloaded files are kept.")) {
+			act("DELETE", blogURL);
+		}
+	});
+}
+
+let paused = false;
+
+async function refresh() {
+	let stats, queue, blogs;
+	try {
+		[stats, queue, blogs] = await Promise.all([
+			api("GET", "/api/stats"),
+			api("GET", "/api/queue"),
+			api("GET", "/api/blogs"),
+		]);
+	} catch (err) {
+		$("summary").textContent = "Can't reach the downloader: " + err.message;
+		return;
+	}
+
+	paused = queue.paused;
+	$("pause").textContent = paused ? "Resume" : "Pause";
+	$("summary").textContent =
+		stats.files_downloaded + " files (" + byteSize(stats.bytes_downloaded) +
+		") downloaded, " + queue.depth + " queued" + (paused ? ", paused" : "");
+
+	const filter = $("filter").value.toLowerCase();
+	const tbody = $("blogs");
+	tbody.replaceChildren();
+	blogs.sort((a, b) => a.name.localeCompare(b.name));
+	for (const b of blogs) {
+		if (b.name.toLowerCase().includes(filter)) {
+			blogRow(tbody, b);
+		}
+	}
+}
+
+$("run").onclick = () => act("POST", "/api/run");
+$("pause").onclick = () => act("POST", paused ? "/api/resume" : "/api/pause");
+$("filter").oninput = refresh;
+
+$("add").onsubmit = (e) => {
+	e.preventDefault();
+	const form = e.target.elements;
+	act("POST", "/api/blogs", {
+		name: form.namedItem("name").value,
+		tag: form.namedItem("tag").value,
+		schedule: form.namedItem("schedule").value,
+	});
+	e.target.reset();
+};
+
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+var ytdlpSearch = regexp.MustCompile(`https?:\/\/(?:www\.|m\.)?(?:youtube\.com\/(?:watch\?v=|embed\/)|youtu\.be\/)[\w\-]+`)
+
+// ytdlpTimeout is how long yt-dlp gets to find a video, so one that
+// hangs can't hold up a downloader.
+const ytdlpTimeout = 2 * time.Minute
+
+func init() {
+	registerResolver("ytdlp", func(c ResolverConfig) Resolver {
+		p := c.YtDlpPath
+		if p == "" {
+			p = "yt-dlp"
+		}
+		return ytdlpResolver{path: p}
+	})
+}
+
+// ytdlpResolver hands YouTube links to a locally installed yt-dlp,
+// which finds the URL of the actual video file.
+type ytdlpResolver struct {
+	path string
+}
+
+func (ytdlpResolver) Name() string { return "ytdlp" }
+
+func (ytdlpResolver) Match(s string) []string {
+	if cfg.IgnoreVideos {
+		return nil
+	}
+	return ytdlpSearch.FindAllString(s, -1)
+}
+
+func (r ytdlpResolver) Resolve(link string) ([]File, error) {
+	// It's stopped when downloads are aborted, too.
+	ctx, cancel := context.WithTimeout(abortCtx, ytdlpTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.path, "--dump-json", "--no-playlist",
+		"--format", "best[ext=mp4]/best", link)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait forever on children of yt-dlp that keep its output open.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("yt-dlp: timed out after %s", ytdlpTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var info struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+		Ext string `json:"ext"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return nil, fmt.Errorf("yt-dlp: %s", err)
+	}
+	if info.URL == "" {
+		return nil, errors.New("yt-dlp: no video URL for " + link)
+	}
+
+	f := newFile(info.URL)
+	f.Filename = info.ID + "." + info.Ext
+	return []File{f}, nil
+}